@@ -0,0 +1,78 @@
+package appengine
+
+import (
+	"context"
+	"time"
+
+	"github.com/johnsto/go-passwordless/v2"
+
+	"google.golang.org/appengine/memcache"
+)
+
+// MemcacheKV is a `passwordless.KV` that holds values in memcache, for use
+// with `passwordless.KVStore`.
+type MemcacheKV struct{}
+
+// Get returns the value of the key, or `passwordless.ErrKeyNotFound` if it
+// does not exist.
+func (MemcacheKV) Get(ctx context.Context, key string) ([]byte, error) {
+	it, err := memcache.Get(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return nil, passwordless.ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return it.Value, nil
+}
+
+// Set sets the value of the key, which expires after ttl.
+func (MemcacheKV) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return memcache.Set(ctx, &memcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: ttl,
+	})
+}
+
+// Add sets the value of the key only if it does not already exist,
+// returning false if it does.
+func (MemcacheKV) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	err := memcache.Add(ctx, &memcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: ttl,
+	})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete removes the key, returning `passwordless.ErrKeyNotFound` if it
+// does not exist.
+func (MemcacheKV) Delete(ctx context.Context, key string) error {
+	err := memcache.Delete(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return passwordless.ErrKeyNotFound
+	}
+	return err
+}
+
+// Incr increments the counter held by the key, returning its new value. A
+// missing counter is created with the given ttl.
+func (MemcacheKV) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	// Create the counter with its expiry if it doesn't already exist, as
+	// Increment can't set one
+	err := memcache.Add(ctx, &memcache.Item{
+		Key:        key,
+		Value:      []byte("0"),
+		Expiration: ttl,
+	})
+	if err != nil && err != memcache.ErrNotStored {
+		return 0, err
+	}
+	n, err := memcache.IncrementExisting(ctx, key, 1)
+	return int64(n), err
+}
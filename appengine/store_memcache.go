@@ -6,73 +6,72 @@ import (
 	"github.com/johnsto/go-passwordless/v2"
 
 	"context"
-
-	"github.com/gyepisam/mcf"
-	_ "github.com/gyepisam/mcf/scrypt"
-	"google.golang.org/appengine/memcache"
 )
 
+// MemcacheStore stores tokens in memcache. It is a `passwordless.KVStore`
+// holding tokens in `MemcacheKV`, so each token is held in its own item and
+// consumed by deleting it, and each user's index of tokens is locked while
+// it is updated.
+//
+// Tokens stored by earlier versions, which held all of a user's tokens in a
+// single item, are not read.
 type MemcacheStore struct {
+	// KeyPrefix is prepended to every key written to memcache.
 	KeyPrefix string
+	// MaxTokens is the number of outstanding tokens held for each user. If
+	// zero, `passwordless.DefaultMaxTokens` is used.
+	MaxTokens int
+	// Hasher hashes tokens before they are stored. If nil,
+	// `passwordless.DefaultHasher` is used.
+	Hasher passwordless.TokenHasher
 }
 
-type item struct {
-	hashToken string    `json:"token"`
-	expiresAt time.Time `json:"expires_at"`
-}
-
-func (s MemcacheStore) Store(ctx context.Context, token, uid string, ttl time.Duration) error {
-	hashToken, err := mcf.Create(token)
-	if err != nil {
-		return err
+// kv returns the `passwordless.KVStore` holding the store's tokens.
+func (s MemcacheStore) kv() *passwordless.KVStore {
+	kv := passwordless.NewKVStore(MemcacheKV{})
+	kv.Prefix = s.KeyPrefix
+	kv.Hasher = s.Hasher
+	if s.MaxTokens != 0 {
+		kv.MaxTokens = s.MaxTokens
 	}
+	return kv
+}
 
-	expiresAt := time.Now().Add(ttl)
-	return memcache.JSON.Set(ctx, &memcache.Item{
-		Key:        s.KeyPrefix + uid,
-		Object:     item{hashToken, expiresAt},
-		Expiration: ttl,
-	})
+func (s MemcacheStore) Store(ctx context.Context, token, uid string, scope passwordless.Scope, ttl time.Duration) (string, error) {
+	return s.kv().Store(ctx, token, uid, scope, ttl)
 }
 
 // Exists returns true if a token for the specified user exists.
 func (s MemcacheStore) Exists(ctx context.Context, uid string) (bool, time.Time, error) {
-	v := item{}
-	_, err := memcache.JSON.Get(ctx, s.KeyPrefix+uid, &v)
-	if err == memcache.ErrCacheMiss {
-		// No known token for this user
-		return false, time.Time{}, nil
-	} else {
-		// Token exists and is still valid
-		return true, v.expiresAt, nil
-	}
+	return s.kv().Exists(ctx, uid)
 }
 
-func (s MemcacheStore) Verify(ctx context.Context, token, uid string) (bool, error) {
-	v := item{}
-	_, err := memcache.JSON.Get(ctx, s.KeyPrefix+uid, &v)
-	if err == memcache.ErrCacheMiss {
-		// No token in database
-		return false, passwordless.ErrTokenNotFound
-	} else if err != nil {
-		return false, err
-	}
+// ExistsInScope returns true if a token for the specified user exists
+// within the scope.
+func (s MemcacheStore) ExistsInScope(ctx context.Context, uid string, scope passwordless.Scope) (bool, time.Time, error) {
+	return s.kv().ExistsInScope(ctx, uid, scope)
+}
 
-	if time.Now().After(v.expiresAt) {
-		// Token has actually expired (even if still present in memcache)
-		return false, passwordless.ErrTokenNotFound
-	} else if valid, err := mcf.Verify(token, v.hashToken); err != nil {
-		// Couldn't validate token
-		return false, err
-	} else if !valid {
-		// Token does not validate against hashed token
-		return false, nil
-	} else {
-		// Token is valid!
-		return true, nil
-	}
+// List returns the IDs of the user's tokens.
+func (s MemcacheStore) List(ctx context.Context, uid string) ([]string, error) {
+	return s.kv().List(ctx, uid)
+}
+
+func (s MemcacheStore) Verify(ctx context.Context, token, uid, id string) (bool, passwordless.Scope, error) {
+	return s.kv().Verify(ctx, token, uid, id)
+}
+
+// Consume verifies the token, deleting it if valid and within the scope.
+func (s MemcacheStore) Consume(ctx context.Context, token, uid, id string, scope passwordless.Scope, maxAttempts int) (bool, passwordless.Scope, int, error) {
+	return s.kv().Consume(ctx, token, uid, id, scope, maxAttempts)
+}
+
+// RecordFailure increments the number of failed attempts made against the
+// user's token.
+func (s MemcacheStore) RecordFailure(ctx context.Context, uid, id string) (int, error) {
+	return s.kv().RecordFailure(ctx, uid, id)
 }
 
-func (s MemcacheStore) Delete(ctx context.Context, uid string) error {
-	return memcache.Delete(ctx, s.KeyPrefix+uid)
+func (s MemcacheStore) Delete(ctx context.Context, uid, id string) error {
+	return s.kv().Delete(ctx, uid, id)
 }
@@ -0,0 +1,102 @@
+package passwordless
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"context"
+)
+
+// Outcomes recorded in audit entries.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeError   = "error"
+)
+
+// AuditEntry is a record of an event, suitable for an audit log.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Strategy string    `json:"strategy"`
+	Purpose  string    `json:"purpose,omitempty"`
+	UID      string    `json:"uid"`
+	// Recipient is the masked address the token was sent to.
+	Recipient string `json:"recipient,omitempty"`
+	TokenID   string `json:"token_id,omitempty"`
+	// ClientIP is the address of the client making the request, if the
+	// request was provided with `SetContext`.
+	ClientIP string `json:"client_ip,omitempty"`
+	Outcome  string `json:"outcome"`
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// AuditLogger records audit entries. If set on `Passwordless`, an entry is
+// logged for every event. Errors are written to the standard logger.
+type AuditLogger interface {
+	Log(ctx context.Context, entry AuditEntry) error
+}
+
+// newAuditEntry returns an audit entry describing the event.
+func newAuditEntry(ctx context.Context, e Event) AuditEntry {
+	entry := AuditEntry{
+		Time:      e.Time,
+		Event:     e.Type.String(),
+		Strategy:  e.Strategy,
+		Purpose:   e.Purpose,
+		UID:       e.UID,
+		Recipient: MaskRecipient(e.Recipient),
+		TokenID:   e.ID,
+		Reason:    e.Reason,
+		Outcome:   OutcomeSuccess,
+	}
+	if _, req := fromContext(ctx); req != nil {
+		entry.ClientIP = ClientIP(req.RemoteAddr)
+	}
+	if e.Err != nil {
+		entry.Outcome = OutcomeError
+		entry.Error = e.Err.Error()
+	} else if e.Type == EventVerifyFailed {
+		entry.Outcome = OutcomeFailure
+	}
+	return entry
+}
+
+// audit logs the event with the configured AuditLogger, if any.
+func (p *Passwordless) audit(ctx context.Context, e Event) {
+	if p.Audit == nil {
+		return
+	}
+	if err := p.Audit.Log(ctx, newAuditEntry(ctx, e)); err != nil {
+		log.Printf("passwordless: couldn't write audit log: %v", err)
+	}
+}
+
+// MaskRecipient obscures most of the recipient address, so that it can be
+// logged. Email addresses keep the first character of the local part and
+// the domain; other addresses keep only their last two characters.
+func MaskRecipient(r string) string {
+	if r == "" {
+		return ""
+	}
+	if at := strings.LastIndex(r, "@"); at > 0 {
+		return r[:1] + strings.Repeat("*", at-1) + r[at:]
+	}
+	if len(r) <= 2 {
+		return strings.Repeat("*", len(r))
+	}
+	return strings.Repeat("*", len(r)-2) + r[len(r)-2:]
+}
+
+// ClientIP returns the IP address from a `Request.RemoteAddr` value. If the
+// server is behind a proxy, `RemoteAddr` should be rewritten from trusted
+// forwarding headers before the request reaches Passwordless.
+func ClientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
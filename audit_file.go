@@ -0,0 +1,173 @@
+package passwordless
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"context"
+)
+
+const (
+	// DefaultAuditMaxSize is the default size at which audit logs rotate.
+	DefaultAuditMaxSize = 10 << 20
+	// DefaultAuditMaxBackups is the default number of rotated audit logs
+	// kept.
+	DefaultAuditMaxBackups = 5
+)
+
+// FileAuditLog is an AuditLogger that appends entries to a file as JSON
+// lines. Once the file exceeds MaxSize it is renamed with a numeric suffix
+// (".1" being the most recent), keeping up to MaxBackups old files.
+type FileAuditLog struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	mut        sync.Mutex
+	f          *os.File
+	size       int64
+}
+
+// NewFileAuditLog returns a FileAuditLog writing to the given path.
+func NewFileAuditLog(path string) *FileAuditLog {
+	return &FileAuditLog{
+		Path:       path,
+		MaxSize:    DefaultAuditMaxSize,
+		MaxBackups: DefaultAuditMaxBackups,
+	}
+}
+
+// Log appends the entry to the log file, rotating it if necessary.
+func (l *FileAuditLog) Log(ctx context.Context, entry AuditEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// Close closes the log file.
+func (l *FileAuditLog) Close() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Recent returns up to `n` of the most recent entries for the user, most
+// recent first, searching the current and rotated log files.
+func (l *FileAuditLog) Recent(uid string, n int) ([]AuditEntry, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	entries := []AuditEntry{}
+	for i := 0; i <= l.MaxBackups && len(entries) < n; i++ {
+		es, err := ReadAuditLog(l.backupPath(i), uid)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		// Entries within each file are oldest first
+		for j := len(es) - 1; j >= 0 && len(entries) < n; j-- {
+			entries = append(entries, es[j])
+		}
+	}
+	return entries, nil
+}
+
+// ReadAuditLog reads the entries for the user from the JSON lines file at
+// the given path, in the order they were written. If uid is empty, all
+// entries are returned.
+func ReadAuditLog(path, uid string) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		if uid == "" || entry.UID == uid {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// open opens the log file for appending.
+func (l *FileAuditLog) open() error {
+	f, err := os.OpenFile(l.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate closes the current log file, shifts the existing backups along,
+// and opens a new file.
+func (l *FileAuditLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+
+	if l.MaxBackups <= 0 {
+		if err := os.Remove(l.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.open()
+	}
+	for i := l.MaxBackups - 1; i >= 0; i-- {
+		err := os.Rename(l.backupPath(i), l.backupPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return l.open()
+}
+
+// backupPath returns the path of the nth backup, or the current log file if
+// n is zero.
+func (l *FileAuditLog) backupPath(n int) string {
+	if n == 0 {
+		return l.Path
+	}
+	return fmt.Sprintf("%s.%d", l.Path, n)
+}
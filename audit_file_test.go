@@ -0,0 +1,62 @@
+package passwordless
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := NewFileAuditLog(path)
+	defer l.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, l.Log(nil, AuditEntry{UID: "alice", TokenID: fmt.Sprint(i)}))
+		assert.NoError(t, l.Log(nil, AuditEntry{UID: "bob", TokenID: fmt.Sprint(i)}))
+	}
+
+	entries, err := ReadAuditLog(path, "")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 10)
+
+	entries, err = l.Recent("alice", 3)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "4", entries[0].TokenID)
+	assert.Equal(t, "2", entries[2].TokenID)
+}
+
+func TestFileAuditLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := NewFileAuditLog(path)
+	l.MaxSize = 200
+	l.MaxBackups = 2
+	defer l.Close()
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, l.Log(nil, AuditEntry{UID: "alice", TokenID: fmt.Sprint(i)}))
+	}
+
+	// Check files were rotated, and excess backups removed
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		assert.NoError(t, err)
+		assert.True(t, info.Size() <= l.MaxSize, p)
+	}
+	_, err := os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Check recent entries span files, newest first
+	entries, err := l.Recent("alice", 100)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, entries)
+	assert.True(t, len(entries) < 20)
+	assert.Equal(t, "19", entries[0].TokenID)
+	for i := 1; i < len(entries); i++ {
+		assert.Equal(t, fmt.Sprint(19-i), entries[i].TokenID)
+	}
+}
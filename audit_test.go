@@ -0,0 +1,77 @@
+package passwordless
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memAuditLog struct {
+	entries []AuditEntry
+}
+
+func (l *memAuditLog) Log(ctx context.Context, entry AuditEntry) error {
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	p := New(NewMemStore())
+	audit := &memAuditLog{}
+	p.Audit = audit
+	p.SetTransport("test", &testTransport{}, &testGenerator{token: "1337"}, 5*time.Minute)
+
+	req := httptest.NewRequest("POST", "/token", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	ctx := SetContext(nil, httptest.NewRecorder(), req)
+
+	id, err := p.RequestToken(ctx, "test", "uid", "alice@example.com")
+	assert.NoError(t, err)
+	_, err = p.VerifyToken(ctx, "test", "uid", id, "bad")
+	assert.NoError(t, err)
+
+	assert.Len(t, audit.entries, 3)
+	for _, e := range audit.entries {
+		assert.Equal(t, "192.0.2.1", e.ClientIP)
+		assert.Equal(t, "test", e.Strategy)
+		assert.Equal(t, "uid", e.UID)
+		assert.Equal(t, id, e.TokenID)
+		assert.False(t, e.Time.IsZero())
+	}
+	assert.Equal(t, "token_requested", audit.entries[0].Event)
+	assert.Equal(t, "a****@example.com", audit.entries[0].Recipient)
+	assert.Equal(t, OutcomeSuccess, audit.entries[1].Outcome)
+	assert.Equal(t, "verify_failed", audit.entries[2].Event)
+	assert.Equal(t, OutcomeFailure, audit.entries[2].Outcome)
+	assert.Empty(t, audit.entries[2].Error)
+
+	// Errors are recorded
+	_, err = p.VerifyToken(nil, "test", "uid", "unknown", "1337")
+	assert.Equal(t, ErrTokenNotFound, err)
+	last := audit.entries[len(audit.entries)-1]
+	assert.Equal(t, OutcomeError, last.Outcome)
+	assert.Equal(t, ErrTokenNotFound.Error(), last.Error)
+	assert.Empty(t, last.ClientIP)
+}
+
+func TestMaskRecipient(t *testing.T) {
+	for in, out := range map[string]string{
+		"":                  "",
+		"alice@example.com": "a****@example.com",
+		"a@example.com":     "a@example.com",
+		"+447700900123":     "***********23",
+		"12":                "**",
+	} {
+		assert.Equal(t, out, MaskRecipient(in), in)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", ClientIP("192.0.2.1:1234"))
+	assert.Equal(t, "2001:db8::1", ClientIP("[2001:db8::1]:1234"))
+	assert.Equal(t, "192.0.2.1", ClientIP("192.0.2.1"))
+}
@@ -0,0 +1,155 @@
+package passwordless
+
+import (
+	"sync"
+	"time"
+
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redisConsumedPrefix = "passwordless-consumed::"
+	redisAttemptsPrefix = "passwordless-attempts::"
+)
+
+// ConsumedRegistry records the IDs of tokens that have been used, allowing
+// stores that hold tokens on the client, such as `CookieStore`, to reject
+// tokens that are replayed after being used. IDs need only be remembered
+// until the token they identify expires.
+type ConsumedRegistry interface {
+	// MarkConsumed records that the token of the given ID has been used,
+	// returning false if it had already been marked.
+	MarkConsumed(ctx context.Context, id string, exp time.Time) (bool, error)
+	// IsConsumed returns true if the token of the given ID has been used.
+	IsConsumed(ctx context.Context, id string) (bool, error)
+}
+
+// MemConsumedRegistry is a ConsumedRegistry that holds IDs in memory. It is
+// only suitable where a single process verifies tokens.
+type MemConsumedRegistry struct {
+	mut       sync.Mutex
+	ids       map[string]time.Time
+	attempts  map[string]memAttempts
+	lastPrune time.Time
+}
+
+type memAttempts struct {
+	n   int
+	exp time.Time
+}
+
+// NewMemConsumedRegistry creates and returns a new `MemConsumedRegistry`.
+func NewMemConsumedRegistry() *MemConsumedRegistry {
+	return &MemConsumedRegistry{
+		ids:       make(map[string]time.Time),
+		attempts:  make(map[string]memAttempts),
+		lastPrune: time.Now(),
+	}
+}
+
+func (r *MemConsumedRegistry) MarkConsumed(ctx context.Context, id string, exp time.Time) (bool, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.prune()
+	if e, ok := r.ids[id]; ok && time.Now().Before(e) {
+		return false, nil
+	}
+	r.ids[id] = exp
+	return true, nil
+}
+
+func (r *MemConsumedRegistry) IsConsumed(ctx context.Context, id string) (bool, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	exp, ok := r.ids[id]
+	return ok && time.Now().Before(exp), nil
+}
+
+func (r *MemConsumedRegistry) RecordAttempt(ctx context.Context, id string, exp time.Time) (int, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.prune()
+	a := r.attempts[id]
+	if time.Now().After(a.exp) {
+		a = memAttempts{}
+	}
+	a.n++
+	a.exp = exp
+	r.attempts[id] = a
+	return a.n, nil
+}
+
+// prune discards IDs of expired tokens, at most once a minute. The caller
+// must hold the lock.
+func (r *MemConsumedRegistry) prune() {
+	if time.Since(r.lastPrune) < time.Minute {
+		return
+	}
+	r.lastPrune = time.Now()
+	for id, exp := range r.ids {
+		if time.Now().After(exp) {
+			delete(r.ids, id)
+		}
+	}
+	for id, a := range r.attempts {
+		if time.Now().After(a.exp) {
+			delete(r.attempts, id)
+		}
+	}
+}
+
+// RedisConsumedRegistry is a ConsumedRegistry that holds IDs in Redis, each
+// expiring with the token it identifies.
+type RedisConsumedRegistry struct {
+	// Prefix is prepended to each ID to form its key.
+	Prefix string
+	// AttemptsPrefix is prepended to each ID to form the key holding the
+	// number of failed attempts made against it.
+	AttemptsPrefix string
+
+	client redis.UniversalClient
+}
+
+// NewRedisConsumedRegistry creates and returns a new `RedisConsumedRegistry`.
+func NewRedisConsumedRegistry(client redis.UniversalClient) *RedisConsumedRegistry {
+	return &RedisConsumedRegistry{
+		Prefix:         redisConsumedPrefix,
+		AttemptsPrefix: redisAttemptsPrefix,
+		client:         client,
+	}
+}
+
+func (r *RedisConsumedRegistry) MarkConsumed(ctx context.Context, id string, exp time.Time) (bool, error) {
+	ttl := time.Until(exp)
+	if ttl <= 0 {
+		// Token has expired, so can't be replayed anyway
+		return true, nil
+	}
+	return r.client.SetNX(ctx, r.Prefix+id, 1, ttl).Result()
+}
+
+func (r *RedisConsumedRegistry) IsConsumed(ctx context.Context, id string) (bool, error) {
+	n, err := r.client.Exists(ctx, r.Prefix+id).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *RedisConsumedRegistry) RecordAttempt(ctx context.Context, id string, exp time.Time) (int, error) {
+	key := r.AttemptsPrefix + id
+	// Set the expiry in the same transaction, so the count can't be left
+	// without one
+	var incr *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.PExpireAt(ctx, key, exp)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
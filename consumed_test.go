@@ -0,0 +1,59 @@
+package passwordless
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumedRegistry(t *testing.T) {
+	mr, client := newTestRedis(t)
+	for name, c := range map[string]struct {
+		r ConsumedRegistry
+		// wait lets time pass for the registry
+		wait func(time.Duration)
+	}{
+		"mem":   {NewMemConsumedRegistry(), time.Sleep},
+		"redis": {NewRedisConsumedRegistry(client), mr.FastForward},
+	} {
+		r := c.r
+		ctx := context.Background()
+		consumed, err := r.IsConsumed(ctx, "id")
+		assert.NoError(t, err, name)
+		assert.False(t, consumed, name)
+
+		// IDs can only be marked once
+		ok, err := r.MarkConsumed(ctx, "id", time.Now().Add(time.Hour))
+		assert.NoError(t, err, name)
+		assert.True(t, ok, name)
+		ok, err = r.MarkConsumed(ctx, "id", time.Now().Add(time.Hour))
+		assert.NoError(t, err, name)
+		assert.False(t, ok, name)
+		consumed, err = r.IsConsumed(ctx, "id")
+		assert.NoError(t, err, name)
+		assert.True(t, consumed, name)
+
+		// IDs are forgotten once the token expires
+		ok, err = r.MarkConsumed(ctx, "expiring", time.Now().Add(10*time.Millisecond))
+		assert.NoError(t, err, name)
+		assert.True(t, ok, name)
+		c.wait(20 * time.Millisecond)
+		consumed, err = r.IsConsumed(ctx, "expiring")
+		assert.NoError(t, err, name)
+		assert.False(t, consumed, name)
+
+		// Failed attempts are counted until the token expires
+		a := r.(AttemptRegistry)
+		for i := 1; i <= 3; i++ {
+			n, err := a.RecordAttempt(ctx, "id", time.Now().Add(10*time.Millisecond))
+			assert.NoError(t, err, name)
+			assert.Equal(t, i, n, name)
+		}
+		c.wait(20 * time.Millisecond)
+		n, err := a.RecordAttempt(ctx, "id", time.Now().Add(time.Hour))
+		assert.NoError(t, err, name)
+		assert.Equal(t, 1, n, name)
+	}
+}
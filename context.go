@@ -11,6 +11,10 @@ type ctxKey int
 const (
 	reqKey ctxKey = 1
 	rwKey  ctxKey = 2
+	idKey  ctxKey = 3
+	purKey ctxKey = 4
+	trcKey ctxKey = 5
+	spnKey ctxKey = 6
 )
 
 // SetContext returns a Context containing the specified `ResponseWriter` and
@@ -39,3 +43,42 @@ func fromContext(ctx context.Context) (http.ResponseWriter, *http.Request) {
 	}
 	return rw, req
 }
+
+// withTokenID returns a Context containing the ID of a stored token.
+func withTokenID(ctx context.Context, id string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, idKey, id)
+}
+
+// TokenID returns the ID of the token being delivered, as returned by
+// `TokenStore.Store`. Transports may use it to construct links that refer
+// to a specific token. An empty string is returned if the ID is not known.
+func TokenID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(idKey).(string)
+	return id
+}
+
+// WithPurpose returns a Context specifying the purpose for which tokens are
+// requested or verified, such as "signin" or "change-email". Tokens
+// requested for one purpose cannot be verified for another. If no purpose
+// is set, it is empty.
+func WithPurpose(ctx context.Context, purpose string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, purKey, purpose)
+}
+
+// Purpose returns the purpose set in the Context with `WithPurpose`.
+func Purpose(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	p, _ := ctx.Value(purKey).(string)
+	return p
+}
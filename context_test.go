@@ -31,3 +31,12 @@ func TestContext(t *testing.T) {
 	assert.Equal(t, req, req2)
 	assert.Equal(t, "hello", ctx.Value(testKey))
 }
+
+func TestPurpose(t *testing.T) {
+	assert.Equal(t, "", Purpose(nil))
+	assert.Equal(t, "", Purpose(context.Background()))
+
+	ctx := WithPurpose(nil, "signin")
+	assert.Equal(t, "signin", Purpose(ctx))
+	assert.Equal(t, "change-email", Purpose(WithPurpose(ctx, "change-email")))
+}
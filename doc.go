@@ -26,15 +26,17 @@ When the user wants to sign in, get a list of valid transports with `passwordles
     strategy := r.FormValue("strategy")
     recipient := r.FormValue("recipient")
     user := Users.Find(recipient)
-    err := pw.RequestToken(ctx, strategy, user.ID, recipient)
+    id, err := pw.RequestToken(ctx, strategy, user.ID, recipient)
 
-Then prompt the user to enter the token they received:
+The returned `id` identifies the token among any others the user has requested (for example, on another device). Then prompt the user to enter the token they received:
 
+    strategy := r.FormValue("strategy")
     token := r.FormValue("token")
     uid := r.FormValue("uid")
-    valid, err := pw.VerifyToken(ctx, uid, token)
+    id := r.FormValue("id")
+    valid, err := pw.VerifyToken(ctx, strategy, uid, id, token)
 
-If `valid` is `true`, the user can be considered authenticated and the login process is complete. At this point, you may want to set a secure session cookie to keep the user logged in.
+If `id` is empty, the token is checked against all of the user's outstanding tokens. If `valid` is `true`, the user can be considered authenticated and the login process is complete. At this point, you may want to set a secure session cookie to keep the user logged in.
 
 A complete implementation can be found in the "example" directory.
 
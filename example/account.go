@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/johnsto/go-passwordless/v2"
 )
@@ -57,6 +58,10 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 	recipient := r.FormValue("recipient")
 	uid := r.FormValue("uid")
 
+	// id identifies the token among any others the user has requested. If
+	// empty, all of the user's tokens are checked.
+	id := r.FormValue("id")
+
 	// token is only set if the user is trying to verify a token they've got
 	token := r.FormValue("token")
 
@@ -81,9 +86,14 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 	} else if token == "" {
 		// No token provided in request, so generate a new one and send it
 		// to the user via their preferred transport strategy.
-		err := pw.RequestToken(ctx, strategy, uid, recipient)
+		tid, err := pw.RequestToken(ctx, strategy, uid, recipient)
 
-		if err != nil {
+		if cerr, ok := err.(*passwordless.CooldownError); ok {
+			// User requested another token too soon after the last one.
+			// Their previous token is still valid, so prompt them for it.
+			tokenError = "Please wait " + cerr.Remaining.Round(time.Second).String() +
+				" before requesting another token."
+		} else if err != nil {
 			writeError(w, r, session, http.StatusInternalServerError, Error{
 				Name:        "Internal Error",
 				Description: err.Error(),
@@ -91,9 +101,10 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 			})
 			return
 		}
+		id = tid
 	} else {
 		// User has provided a token, verify it against provided uid.
-		valid, err := pw.VerifyToken(ctx, uid, token)
+		valid, err := pw.VerifyToken(ctx, strategy, uid, id, token)
 
 		if valid {
 			// User provided a valid token! We can safely use the uid as it
@@ -105,7 +116,14 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err == passwordless.ErrTokenNotFound {
+		if err == passwordless.ErrAttemptsExhausted {
+			// Too many incorrect tokens were entered, so the token has been
+			// invalidated and the user must request a new one.
+			session.AddFlash("token_exhausted")
+			session.Save(r, w)
+			http.Redirect(w, r, "/account/signin", http.StatusTemporaryRedirect)
+			return
+		} else if err == passwordless.ErrTokenNotFound {
 			// Token not found, maybe it was a previous one or expired. Either
 			// way, the user will need to attempt sign-in again.
 			session.AddFlash("token_not_found")
@@ -135,12 +153,14 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 		Strategy   string
 		Recipient  string
 		UserID     string
+		TokenID    string
 		Next       string
 		TokenError string
 	}{
 		Strategy:   strategy,
 		Recipient:  recipient,
 		UserID:     uid,
+		TokenID:    id,
 		Context:    getTemplateContext(w, r, session),
 		Next:       r.FormValue("next"),
 		TokenError: tokenError,
@@ -149,6 +169,40 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// linkSuccessHandler is called when the user follows a valid sign-in link.
+func linkSuccessHandler(w http.ResponseWriter, r *http.Request, uid, next string) {
+	session, err := getSession(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// The uid was held within the signed link, and verified alongside the
+	// token, so it can be trusted.
+	session.Values["uid"] = uid
+	session.AddFlash("signed_in")
+	session.Save(r, w)
+	redirect(w, r, next, baseURL)
+}
+
+// linkFailureHandler is called when the user follows a sign-in link that is
+// invalid, or has expired or been used.
+func linkFailureHandler(w http.ResponseWriter, r *http.Request, err error) {
+	session, serr := getSession(w, r)
+	if serr != nil {
+		log.Println(serr)
+		return
+	}
+
+	if err == passwordless.ErrAttemptsExhausted {
+		session.AddFlash("token_exhausted")
+	} else {
+		session.AddFlash("token_not_found")
+	}
+	session.Save(r, w)
+	http.Redirect(w, r, "/account/signin", http.StatusTemporaryRedirect)
+}
+
 func signoutHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := getSession(w, r)
 	if err != nil {
@@ -24,6 +24,9 @@ const SesssionKey string = "go-passwordless-example"
 
 var pw *passwordless.Passwordless
 
+// links builds the sign-in links sent to users
+var links *passwordless.MagicLinks
+
 var (
 	tmpl  *template.Template
 	store sessions.Store
@@ -56,6 +59,16 @@ func main() {
 	}
 	store = sessions.NewCookieStore(cookieKey)
 
+	// Initialise magic link builder, to sign and encrypt the sign-in links
+	// sent to users.
+	linkKey := []byte(os.Getenv("PWL_KEY_MAGIC_LINK"))
+	if len(linkKey) == 0 {
+		log.Println("PWL_KEY_MAGIC_LINK not defined; using random key")
+		linkKey = securecookie.GenerateRandomKey(32)
+	}
+	links = passwordless.NewMagicLinks(baseURL+"/account/link",
+		linkKey, securecookie.GenerateRandomKey(32))
+
 	// Init Passwordless with ephemeral memory store that will hold tokens
 	// util they're used (or expire)
 	tokStore := passwordless.NewMemStore()
@@ -76,12 +89,24 @@ func main() {
 		), passwordless.NewCrockfordGenerator(10), 30*time.Minute)
 	} else {
 		log.Println("No email transport specified, printing codes to stdout")
-		pw.SetTransport("debug", passwordless.LogTransport{
+		s := pw.SetTransport("debug", passwordless.LogTransport{
 			MessageFunc: func(token, uid string) string {
-				return fmt.Sprintf("Login at %s/account/token?strategy=debug&token=%s&uid=%s",
-					baseURL, token, uid)
+				link, err := links.Build(context.Background(), "debug", token, uid, "")
+				if err != nil {
+					return fmt.Sprintf("Couldn't build link: %v", err)
+				}
+				return fmt.Sprintf("Login with %s at %s", token, link)
 			},
 		}, passwordless.NewCrockfordGenerator(4), 30*time.Minute)
+		// Short tokens are easily guessed, so limit attempts to verify them.
+		// Repeated requests within 30 seconds are ignored, leaving the
+		// previous token valid.
+		pw.SetStrategy("debug", passwordless.LimitedStrategy{
+			Strategy: s,
+			Attempts: 5,
+			Cooldown: 30 * time.Second,
+			Coalesce: true,
+		})
 	}
 
 	limiter, err := rateLimiter()
@@ -96,6 +121,12 @@ func main() {
 	http.HandleFunc("/account/signin", signinHandler)
 	http.Handle("/account/token",
 		limiter.RateLimit(http.HandlerFunc(tokenHandler)))
+	http.Handle("/account/link", limiter.RateLimit(passwordless.MagicLinkHandler{
+		Passwordless: pw,
+		Links:        links,
+		OnSuccess:    linkSuccessHandler,
+		OnFailure:    linkFailureHandler,
+	}))
 	http.HandleFunc("/account/signout", signoutHandler)
 
 	// Setup restricted routes that require a valid username
@@ -155,8 +186,10 @@ func emailWriter(ctx context.Context, token, uid, recipient string, w io.Writer)
 		To:      recipient,
 	}
 
-	link := baseURL + "/account/token" +
-		"?strategy=email&token=" + token + "&uid=" + uid
+	link, err := links.Build(ctx, "email", token, uid, "")
+	if err != nil {
+		return err
+	}
 
 	// Ideally these would be populated from templates, but...
 	text := "You (or someone who knows your email address) wants " +
@@ -177,7 +210,7 @@ func emailWriter(ctx context.Context, token, uid, recipient string, w io.Writer)
 	e.AddBody("text/plain", text)
 	e.AddBody("text/html", html)
 
-	_, err := e.Write(w)
+	_, err = e.Write(w)
 
 	return err
 }
@@ -189,7 +222,7 @@ func rateLimiter() (*throttled.HTTPRateLimiter, error) {
 		return nil, err
 	}
 
-	quota := throttled.RateQuota{throttled.PerMin(10), 5}
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(10), MaxBurst: 5}
 
 	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
 	if err != nil {
@@ -3,17 +3,17 @@ module github.com/johnsto/go-passwordless/v2
 go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/go-redis/redis/v8 v8.11.4
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.1
-	github.com/gyepisam/mcf v0.0.0-20181020145543-a4d14a7af431
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
 	github.com/kr/pretty v0.1.0 // indirect
-	github.com/pzduniak/mcf v0.0.0-20160731113721-0ddac5a6d704
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/stretchr/testify v1.7.0
 	github.com/throttled/throttled v2.2.4+incompatible // indirect
-	golang.org/x/crypto v0.0.0-20220131195533-30dcbda58838 // indirect
+	golang.org/x/crypto v0.0.0-20220131195533-30dcbda58838
 	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd // indirect
 	google.golang.org/appengine v1.6.7
 	google.golang.org/protobuf v1.27.1 // indirect
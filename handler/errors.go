@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/johnsto/go-passwordless/v2"
+)
+
+var errMethodNotAllowed = errors.New("method not allowed")
+
+// errorResponse is the response body written by `WriteError`.
+type errorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"description"`
+	RetryAfter  int    `json:"retry_after,omitempty"`
+}
+
+// Status returns the HTTP status code and a short, stable error code for
+// the given error. Unrecognised errors map to 500 Internal Server Error.
+func Status(err error) (int, string) {
+	if _, ok := err.(*passwordless.CooldownError); ok {
+		return http.StatusTooManyRequests, "cooldown"
+	}
+	switch err {
+	case errMethodNotAllowed:
+		return http.StatusMethodNotAllowed, "method_not_allowed"
+	case ErrMissingField:
+		return http.StatusBadRequest, "missing_field"
+	case ErrInvalidBody:
+		return http.StatusBadRequest, "invalid_body"
+	case passwordless.ErrUnknownStrategy:
+		return http.StatusBadRequest, "unknown_strategy"
+	case passwordless.ErrNotValidForContext:
+		return http.StatusBadRequest, "strategy_not_valid"
+	case ErrUnknownUser:
+		return http.StatusNotFound, "unknown_user"
+	case passwordless.ErrTokenNotFound:
+		return http.StatusNotFound, "token_not_found"
+	case passwordless.ErrTokenNotValid:
+		return http.StatusForbidden, "token_not_valid"
+	case passwordless.ErrWrongTokenScope:
+		return http.StatusForbidden, "wrong_token_scope"
+	case passwordless.ErrAttemptsExhausted:
+		return http.StatusForbidden, "attempts_exhausted"
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+// WriteError writes a JSON response describing the error, with the status
+// code returned by `Status`. The descriptions of unrecognised errors are
+// not written, as they may reveal internal details. If the error is a
+// `*passwordless.CooldownError`, the Retry-After header is also set.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := Status(err)
+	resp := errorResponse{
+		Error:       code,
+		Description: http.StatusText(status),
+	}
+	if status != http.StatusInternalServerError {
+		resp.Description = err.Error()
+	}
+	if cerr, ok := err.(*passwordless.CooldownError); ok {
+		resp.RetryAfter = int(math.Ceil(cerr.Remaining.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(resp.RetryAfter))
+	}
+	if status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", http.MethodPost)
+	}
+	writeJSON(w, status, resp)
+}
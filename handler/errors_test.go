@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/johnsto/go-passwordless/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+	for err, status := range map[error]int{
+		passwordless.ErrUnknownStrategy:    http.StatusBadRequest,
+		passwordless.ErrNotValidForContext: http.StatusBadRequest,
+		passwordless.ErrTokenNotFound:      http.StatusNotFound,
+		passwordless.ErrTokenNotValid:      http.StatusForbidden,
+		passwordless.ErrWrongTokenScope:    http.StatusForbidden,
+		passwordless.ErrAttemptsExhausted:  http.StatusForbidden,
+		ErrMissingField:                    http.StatusBadRequest,
+		ErrUnknownUser:                     http.StatusNotFound,
+		errors.New("boom"):                 http.StatusInternalServerError,
+		&passwordless.CooldownError{}:      http.StatusTooManyRequests,
+	} {
+		s, code := Status(err)
+		assert.Equal(t, status, s, err.Error())
+		assert.NotEmpty(t, code)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, nil, &passwordless.CooldownError{Remaining: 1500 * time.Millisecond})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+}
@@ -0,0 +1,232 @@
+// Package handler provides ready-made `http.Handler`s for requesting and
+// verifying passwordless tokens.
+//
+// Both handlers accept either form posts or JSON bodies, and respond with
+// JSON. Errors returned by the library are mapped to appropriate status
+// codes; see `Status`.
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/johnsto/go-passwordless/v2"
+)
+
+const (
+	// IDHeader is the header in which the token ID is returned, and may be
+	// provided instead of the "id" field. This allows clients to carry the
+	// challenge returned by `passwordless.StatelessStore` in a header.
+	IDHeader = "Passwordless-Token-ID"
+
+	// maxBodySize is the maximum size of a request body.
+	maxBodySize = 1 << 16
+)
+
+var (
+	ErrUnknownUser  = errors.New("unknown user")
+	ErrMissingField = errors.New("required field missing")
+	ErrInvalidBody  = errors.New("request body could not be parsed")
+)
+
+// LookupFunc returns the ID of the user with the given recipient address
+// for the named strategy. It should return `ErrUnknownUser` if no such user
+// exists. To avoid revealing which users exist, it may instead return an ID
+// that no user can sign in as.
+type LookupFunc func(ctx context.Context, strategy, recipient string) (string, error)
+
+// SessionFunc is called once a user has been verified, and should issue a
+// session for them, for instance by setting a cookie. `remember` is true if
+// the user asked to stay signed in on this device.
+type SessionFunc func(w http.ResponseWriter, r *http.Request, uid string, remember bool) error
+
+// ErrorFunc writes a response for the given error.
+type ErrorFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// Params holds the values submitted to the handlers.
+type Params struct {
+	Strategy  string `json:"strategy"`
+	Recipient string `json:"recipient"`
+	ID        string `json:"id"`
+	Token     string `json:"token"`
+	Remember  bool   `json:"remember"`
+}
+
+// RequestHandler generates and sends a token to the user identified by the
+// submitted strategy and recipient, responding with the ID of the token.
+type RequestHandler struct {
+	Passwordless *passwordless.Passwordless
+	// Lookup returns the ID of the user to send the token to. If nil, the
+	// recipient is used as the user ID.
+	Lookup LookupFunc
+	// Purpose, if set, binds requested tokens to the given purpose.
+	Purpose string
+	// OnError is called to write the response when an error occurs. If nil,
+	// `WriteError` is used.
+	OnError ErrorFunc
+}
+
+// requestResponse is the response body of RequestHandler.
+type requestResponse struct {
+	ID string `json:"id"`
+}
+
+func (h RequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, err := readParams(w, r)
+	if err == nil && (p.Strategy == "" || p.Recipient == "") {
+		err = ErrMissingField
+	}
+	if err != nil {
+		handleError(h.OnError, w, r, err)
+		return
+	}
+
+	ctx := newContext(w, r, h.Purpose)
+	uid, err := lookup(ctx, h.Lookup, p)
+	if err != nil {
+		handleError(h.OnError, w, r, err)
+		return
+	}
+
+	id, err := h.Passwordless.RequestToken(ctx, p.Strategy, uid, p.Recipient)
+	if err != nil {
+		handleError(h.OnError, w, r, err)
+		return
+	}
+
+	w.Header().Set(IDHeader, id)
+	writeJSON(w, http.StatusOK, requestResponse{ID: id})
+}
+
+// VerifyHandler verifies the token submitted by the user, issuing them a
+// session if it is valid.
+type VerifyHandler struct {
+	Passwordless *passwordless.Passwordless
+	// Lookup returns the ID of the user verifying the token. It should
+	// behave the same as the Lookup function of the corresponding
+	// RequestHandler. If nil, the recipient is used as the user ID.
+	Lookup LookupFunc
+	// Purpose, if set, verifies tokens for the given purpose.
+	Purpose string
+	// IssueSession is called once the user has been verified.
+	IssueSession SessionFunc
+	// OnError is called to write the response when an error occurs. If nil,
+	// `WriteError` is used.
+	OnError ErrorFunc
+}
+
+// verifyResponse is the response body of VerifyHandler.
+type verifyResponse struct {
+	UID string `json:"uid"`
+}
+
+func (h VerifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, err := readParams(w, r)
+	if err == nil && (p.Strategy == "" || p.Recipient == "" || p.Token == "") {
+		err = ErrMissingField
+	}
+	if err != nil {
+		handleError(h.OnError, w, r, err)
+		return
+	}
+
+	ctx := newContext(w, r, h.Purpose)
+	uid, err := lookup(ctx, h.Lookup, p)
+	if err != nil {
+		handleError(h.OnError, w, r, err)
+		return
+	}
+
+	valid, err := h.Passwordless.VerifyToken(ctx, p.Strategy, uid, p.ID, p.Token)
+	if err == nil && !valid {
+		err = passwordless.ErrTokenNotValid
+	}
+	if err != nil {
+		handleError(h.OnError, w, r, err)
+		return
+	}
+
+	if h.IssueSession != nil {
+		if err := h.IssueSession(w, r, uid, p.Remember); err != nil {
+			handleError(h.OnError, w, r, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, verifyResponse{UID: uid})
+}
+
+// readParams reads the parameters from the posted form or JSON body. The
+// token ID is read from `IDHeader` if not present in the body.
+func readParams(w http.ResponseWriter, r *http.Request) (Params, error) {
+	p, err := readBody(w, r)
+	if err == nil && p.ID == "" {
+		p.ID = r.Header.Get(IDHeader)
+	}
+	return p, err
+}
+
+// readBody reads the parameters from the posted form or JSON body.
+func readBody(w http.ResponseWriter, r *http.Request) (Params, error) {
+	p := Params{}
+	if r.Method != http.MethodPost {
+		return p, errMethodNotAllowed
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			return p, ErrInvalidBody
+		}
+		return p, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return p, ErrInvalidBody
+	}
+	p.Strategy = r.PostFormValue("strategy")
+	p.Recipient = r.PostFormValue("recipient")
+	p.ID = r.PostFormValue("id")
+	p.Token = r.PostFormValue("token")
+	p.Remember, _ = strconv.ParseBool(r.PostFormValue("remember"))
+	return p, nil
+}
+
+// newContext returns a context for the request, populated with the
+// ResponseWriter and Request as required by `CookieStore`.
+func newContext(w http.ResponseWriter, r *http.Request, purpose string) context.Context {
+	ctx := passwordless.SetContext(r.Context(), w, r)
+	if purpose != "" {
+		ctx = passwordless.WithPurpose(ctx, purpose)
+	}
+	return ctx
+}
+
+// lookup returns the ID of the user identified by the parameters.
+func lookup(ctx context.Context, f LookupFunc, p Params) (string, error) {
+	if f == nil {
+		return p.Recipient, nil
+	}
+	return f(ctx, p.Strategy, p.Recipient)
+}
+
+// handleError writes the error using the given function, or `WriteError`
+// if nil.
+func handleError(f ErrorFunc, w http.ResponseWriter, r *http.Request, err error) {
+	if f == nil {
+		f = WriteError
+	}
+	f(w, r, err)
+}
+
+// writeJSON writes the value as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnsto/go-passwordless/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTransport struct {
+	token string
+	uid   string
+}
+
+func (t *testTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	t.token = token
+	t.uid = uid
+	return nil
+}
+
+func newTestPasswordless() (*passwordless.Passwordless, *testTransport) {
+	p := passwordless.New(passwordless.NewMemStore())
+	tt := &testTransport{}
+	p.SetTransport("test", tt, passwordless.PINGenerator{Length: 6}, time.Minute)
+	return p, tt
+}
+
+func postForm(h http.Handler, v url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(v.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func postJSON(h http.Handler, p Params) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(p)
+	r := httptest.NewRequest("POST", "/", strings.NewReader(string(b)))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	m := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&m))
+	return m
+}
+
+func TestHandlersForm(t *testing.T) {
+	p, tt := newTestPasswordless()
+	lookup := func(ctx context.Context, strategy, recipient string) (string, error) {
+		if recipient != "alice@example.com" {
+			return "", ErrUnknownUser
+		}
+		return "alice", nil
+	}
+	sessions := []string{}
+	remembered := false
+	rh := RequestHandler{Passwordless: p, Lookup: lookup}
+	vh := VerifyHandler{Passwordless: p, Lookup: lookup,
+		IssueSession: func(w http.ResponseWriter, r *http.Request, uid string, remember bool) error {
+			sessions = append(sessions, uid)
+			remembered = remember
+			return nil
+		}}
+
+	// Request token
+	w := postForm(rh, url.Values{
+		"strategy":  {"test"},
+		"recipient": {"alice@example.com"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	id := decode(t, w)["id"].(string)
+	assert.NotEmpty(t, id)
+	assert.Equal(t, "alice", tt.uid)
+
+	// Verify bad token
+	w = postForm(vh, url.Values{
+		"strategy":  {"test"},
+		"recipient": {"alice@example.com"},
+		"id":        {id},
+		"token":     {"badtoken"},
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "token_not_valid", decode(t, w)["error"])
+	assert.Empty(t, sessions)
+
+	// Verify good token
+	w = postForm(vh, url.Values{
+		"strategy":  {"test"},
+		"recipient": {"alice@example.com"},
+		"id":        {id},
+		"token":     {tt.token},
+		"remember":  {"true"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice", decode(t, w)["uid"])
+	assert.Equal(t, []string{"alice"}, sessions)
+	assert.True(t, remembered)
+
+	// Check token can't be reused
+	w = postForm(vh, url.Values{
+		"strategy":  {"test"},
+		"recipient": {"alice@example.com"},
+		"id":        {id},
+		"token":     {tt.token},
+	})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "token_not_found", decode(t, w)["error"])
+
+	// Check unknown users are refused
+	w = postForm(rh, url.Values{
+		"strategy":  {"test"},
+		"recipient": {"bob@example.com"},
+	})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "unknown_user", decode(t, w)["error"])
+}
+
+func TestHandlersJSON(t *testing.T) {
+	p, tt := newTestPasswordless()
+	rh := RequestHandler{Passwordless: p}
+	vh := VerifyHandler{Passwordless: p}
+
+	// Request token, using the recipient as the uid
+	w := postJSON(rh, Params{Strategy: "test", Recipient: "bob"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, decode(t, w)["id"])
+	assert.Equal(t, "bob", tt.uid)
+
+	// Verify without ID, scanning the user's tokens
+	w = postJSON(vh, Params{Strategy: "test", Recipient: "bob", Token: tt.token})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "bob", decode(t, w)["uid"])
+}
+
+func TestHandlersIDHeader(t *testing.T) {
+	store, err := passwordless.NewStatelessStore(passwordless.CookieKey{
+		SigningKey:    []byte("signing"),
+		AuthKey:       []byte("auth"),
+		EncryptionKey: []byte("encryptionkey-a!"),
+	})
+	assert.NoError(t, err)
+	p := passwordless.New(store)
+	tt := &testTransport{}
+	p.SetTransport("test", tt, passwordless.PINGenerator{Length: 6}, time.Minute)
+	rh := RequestHandler{Passwordless: p}
+	vh := VerifyHandler{Passwordless: p}
+
+	// Challenge is returned in the header
+	w := postJSON(rh, Params{Strategy: "test", Recipient: "alice"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	id := w.Header().Get(IDHeader)
+	assert.NotEmpty(t, id)
+	assert.Equal(t, id, decode(t, w)["id"])
+
+	// and accepted from the header
+	b, _ := json.Marshal(Params{Strategy: "test", Recipient: "alice", Token: tt.token})
+	r := httptest.NewRequest("POST", "/", strings.NewReader(string(b)))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(IDHeader, id)
+	w = httptest.NewRecorder()
+	vh.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice", decode(t, w)["uid"])
+}
+
+func TestHandlersErrors(t *testing.T) {
+	p, tt := newTestPasswordless()
+	p.SetStrategy("limited", passwordless.LimitedStrategy{
+		Strategy: p.Strategies["test"],
+		Cooldown: time.Minute,
+	})
+	rh := RequestHandler{Passwordless: p}
+	vh := VerifyHandler{Passwordless: p}
+
+	// Wrong method
+	w := httptest.NewRecorder()
+	rh.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "POST", w.Header().Get("Allow"))
+
+	// Bad JSON
+	r := httptest.NewRequest("POST", "/", strings.NewReader("{"))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	rh.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_body", decode(t, w)["error"])
+
+	// Missing fields
+	w = postJSON(vh, Params{Strategy: "test", Recipient: "bob"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "missing_field", decode(t, w)["error"])
+
+	// Unknown strategy
+	w = postJSON(rh, Params{Strategy: "madeup", Recipient: "bob"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "unknown_strategy", decode(t, w)["error"])
+
+	// Cooldown
+	w = postJSON(rh, Params{Strategy: "limited", Recipient: "bob"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = postJSON(rh, Params{Strategy: "limited", Recipient: "bob"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, "cooldown", decode(t, w)["error"])
+
+	// Custom error handler
+	var handled error
+	vh.OnError = func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+		w.WriteHeader(http.StatusTeapot)
+	}
+	w = postJSON(vh, Params{Strategy: "test", Recipient: "carol", Token: "123"})
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, passwordless.ErrTokenNotFound, handled)
+
+	// Session errors are reported
+	w = postJSON(rh, Params{Strategy: "test", Recipient: "dave"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	vh = VerifyHandler{Passwordless: p,
+		IssueSession: func(w http.ResponseWriter, r *http.Request, uid string, remember bool) error {
+			return errors.New("session store unavailable")
+		}}
+	w = postJSON(vh, Params{Strategy: "test", Recipient: "dave", Token: tt.token})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	m := decode(t, w)
+	assert.Equal(t, "internal_error", m["error"])
+	assert.NotContains(t, m["description"], "session store")
+}
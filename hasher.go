@@ -0,0 +1,346 @@
+package passwordless
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrUnknownHash = errors.New("the token hash is not in a recognised format")
+	ErrNoPepper    = errors.New("no pepper has been configured")
+)
+
+// TokenHasher hashes tokens before they are stored, and verifies tokens
+// against stored hashes. Hashes should be self-describing, beginning with
+// `$<algorithm>$` followed by any parameters needed to verify them, so that
+// parameters can be changed without invalidating stored tokens.
+type TokenHasher interface {
+	// Hash returns a hash of the token suitable for storage.
+	Hash(token string) ([]byte, error)
+	// Verify returns true if the token matches the hash.
+	Verify(token string, hash []byte) (bool, error)
+}
+
+// DefaultHasher is the hasher used by stores that have not been configured
+// with one.
+var DefaultHasher TokenHasher = NewScryptHasher()
+
+// hasherOrDefault returns h, or DefaultHasher if h is nil.
+func hasherOrDefault(h TokenHasher) TokenHasher {
+	if h == nil {
+		return DefaultHasher
+	}
+	return h
+}
+
+// splitHash splits a hash of the form `$name$field$field...` into its
+// fields, returning ErrUnknownHash if it does not have the given name and
+// number of fields.
+func splitHash(hash []byte, name string, n int) ([]string, error) {
+	prefix := "$" + name + "$"
+	if !bytes.HasPrefix(hash, []byte(prefix)) {
+		return nil, ErrUnknownHash
+	}
+	fields := strings.Split(string(hash[len(prefix):]), "$")
+	if len(fields) != n {
+		return nil, ErrUnknownHash
+	}
+	return fields, nil
+}
+
+// salt returns n random bytes.
+func salt(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Argon2idHasher hashes tokens with Argon2id, in the PHC string format
+// `$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>`.
+type Argon2idHasher struct {
+	// Time is the number of passes over memory.
+	Time uint32
+	// Memory is the amount of memory used, in KiB.
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen int
+}
+
+// NewArgon2idHasher returns an Argon2idHasher with the parameters
+// recommended by RFC 9106 for memory-constrained environments.
+func NewArgon2idHasher() Argon2idHasher {
+	return Argon2idHasher{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+func (h Argon2idHasher) Hash(token string) ([]byte, error) {
+	s, err := salt(h.SaltLen)
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(token), s, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(s),
+		base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+func (h Argon2idHasher) Verify(token string, hash []byte) (bool, error) {
+	fields, err := splitHash(hash, "argon2id", 4)
+	if err != nil {
+		return false, err
+	}
+	var version int
+	var p Argon2idHasher
+	if _, err := fmt.Sscanf(fields[0], "v=%d", &version); err != nil {
+		return false, ErrUnknownHash
+	} else if version != argon2.Version {
+		return false, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(fields[1], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return false, ErrUnknownHash
+	}
+	s, err := base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	test := argon2.IDKey([]byte(token), s, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, test) == 1, nil
+}
+
+// BcryptHasher hashes tokens with bcrypt, in the standard `$2a$<cost>$...`
+// format. Only the first 72 bytes of a token are significant.
+type BcryptHasher struct {
+	Cost int
+}
+
+// NewBcryptHasher returns a BcryptHasher with bcrypt's default cost.
+func NewBcryptHasher() BcryptHasher {
+	return BcryptHasher{Cost: bcrypt.DefaultCost}
+}
+
+func (h BcryptHasher) Hash(token string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(token), h.Cost)
+}
+
+func (h BcryptHasher) Verify(token string, hash []byte) (bool, error) {
+	if !bytes.HasPrefix(hash, []byte("$2")) {
+		return false, ErrUnknownHash
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(token))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ScryptHasher hashes tokens with scrypt, in the format
+// `$scrypt$KeyLen=<n>,N=<n>,R=<n>,P=<n>$<salt>$<key>` used by earlier
+// versions of this package.
+type ScryptHasher struct {
+	// N is the CPU/memory cost, and must be a power of two.
+	N       int
+	R       int
+	P       int
+	KeyLen  int
+	SaltLen int
+}
+
+// NewScryptHasher returns a ScryptHasher with the parameters used by
+// earlier versions of this package.
+func NewScryptHasher() ScryptHasher {
+	return ScryptHasher{
+		N:       1 << 16,
+		R:       10,
+		P:       2,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+func (h ScryptHasher) Hash(token string) ([]byte, error) {
+	s, err := salt(h.SaltLen)
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(token), s, h.N, h.R, h.P, h.KeyLen)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("$scrypt$KeyLen=%d,N=%d,R=%d,P=%d$%s$%s",
+		h.KeyLen, h.N, h.R, h.P,
+		base64.StdEncoding.EncodeToString(s),
+		base64.StdEncoding.EncodeToString(key))), nil
+}
+
+func (h ScryptHasher) Verify(token string, hash []byte) (bool, error) {
+	fields, err := splitHash(hash, "scrypt", 3)
+	if err != nil {
+		return false, err
+	}
+	var p ScryptHasher
+	if _, err := fmt.Sscanf(fields[0], "KeyLen=%d,N=%d,R=%d,P=%d", &p.KeyLen, &p.N, &p.R, &p.P); err != nil {
+		return false, ErrUnknownHash
+	}
+	s, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	key, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	test, err := scrypt.Key([]byte(token), s, p.N, p.R, p.P, p.KeyLen)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, test) == 1, nil
+}
+
+// HMACHasher hashes tokens with HMAC-SHA256 keyed by a secret pepper, in the
+// format `$hmac-sha256$k=<key ID>$<salt>$<mac>`. It is much faster than the
+// other hashers, and as tokens are short-lived, its security rests on the
+// pepper remaining secret rather than on the cost of brute-forcing a stolen
+// hash. The pepper should be at least 32 random bytes, and kept separate
+// from the token store.
+type HMACHasher struct {
+	Pepper []byte
+	// KeyID identifies the pepper, so that it can be rotated.
+	KeyID   string
+	SaltLen int
+}
+
+// NewHMACHasher returns an HMACHasher using the given pepper.
+func NewHMACHasher(pepper []byte) HMACHasher {
+	return HMACHasher{Pepper: pepper, SaltLen: 16}
+}
+
+func (h HMACHasher) mac(token string, s []byte) []byte {
+	m := hmac.New(sha256.New, h.Pepper)
+	m.Write(s)
+	m.Write([]byte(token))
+	return m.Sum(nil)
+}
+
+func (h HMACHasher) Hash(token string) ([]byte, error) {
+	if len(h.Pepper) == 0 {
+		return nil, ErrNoPepper
+	}
+	s, err := salt(h.SaltLen)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("$hmac-sha256$k=%s$%s$%s", h.KeyID,
+		base64.RawStdEncoding.EncodeToString(s),
+		base64.RawStdEncoding.EncodeToString(h.mac(token, s)))), nil
+}
+
+func (h HMACHasher) Verify(token string, hash []byte) (bool, error) {
+	if len(h.Pepper) == 0 {
+		return false, ErrNoPepper
+	}
+	fields, err := splitHash(hash, "hmac-sha256", 3)
+	if err != nil {
+		return false, err
+	}
+	if fields[0] != "k="+h.KeyID {
+		return false, ErrUnknownHash
+	}
+	s, err := base64.RawStdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	mac, err := base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	return hmac.Equal(mac, h.mac(token, s)), nil
+}
+
+// MultiHasher hashes new tokens with the first of its hashers, and verifies
+// tokens with whichever hasher recognises the stored hash. This allows the
+// algorithm or pepper to be changed without invalidating outstanding tokens,
+// by placing the new hasher first and keeping the old ones until any tokens
+// they hashed have expired.
+type MultiHasher []TokenHasher
+
+func (h MultiHasher) Hash(token string) ([]byte, error) {
+	if len(h) == 0 {
+		return DefaultHasher.Hash(token)
+	}
+	return h[0].Hash(token)
+}
+
+func (h MultiHasher) Verify(token string, hash []byte) (bool, error) {
+	for _, hasher := range h {
+		valid, err := hasher.Verify(token, hash)
+		if err != ErrUnknownHash {
+			return valid, err
+		}
+	}
+	return false, ErrUnknownHash
+}
+
+// NewHMACKeyRing returns a MultiHasher that hashes new tokens with the pepper
+// of the current key ID, and verifies tokens hashed with any of the given
+// peppers.
+func NewHMACKeyRing(current string, peppers map[string][]byte) (MultiHasher, error) {
+	if _, ok := peppers[current]; !ok {
+		return nil, ErrNoPepper
+	}
+	h := MultiHasher{HMACHasher{Pepper: peppers[current], KeyID: current, SaltLen: 16}}
+	for kid, pepper := range peppers {
+		if kid != current {
+			h = append(h, HMACHasher{Pepper: pepper, KeyID: kid, SaltLen: 16})
+		}
+	}
+	return h, nil
+}
+
+// builtinHashers recognise hashes created by the unkeyed hashers, with any
+// parameters.
+var builtinHashers = MultiHasher{
+	ScryptHasher{},
+	Argon2idHasher{},
+	BcryptHasher{},
+}
+
+// VerifyHash verifies the token against the hash with the given hasher, or
+// `DefaultHasher` if nil. If the hasher does not recognise the hash, it is
+// verified with the built-in scrypt, Argon2id or bcrypt hasher that created
+// it, so that a store's hasher can be changed without invalidating
+// outstanding tokens. Hashes made with a pepper are only verified by a
+// hasher holding that pepper.
+func VerifyHash(h TokenHasher, token string, hash []byte) (bool, error) {
+	valid, err := hasherOrDefault(h).Verify(token, hash)
+	if err == ErrUnknownHash {
+		return builtinHashers.Verify(token, hash)
+	}
+	return valid, err
+}
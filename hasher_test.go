@@ -0,0 +1,211 @@
+package passwordless
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testHashers are hashers with cheap parameters, for testing.
+var testHashers = map[string]TokenHasher{
+	"argon2id": Argon2idHasher{Time: 1, Memory: 64, Threads: 1, KeyLen: 32, SaltLen: 16},
+	"bcrypt":   BcryptHasher{Cost: 4},
+	"scrypt":   ScryptHasher{N: 1 << 10, R: 8, P: 1, KeyLen: 32, SaltLen: 16},
+	"hmac":     HMACHasher{Pepper: []byte("pepper"), KeyID: "1", SaltLen: 16},
+}
+
+// slowHasher delays verification by the wrapped hasher, so that concurrent
+// requests overlap.
+type slowHasher struct {
+	TokenHasher
+}
+
+func (h slowHasher) Verify(token string, hash []byte) (bool, error) {
+	time.Sleep(5 * time.Millisecond)
+	return h.TokenHasher.Verify(token, hash)
+}
+
+func TestHashers(t *testing.T) {
+	for name, h := range testHashers {
+		hash, err := h.Hash("1337")
+		assert.NoError(t, err, name)
+		assert.True(t, strings.HasPrefix(string(hash), "$"), name)
+
+		valid, err := h.Verify("1337", hash)
+		assert.NoError(t, err, name)
+		assert.True(t, valid, name)
+
+		valid, err = h.Verify("1338", hash)
+		assert.NoError(t, err, name)
+		assert.False(t, valid, name)
+
+		// Hashes are salted
+		other, err := h.Hash("1337")
+		assert.NoError(t, err, name)
+		assert.NotEqual(t, hash, other, name)
+
+		// Hashes from other hashers are not recognised
+		for otherName, other := range testHashers {
+			if otherName == name {
+				continue
+			}
+			_, err := other.Verify("1337", hash)
+			assert.Equal(t, ErrUnknownHash, err, "%s verifying %s", otherName, name)
+		}
+	}
+}
+
+func TestHasherParameters(t *testing.T) {
+	// Hashes are verified with the parameters they were created with
+	h := Argon2idHasher{Time: 1, Memory: 64, Threads: 1, KeyLen: 16, SaltLen: 8}
+	hash, err := h.Hash("1337")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(hash), "$argon2id$v=19$m=64,t=1,p=1$"))
+	valid, err := testHashers["argon2id"].Verify("1337", hash)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// Hashes created by earlier versions can be verified
+	legacy := "$scrypt$KeyLen=32,N=1024,R=10,P=2$wyS4kT+QG4LBIF4/oIW5hA==$ooyZO+swN0FAhgFqmYhawD/90xcg/8wBVy/PjgIt6Do="
+	valid, err = NewScryptHasher().Verify("1337", []byte(legacy))
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// Malformed hashes are rejected
+	_, err = NewScryptHasher().Verify("1337", []byte("$scrypt$KeyLen=32$x$y"))
+	assert.Equal(t, ErrUnknownHash, err)
+}
+
+func TestHMACHasher(t *testing.T) {
+	h := NewHMACHasher([]byte("pepper"))
+	hash, err := h.Hash("1337")
+	assert.NoError(t, err)
+
+	// A different pepper or key ID does not verify
+	valid, err := NewHMACHasher([]byte("other")).Verify("1337", hash)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	h2 := h
+	h2.KeyID = "2"
+	_, err = h2.Verify("1337", hash)
+	assert.Equal(t, ErrUnknownHash, err)
+
+	// A pepper is required
+	_, err = NewHMACHasher(nil).Hash("1337")
+	assert.Equal(t, ErrNoPepper, err)
+}
+
+func TestStoreHasher(t *testing.T) {
+	ms := NewMemStore()
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+	id, err := ms.Store(nil, "1337", "uid", Scope{}, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(ms.shard("uid").data["uid"][id].HashedToken), "$hmac-sha256$k=1$"))
+	valid, _, err := ms.Verify(nil, "1337", "uid", id)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// Outstanding tokens remain valid when the hasher is changed
+	ms.Hasher = testHashers["scrypt"]
+	id2, err := ms.Store(nil, "1337", "uid", Scope{}, time.Minute)
+	assert.NoError(t, err)
+	ms.Hasher = MultiHasher{testHashers["argon2id"], testHashers["hmac"]}
+	for _, id := range []string{id, id2} {
+		valid, _, err = ms.Verify(nil, "1337", "uid", id)
+		assert.NoError(t, err)
+		assert.True(t, valid)
+	}
+}
+
+func TestMultiHasher(t *testing.T) {
+	old := HMACHasher{Pepper: []byte("old"), KeyID: "1", SaltLen: 16}
+	oldHash, err := old.Hash("1337")
+	assert.NoError(t, err)
+
+	// New tokens are hashed with the first hasher, and old ones still verify
+	h := MultiHasher{testHashers["argon2id"], old}
+	hash, err := h.Hash("1337")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(hash), "$argon2id$"))
+	for _, b := range [][]byte{hash, oldHash} {
+		valid, err := h.Verify("1337", b)
+		assert.NoError(t, err)
+		assert.True(t, valid)
+		valid, err = h.Verify("1338", b)
+		assert.NoError(t, err)
+		assert.False(t, valid)
+	}
+
+	// Once removed, old hashes are no longer recognised
+	_, err = MultiHasher{testHashers["argon2id"]}.Verify("1337", oldHash)
+	assert.Equal(t, ErrUnknownHash, err)
+}
+
+func TestHMACKeyRing(t *testing.T) {
+	ring1, err := NewHMACKeyRing("1", map[string][]byte{"1": []byte("pepper1")})
+	assert.NoError(t, err)
+	hash1, err := ring1.Hash("1337")
+	assert.NoError(t, err)
+
+	// Rotate to a new pepper, retaining the old one
+	ring2, err := NewHMACKeyRing("2", map[string][]byte{
+		"1": []byte("pepper1"),
+		"2": []byte("pepper2"),
+	})
+	assert.NoError(t, err)
+	hash2, err := ring2.Hash("1337")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(hash2), "$hmac-sha256$k=2$"))
+	for _, b := range [][]byte{hash1, hash2} {
+		valid, err := ring2.Verify("1337", b)
+		assert.NoError(t, err)
+		assert.True(t, valid)
+	}
+
+	// The current key must be present
+	_, err = NewHMACKeyRing("3", map[string][]byte{"1": []byte("pepper1")})
+	assert.Equal(t, ErrNoPepper, err)
+}
+
+func TestVerifyHash(t *testing.T) {
+	// Hashes made by built-in hashers verify regardless of configured hasher
+	for _, name := range []string{"argon2id", "bcrypt", "scrypt"} {
+		hash, err := testHashers[name].Hash("1337")
+		assert.NoError(t, err)
+		valid, err := VerifyHash(testHashers["hmac"], "1337", hash)
+		assert.NoError(t, err, name)
+		assert.True(t, valid, name)
+	}
+
+	// Peppered hashes require the pepper
+	hash, err := testHashers["hmac"].Hash("1337")
+	assert.NoError(t, err)
+	_, err = VerifyHash(nil, "1337", hash)
+	assert.Equal(t, ErrUnknownHash, err)
+	valid, err := VerifyHash(testHashers["hmac"], "1337", hash)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
+
+func benchmarkHasher(b *testing.B, h TokenHasher) {
+	hash, err := h.Hash("123456")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.Verify("123456", hash); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkArgon2idHasher(b *testing.B) { benchmarkHasher(b, NewArgon2idHasher()) }
+func BenchmarkBcryptHasher(b *testing.B)   { benchmarkHasher(b, NewBcryptHasher()) }
+func BenchmarkScryptHasher(b *testing.B)   { benchmarkHasher(b, NewScryptHasher()) }
+func BenchmarkHMACHasher(b *testing.B) {
+	benchmarkHasher(b, NewHMACHasher([]byte("0123456789abcdef0123456789abcdef")))
+}
@@ -0,0 +1,119 @@
+package passwordless
+
+import (
+	"time"
+
+	"context"
+)
+
+// EventType identifies a stage in the lifecycle of a token.
+type EventType int
+
+const (
+	// EventTokenRequested occurs when a token has been generated and
+	// stored, before it is sent to the user.
+	EventTokenRequested EventType = iota + 1
+	// EventTokenDelivered occurs when a token has been sent to the user.
+	EventTokenDelivered
+	// EventDeliveryFailed occurs when a token could not be sent to the user.
+	EventDeliveryFailed
+	// EventVerifySucceeded occurs when a user has provided a valid token.
+	EventVerifySucceeded
+	// EventVerifyFailed occurs when a token could not be verified, either
+	// because it was incorrect or because an error occurred.
+	EventVerifyFailed
+	// EventTokenDeleted occurs when a token is deleted, because it was used,
+	// too many failed attempts were made against it, or it couldn't be
+	// delivered.
+	EventTokenDeleted
+	// EventTokenExpired occurs when the requested token could not be found,
+	// typically because it has expired or has already been used. Tokens
+	// removed by a store's own expiry mechanism do not cause an event.
+	EventTokenExpired
+)
+
+// Reasons given for EventTokenDeleted.
+const (
+	ReasonConsumed          = "consumed"
+	ReasonAttemptsExhausted = "attempts_exhausted"
+	ReasonDeliveryFailed    = "delivery_failed"
+)
+
+var eventTypeNames = map[EventType]string{
+	EventTokenRequested:  "token_requested",
+	EventTokenDelivered:  "token_delivered",
+	EventDeliveryFailed:  "delivery_failed",
+	EventVerifySucceeded: "verify_succeeded",
+	EventVerifyFailed:    "verify_failed",
+	EventTokenDeleted:    "token_deleted",
+	EventTokenExpired:    "token_expired",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Event describes something that happened to a token.
+type Event struct {
+	Type     EventType
+	Strategy string
+	Purpose  string
+	UID      string
+	// Recipient is the address the token was sent to. It is only known
+	// when the token is requested.
+	Recipient string
+	// ID is the ID of the token, if known.
+	ID string
+	// Reason explains why a token was deleted.
+	Reason string
+	// Time is when the event occurred.
+	Time time.Time
+	// Duration is how long the operation took, where relevant: generating
+	// and storing the token, sending it, or verifying it.
+	Duration time.Duration
+	// Err is the error that occurred, if any.
+	Err error
+}
+
+// with returns a copy of the event of the given type, timed from `start`.
+// A zero start time leaves the duration unset.
+func (e Event) with(t EventType, start time.Time, err error) Event {
+	e.Type = t
+	e.Time = time.Now()
+	if !start.IsZero() {
+		e.Duration = e.Time.Sub(start)
+	}
+	e.Err = err
+	return e
+}
+
+// Observer is notified of events occurring during the lifecycle of tokens.
+// Observers are called synchronously, so should return promptly.
+type Observer interface {
+	Observe(ctx context.Context, e Event)
+}
+
+// ObserverFunc is an adapter allowing an ordinary function to be used as an
+// Observer.
+type ObserverFunc func(ctx context.Context, e Event)
+
+// Observe calls f(ctx, e).
+func (f ObserverFunc) Observe(ctx context.Context, e Event) {
+	f(ctx, e)
+}
+
+// AddObserver registers an observer to be notified of events.
+func (p *Passwordless) AddObserver(o Observer) {
+	p.Observers = append(p.Observers, o)
+}
+
+// emit records the event in the audit log and notifies each observer.
+func (p *Passwordless) emit(ctx context.Context, e Event) {
+	p.audit(ctx, e)
+	for _, o := range p.Observers {
+		o.Observe(ctx, e)
+	}
+}
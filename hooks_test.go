@@ -0,0 +1,94 @@
+package passwordless
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type eventRecorder struct {
+	events []Event
+}
+
+func (r *eventRecorder) Observe(ctx context.Context, e Event) {
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) types() []EventType {
+	ts := make([]EventType, len(r.events))
+	for i, e := range r.events {
+		ts[i] = e.Type
+	}
+	return ts
+}
+
+func TestObserver(t *testing.T) {
+	p := New(NewMemStore())
+	rec := &eventRecorder{}
+	p.AddObserver(rec)
+	tt := &testTransport{}
+	s := p.SetTransport("test", tt, &testGenerator{token: "1337"}, 5*time.Minute)
+	p.SetStrategy("test", LimitedStrategy{Strategy: s, Attempts: 2})
+
+	// Request token
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	assert.Equal(t, []EventType{EventTokenRequested, EventTokenDelivered}, rec.types())
+	for _, e := range rec.events {
+		assert.Equal(t, "test", e.Strategy)
+		assert.Equal(t, "uid", e.UID)
+		assert.Equal(t, "recipient", e.Recipient)
+		assert.Equal(t, id, e.ID)
+		assert.False(t, e.Time.IsZero())
+		assert.NoError(t, e.Err)
+	}
+
+	// Verify token successfully
+	rec.events = nil
+	valid, err := p.VerifyToken(nil, "test", "uid", "", "1337")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, []EventType{EventTokenDeleted, EventVerifySucceeded}, rec.types())
+	assert.Equal(t, ReasonConsumed, rec.events[0].Reason)
+	assert.Equal(t, id, rec.events[1].ID)
+
+	// Verify used token
+	rec.events = nil
+	_, err = p.VerifyToken(nil, "test", "uid", id, "1337")
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.Equal(t, []EventType{EventTokenExpired, EventVerifyFailed}, rec.types())
+	assert.Equal(t, ErrTokenNotFound, rec.events[1].Err)
+
+	// Exhaust attempts
+	id, err = p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	rec.events = nil
+	_, err = p.VerifyToken(nil, "test", "uid", id, "bad")
+	assert.NoError(t, err)
+	assert.Equal(t, []EventType{EventVerifyFailed}, rec.types())
+	assert.NoError(t, rec.events[0].Err)
+	rec.events = nil
+	_, err = p.VerifyToken(nil, "test", "uid", id, "bad")
+	assert.Equal(t, ErrAttemptsExhausted, err)
+	assert.Equal(t, []EventType{EventTokenDeleted, EventVerifyFailed}, rec.types())
+	assert.Equal(t, ReasonAttemptsExhausted, rec.events[0].Reason)
+
+	// Delivery failure
+	tt.err = errors.New("refused send")
+	rec.events = nil
+	_, err = p.RequestToken(nil, "test", "uid", "recipient")
+	assert.Error(t, err)
+	assert.Equal(t, []EventType{EventTokenRequested, EventDeliveryFailed, EventTokenDeleted}, rec.types())
+	assert.Equal(t, tt.err, rec.events[1].Err)
+	assert.Equal(t, ReasonDeliveryFailed, rec.events[2].Reason)
+}
+
+func TestEventTypeString(t *testing.T) {
+	assert.Equal(t, "token_requested", EventTokenRequested.String())
+	assert.Equal(t, "token_expired", EventTokenExpired.String())
+	assert.Equal(t, "unknown", EventType(0).String())
+}
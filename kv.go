@@ -0,0 +1,201 @@
+package passwordless
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	ErrKeyNotFound = errors.New("the key does not exist")
+)
+
+// KV is a key-value cache in which each value expires after a time, such as
+// Redis or memcache. It is the minimum needed by `KVStore` to hold tokens,
+// so that any such cache can back a TokenStore.
+type KV interface {
+	// Get returns the value of the key, or `ErrKeyNotFound` if it does not
+	// exist or has expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set sets the value of the key, which expires after the given
+	// duration. The duration is always positive.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes the key, returning `ErrKeyNotFound` if it does not
+	// exist. Where two requests delete the same key at once, only one must
+	// succeed.
+	Delete(ctx context.Context, key string) error
+}
+
+// KVIncrementer is implemented by KVs that can atomically increment a
+// counter.
+type KVIncrementer interface {
+	// Incr increments the counter held at the key, returning its new
+	// value. If the key does not exist, it is created with a value of 1
+	// that expires after the given duration.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
+
+// KVAdder is implemented by KVs that can atomically set a key only if it
+// does not already exist.
+type KVAdder interface {
+	// Add sets the value of the key as `Set`, returning false and leaving
+	// the key unchanged if it already exists.
+	Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+}
+
+// MemKV is a KV that holds values in memory. It is only suitable where a
+// single process uses the store.
+type MemKV struct {
+	mut       sync.Mutex
+	data      map[string]memKVValue
+	lastPrune time.Time
+}
+
+type memKVValue struct {
+	value   []byte
+	counter int64
+	exp     time.Time
+}
+
+// NewMemKV creates and returns a new `MemKV`.
+func NewMemKV() *MemKV {
+	return &MemKV{
+		data:      make(map[string]memKVValue),
+		lastPrune: time.Now(),
+	}
+}
+
+func (kv *MemKV) Get(ctx context.Context, key string) ([]byte, error) {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	v, ok := kv.get(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte(nil), v.value...), nil
+}
+
+func (kv *MemKV) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	kv.prune()
+	kv.data[key] = memKVValue{
+		value: append([]byte(nil), value...),
+		exp:   time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (kv *MemKV) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	kv.prune()
+	if _, ok := kv.get(key); ok {
+		return false, nil
+	}
+	kv.data[key] = memKVValue{
+		value: append([]byte(nil), value...),
+		exp:   time.Now().Add(ttl),
+	}
+	return true, nil
+}
+
+func (kv *MemKV) Delete(ctx context.Context, key string) error {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	if _, ok := kv.get(key); !ok {
+		return ErrKeyNotFound
+	}
+	delete(kv.data, key)
+	return nil
+}
+
+func (kv *MemKV) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	kv.prune()
+	v, ok := kv.get(key)
+	if !ok {
+		v = memKVValue{exp: time.Now().Add(ttl)}
+	}
+	v.counter++
+	kv.data[key] = v
+	return v.counter, nil
+}
+
+// get returns the unexpired value of the key. The caller must hold the
+// lock.
+func (kv *MemKV) get(key string) (memKVValue, bool) {
+	v, ok := kv.data[key]
+	if !ok || time.Now().After(v.exp) {
+		return memKVValue{}, false
+	}
+	return v, true
+}
+
+// prune discards expired values, at most once a minute. The caller must hold
+// the lock.
+func (kv *MemKV) prune() {
+	if time.Since(kv.lastPrune) < time.Minute {
+		return
+	}
+	kv.lastPrune = time.Now()
+	for key, v := range kv.data {
+		if time.Now().After(v.exp) {
+			delete(kv.data, key)
+		}
+	}
+}
+
+// RedisKV is a KV that holds values in Redis.
+type RedisKV struct {
+	client redis.UniversalClient
+}
+
+// NewRedisKV creates and returns a new `RedisKV`.
+func NewRedisKV(client redis.UniversalClient) *RedisKV {
+	return &RedisKV{client: client}
+}
+
+func (kv *RedisKV) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := kv.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrKeyNotFound
+	}
+	return b, err
+}
+
+func (kv *RedisKV) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return kv.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (kv *RedisKV) Add(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return kv.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (kv *RedisKV) Delete(ctx context.Context, key string) error {
+	n, err := kv.client.Del(ctx, key).Result()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (kv *RedisKV) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	n, err := kv.client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if n == 1 {
+		if err := kv.client.PExpire(ctx, key, ttl).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
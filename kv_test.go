@@ -0,0 +1,70 @@
+package passwordless
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// plainKV hides any optional methods of the wrapped KV.
+type plainKV struct {
+	KV
+}
+
+// slowKV delays reads from the wrapped KV, so that concurrent requests
+// overlap.
+type slowKV struct {
+	*MemKV
+}
+
+func (kv slowKV) Get(ctx context.Context, key string) ([]byte, error) {
+	time.Sleep(time.Millisecond)
+	return kv.MemKV.Get(ctx, key)
+}
+
+func TestKV(t *testing.T) {
+	mr, client := newTestRedis(t)
+	for name, c := range map[string]struct {
+		kv KV
+		// wait lets time pass for the KV
+		wait func(time.Duration)
+	}{
+		"mem":   {NewMemKV(), time.Sleep},
+		"redis": {NewRedisKV(client), mr.FastForward},
+	} {
+		kv := c.kv
+		ctx := context.Background()
+
+		_, err := kv.Get(ctx, "key")
+		assert.Equal(t, ErrKeyNotFound, err, name)
+		assert.Equal(t, ErrKeyNotFound, kv.Delete(ctx, "key"), name)
+
+		// Values can be read until deleted
+		assert.NoError(t, kv.Set(ctx, "key", []byte("value"), time.Hour), name)
+		v, err := kv.Get(ctx, "key")
+		assert.NoError(t, err, name)
+		assert.Equal(t, []byte("value"), v, name)
+		assert.NoError(t, kv.Delete(ctx, "key"), name)
+		assert.Equal(t, ErrKeyNotFound, kv.Delete(ctx, "key"), name)
+
+		// Values expire
+		assert.NoError(t, kv.Set(ctx, "key", []byte("value"), 10*time.Millisecond), name)
+		c.wait(20 * time.Millisecond)
+		_, err = kv.Get(ctx, "key")
+		assert.Equal(t, ErrKeyNotFound, err, name)
+
+		// Counters expire from when they are created
+		inc := kv.(KVIncrementer)
+		for i := int64(1); i <= 3; i++ {
+			n, err := inc.Incr(ctx, "counter", 10*time.Millisecond)
+			assert.NoError(t, err, name)
+			assert.Equal(t, i, n, name)
+		}
+		c.wait(20 * time.Millisecond)
+		n, err := inc.Incr(ctx, "counter", time.Hour)
+		assert.NoError(t, err, name)
+		assert.Equal(t, int64(1), n, name)
+	}
+}
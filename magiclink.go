@@ -0,0 +1,199 @@
+package passwordless
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	// DefaultLinkParam is the query parameter used to hold magic link data.
+	DefaultLinkParam = "link"
+)
+
+var (
+	ErrInvalidLink = errors.New("the link is invalid or has been tampered with")
+)
+
+// DefaultConfirmTemplate is the page shown by `MagicLinkHandler` when a link
+// is opened, asking the user to confirm signing in.
+var DefaultConfirmTemplate = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<form method="POST">
+<input type="hidden" name="{{.Param}}" value="{{.Link}}">
+<button type="submit">Continue signing in</button>
+</form>
+</body>
+</html>
+`))
+
+// MagicLinkConfirmation is passed to the confirmation template of
+// `MagicLinkHandler`.
+type MagicLinkConfirmation struct {
+	// Param is the name of the form field holding the link data.
+	Param string
+	// Link is the link data, to be submitted unchanged.
+	Link string
+}
+
+// MagicLinks builds sign-in links that can be included in messages sent to
+// users, allowing them to sign in with a single click. The link contents are
+// signed and encrypted, so the user ID is not revealed and the link cannot be
+// altered.
+type MagicLinks struct {
+	// BaseURL is the URL that links point to, typically where a
+	// `MagicLinkHandler` is served.
+	BaseURL string
+	// Param is the name of the query parameter holding the link data.
+	Param string
+	cs    *securecookie.SecureCookie
+}
+
+// magicLink holds the contents of a link.
+type magicLink struct {
+	UID      string `json:"u"`
+	Strategy string `json:"s"`
+	Purpose  string `json:"p,omitempty"`
+	ID       string `json:"i,omitempty"`
+	Token    string `json:"t"`
+	Next     string `json:"n,omitempty"`
+}
+
+// NewMagicLinks returns a new link builder pointing at the given base URL.
+// The hash key is used to sign links, and the block key (which should be 16,
+// 24 or 32 bytes long) to encrypt them.
+func NewMagicLinks(baseURL string, hashKey, blockKey []byte) *MagicLinks {
+	cs := securecookie.New(hashKey, blockKey)
+	cs.SetSerializer(securecookie.JSONEncoder{})
+	return &MagicLinks{
+		BaseURL: baseURL,
+		Param:   DefaultLinkParam,
+		cs:      cs,
+	}
+}
+
+// Build returns a link that verifies the given token for the user through
+// the named strategy. `next` is an optional URL to redirect the user to on
+// success. The token ID and purpose are read from the context, so Build
+// should be called with the context passed to `Transport.Send`.
+func (m *MagicLinks) Build(ctx context.Context, strategy, token, uid, next string) (string, error) {
+	u, err := url.Parse(m.BaseURL)
+	if err != nil {
+		return "", err
+	}
+
+	encoded, err := m.cs.Encode(m.Param, magicLink{
+		UID:      uid,
+		Strategy: strategy,
+		Purpose:  Purpose(ctx),
+		ID:       TokenID(ctx),
+		Token:    token,
+		Next:     next,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set(m.Param, encoded)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// parse reads and decodes the link held in the request's query or form.
+func (m *MagicLinks) parse(r *http.Request) (magicLink, error) {
+	l := magicLink{}
+	v := r.FormValue(m.Param)
+	if v == "" {
+		return l, ErrInvalidLink
+	}
+	if err := m.cs.Decode(m.Param, v, &l); err != nil {
+		return l, ErrInvalidLink
+	}
+	return l, nil
+}
+
+// MagicLinkHandler is an `http.Handler` that verifies links built by
+// `MagicLinks`, calling OnSuccess if the token within is valid, or
+// OnFailure otherwise.
+//
+// Opening a link with GET only shows a page asking the user to confirm, and
+// the token is verified when the page's form is submitted with POST. This
+// stops mail scanners and link previews, which fetch links in messages,
+// from consuming the token before the user clicks it.
+type MagicLinkHandler struct {
+	Passwordless *Passwordless
+	Links        *MagicLinks
+	// ConfirmTemplate renders the confirmation page, given a
+	// `MagicLinkConfirmation`. It must post a form holding the link data back
+	// to the link. If nil, `DefaultConfirmTemplate` is used.
+	ConfirmTemplate *template.Template
+	// OnSuccess is called with the verified user ID, and the redirect URL
+	// provided when the link was built.
+	OnSuccess func(w http.ResponseWriter, r *http.Request, uid, next string)
+	// OnFailure is called with the reason verification failed. If the
+	// token was incorrect, the error is `ErrTokenNotValid`.
+	OnFailure func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+func (h MagicLinkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.confirm(w, r)
+	case http.MethodPost:
+		h.verify(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+	}
+}
+
+// confirm shows the page asking the user to confirm the link, without
+// verifying its token.
+func (h MagicLinkHandler) confirm(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.Links.parse(r); err != nil {
+		h.OnFailure(w, r, err)
+		return
+	}
+	tmpl := h.ConfirmTemplate
+	if tmpl == nil {
+		tmpl = DefaultConfirmTemplate
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	tmpl.Execute(w, MagicLinkConfirmation{
+		Param: h.Links.Param,
+		Link:  r.FormValue(h.Links.Param),
+	})
+}
+
+// verify verifies the token held in the submitted link.
+func (h MagicLinkHandler) verify(w http.ResponseWriter, r *http.Request) {
+	l, err := h.Links.parse(r)
+	if err != nil {
+		h.OnFailure(w, r, err)
+		return
+	}
+
+	// Verify within the purpose the link was built for
+	ctx := SetContext(r.Context(), w, r)
+	ctx = WithPurpose(ctx, l.Purpose)
+	valid, err := h.Passwordless.VerifyToken(ctx, l.Strategy, l.UID, l.ID, l.Token)
+	if err == nil && !valid {
+		err = ErrTokenNotValid
+	}
+	if err != nil {
+		h.OnFailure(w, r, err)
+		return
+	}
+
+	h.OnSuccess(w, r, l.UID, l.Next)
+}
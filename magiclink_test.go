@@ -0,0 +1,154 @@
+package passwordless
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type linkTransport struct {
+	links *MagicLinks
+	link  string
+}
+
+func (t *linkTransport) Send(ctx context.Context, token, user, recipient string) error {
+	link, err := t.links.Build(ctx, "test", token, user, "/next?a=b")
+	t.link = link
+	return err
+}
+
+type linkResult struct {
+	uid  string
+	next string
+	err  error
+}
+
+func newLinkHandler(p *Passwordless, m *MagicLinks, r *linkResult) MagicLinkHandler {
+	return MagicLinkHandler{
+		Passwordless: p,
+		Links:        m,
+		OnSuccess: func(w http.ResponseWriter, req *http.Request, uid, next string) {
+			r.uid, r.next = uid, next
+		},
+		OnFailure: func(w http.ResponseWriter, req *http.Request, err error) {
+			r.err = err
+		},
+	}
+}
+
+// postLink returns a request submitting the link's data, as the
+// confirmation form does.
+func postLink(link string) *http.Request {
+	u, _ := url.Parse(link)
+	form := url.Values{DefaultLinkParam: {u.Query().Get(DefaultLinkParam)}}
+	req := httptest.NewRequest("POST", u.Path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestMagicLink(t *testing.T) {
+	m := NewMagicLinks("https://example.com/signin?x=1",
+		[]byte("hashkeyhashkeyhashkeyhashkey1234"),
+		[]byte("blockkeyblockkeyblockkeyblockkey"))
+	p := New(NewMemStore())
+	tt := &linkTransport{links: m}
+	p.SetTransport("test", tt, &testGenerator{token: "1337"}, 5*time.Minute)
+
+	_, err := p.RequestToken(nil, "test", "alice@example.com", "alice@example.com")
+	assert.NoError(t, err)
+
+	// Check link points to base URL and doesn't reveal its contents
+	u, err := url.Parse(tt.link)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", u.Host)
+	assert.Equal(t, "/signin", u.Path)
+	assert.Equal(t, "1", u.Query().Get("x"))
+	assert.NotEmpty(t, u.Query().Get(DefaultLinkParam))
+	assert.NotContains(t, tt.link, "alice")
+	assert.NotContains(t, tt.link, "1337")
+
+	// Check tampered link is rejected
+	r := &linkResult{}
+	h := newLinkHandler(p, m, r)
+	req := httptest.NewRequest("GET", "/signin?link="+
+		strings.ToUpper(u.Query().Get(DefaultLinkParam)), nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, ErrInvalidLink, r.err)
+	assert.Empty(t, r.uid)
+
+	// Check missing link is rejected
+	r = &linkResult{}
+	h = newLinkHandler(p, m, r)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/signin", nil))
+	assert.Equal(t, ErrInvalidLink, r.err)
+
+	// Check opening the link asks for confirmation without using the token
+	r = &linkResult{}
+	h = newLinkHandler(p, m, r)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", tt.link, nil))
+	assert.NoError(t, r.err)
+	assert.Empty(t, r.uid)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `method="POST"`)
+	assert.Contains(t, w.Body.String(), u.Query().Get(DefaultLinkParam))
+	exists, _, err := p.Store.Exists(nil, "alice@example.com")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// Check confirmed link succeeds
+	r = &linkResult{}
+	h = newLinkHandler(p, m, r)
+	h.ServeHTTP(httptest.NewRecorder(), postLink(tt.link))
+	assert.NoError(t, r.err)
+	assert.Equal(t, "alice@example.com", r.uid)
+	assert.Equal(t, "/next?a=b", r.next)
+
+	// Check link can't be used twice
+	r = &linkResult{}
+	h = newLinkHandler(p, m, r)
+	h.ServeHTTP(httptest.NewRecorder(), postLink(tt.link))
+	assert.Equal(t, ErrTokenNotFound, r.err)
+	assert.Empty(t, r.uid)
+
+	// Check other methods are refused
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", tt.link, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestMagicLinkWrongToken(t *testing.T) {
+	m := NewMagicLinks("https://example.com/signin",
+		[]byte("hashkeyhashkeyhashkeyhashkey1234"),
+		[]byte("blockkeyblockkeyblockkeyblockkey"))
+	p := New(NewMemStore())
+	p.SetTransport("test", &testTransport{}, &testGenerator{token: "1337"}, 5*time.Minute)
+
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+
+	// Build link for a token that wasn't issued
+	link, err := m.Build(withTokenID(nil, id), "test", "4242", "uid", "")
+	assert.NoError(t, err)
+
+	r := &linkResult{}
+	h := newLinkHandler(p, m, r)
+	h.ServeHTTP(httptest.NewRecorder(), postLink(link))
+	assert.Equal(t, ErrTokenNotValid, r.err)
+
+	// Check link built for another purpose is refused
+	ctx := WithPurpose(withTokenID(nil, id), "delete-account")
+	link, err = m.Build(ctx, "test", "1337", "uid", "")
+	assert.NoError(t, err)
+
+	r = &linkResult{}
+	h = newLinkHandler(p, m, r)
+	h.ServeHTTP(httptest.NewRecorder(), postLink(link))
+	assert.Equal(t, ErrWrongTokenScope, r.err)
+}
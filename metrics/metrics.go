@@ -0,0 +1,182 @@
+// Package metrics instruments Passwordless, token stores and transports,
+// recording counts and latencies to a `Metrics` implementation.
+//
+// `Registry` is a dependency-free implementation that holds metrics in
+// memory and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/johnsto/go-passwordless/v2"
+)
+
+// Names of the metrics recorded.
+const (
+	EventsTotal       = "passwordless_events_total"
+	EventDuration     = "passwordless_event_duration_seconds"
+	StoreOpsTotal     = "passwordless_store_operations_total"
+	StoreOpDuration   = "passwordless_store_operation_duration_seconds"
+	TransportSends    = "passwordless_transport_sends_total"
+	TransportDuration = "passwordless_transport_send_duration_seconds"
+)
+
+// Results recorded against operations.
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+// Labels are the label names and values of a metric.
+type Labels map[string]string
+
+// Metrics records counters and latency histograms.
+type Metrics interface {
+	// Inc increments the named counter.
+	Inc(name string, labels Labels)
+	// Observe records a duration in the named histogram.
+	Observe(name string, labels Labels, d time.Duration)
+}
+
+// result returns the result label for the error.
+func result(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultOK
+}
+
+// Observer records Passwordless events. Register it with
+// `Passwordless.AddObserver`.
+type Observer struct {
+	Metrics Metrics
+}
+
+// Observe counts the event, and records its duration if it has one.
+func (o Observer) Observe(ctx context.Context, e passwordless.Event) {
+	outcome := result(e.Err)
+	if e.Type == passwordless.EventVerifyFailed && e.Err == nil {
+		outcome = "invalid"
+	}
+	o.Metrics.Inc(EventsTotal, Labels{
+		"event":    e.Type.String(),
+		"strategy": e.Strategy,
+		"outcome":  outcome,
+	})
+	if e.Duration > 0 {
+		o.Metrics.Observe(EventDuration, Labels{
+			"event":    e.Type.String(),
+			"strategy": e.Strategy,
+		}, e.Duration)
+	}
+}
+
+// Transport wraps a Transport, recording the number and duration of sends.
+type Transport struct {
+	passwordless.Transport
+	Metrics Metrics
+	// Name identifies the transport in recorded metrics.
+	Name string
+}
+
+// Send sends the token with the wrapped transport.
+func (t Transport) Send(ctx context.Context, token, uid, recipient string) error {
+	start := time.Now()
+	err := t.Transport.Send(ctx, token, uid, recipient)
+	t.Metrics.Observe(TransportDuration, Labels{"transport": t.Name}, time.Since(start))
+	t.Metrics.Inc(TransportSends, Labels{"transport": t.Name, "result": result(err)})
+	return err
+}
+
+// Store wraps a TokenStore, recording the number and duration of
+// operations.
+type Store struct {
+	passwordless.TokenStore
+	Metrics Metrics
+	// Name identifies the store in recorded metrics.
+	Name string
+}
+
+// record records an operation started at the given time.
+func (s Store) record(op string, start time.Time, err error) {
+	s.Metrics.Observe(StoreOpDuration, Labels{"store": s.Name, "op": op}, time.Since(start))
+	s.Metrics.Inc(StoreOpsTotal, Labels{"store": s.Name, "op": op, "result": result(err)})
+}
+
+func (s Store) Store(ctx context.Context, token, uid string, scope passwordless.Scope, ttl time.Duration) (string, error) {
+	start := time.Now()
+	id, err := s.TokenStore.Store(ctx, token, uid, scope, ttl)
+	s.record("store", start, err)
+	return id, err
+}
+
+func (s Store) Exists(ctx context.Context, uid string) (bool, time.Time, error) {
+	start := time.Now()
+	exists, exp, err := s.TokenStore.Exists(ctx, uid)
+	s.record("exists", start, err)
+	return exists, exp, err
+}
+
+// ExistsInScope checks for tokens within the scope if the wrapped store
+// implements `passwordless.ScopedExister`, or for any of the user's tokens
+// otherwise. Either is recorded as an "exists" operation.
+func (s Store) ExistsInScope(ctx context.Context, uid string, scope passwordless.Scope) (bool, time.Time, error) {
+	se, ok := s.TokenStore.(passwordless.ScopedExister)
+	if !ok {
+		return s.Exists(ctx, uid)
+	}
+	start := time.Now()
+	exists, exp, err := se.ExistsInScope(ctx, uid, scope)
+	s.record("exists", start, err)
+	return exists, exp, err
+}
+
+func (s Store) List(ctx context.Context, uid string) ([]string, error) {
+	start := time.Now()
+	ids, err := s.TokenStore.List(ctx, uid)
+	s.record("list", start, err)
+	return ids, err
+}
+
+func (s Store) Verify(ctx context.Context, token, uid, id string) (bool, passwordless.Scope, error) {
+	start := time.Now()
+	valid, scope, err := s.TokenStore.Verify(ctx, token, uid, id)
+	s.record("verify", start, err)
+	return valid, scope, err
+}
+
+func (s Store) RecordFailure(ctx context.Context, uid, id string) (int, error) {
+	start := time.Now()
+	n, err := s.TokenStore.RecordFailure(ctx, uid, id)
+	s.record("record_failure", start, err)
+	return n, err
+}
+
+func (s Store) Delete(ctx context.Context, uid, id string) error {
+	start := time.Now()
+	err := s.TokenStore.Delete(ctx, uid, id)
+	s.record("delete", start, err)
+	return err
+}
+
+// Consume verifies and deletes the token. If the wrapped store implements
+// `passwordless.TokenConsumer` this is recorded as a single "consume"
+// operation; otherwise the attempt is recorded, and the token verified and
+// deleted, separately, and each operation is recorded.
+func (s Store) Consume(ctx context.Context, token, uid, id string, scope passwordless.Scope, maxAttempts int) (bool, passwordless.Scope, int, error) {
+	c, ok := s.TokenStore.(passwordless.TokenConsumer)
+	if !ok {
+		return passwordless.ConsumeToken(ctx, ops{s}, token, uid, id, scope, maxAttempts)
+	}
+	start := time.Now()
+	valid, ts, n, err := c.Consume(ctx, token, uid, id, scope, maxAttempts)
+	s.record("consume", start, err)
+	return valid, ts, n, err
+}
+
+// ops hides the `Consume` method of a Store, so that each operation made to
+// consume a token is recorded.
+type ops struct {
+	passwordless.TokenStore
+}
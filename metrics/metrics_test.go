@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/johnsto/go-passwordless/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTransport struct {
+	token string
+	err   error
+}
+
+func (t *testTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	t.token = token
+	return t.err
+}
+
+// plainStore hides any optional methods of the wrapped store, so that tokens
+// are verified and deleted separately.
+type plainStore struct {
+	passwordless.TokenStore
+}
+
+func TestInstrumented(t *testing.T) {
+	r := NewRegistry()
+	tt := &testTransport{}
+	p := passwordless.New(Store{
+		TokenStore: plainStore{passwordless.NewMemStore()},
+		Metrics:    r,
+		Name:       "mem",
+	})
+	p.AddObserver(Observer{Metrics: r})
+	p.SetTransport("test", Transport{
+		Transport: tt,
+		Metrics:   r,
+		Name:      "test",
+	}, passwordless.PINGenerator{Length: 4}, time.Minute)
+
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	_, err = p.VerifyToken(nil, "test", "uid", id, "bad")
+	assert.NoError(t, err)
+	valid, err := p.VerifyToken(nil, "test", "uid", id, tt.token)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// Transport
+	assert.Equal(t, 1.0, r.Counter(TransportSends, Labels{"transport": "test", "result": ResultOK}))
+	assert.Equal(t, uint64(1), r.Count(TransportDuration, Labels{"transport": "test"}))
+
+	// Store
+	assert.Equal(t, 1.0, r.Counter(StoreOpsTotal, Labels{"store": "mem", "op": "store", "result": ResultOK}))
+	assert.Equal(t, 2.0, r.Counter(StoreOpsTotal, Labels{"store": "mem", "op": "verify", "result": ResultOK}))
+	assert.Equal(t, 1.0, r.Counter(StoreOpsTotal, Labels{"store": "mem", "op": "delete", "result": ResultOK}))
+	assert.Equal(t, uint64(2), r.Count(StoreOpDuration, Labels{"store": "mem", "op": "verify"}))
+
+	// Events
+	assert.Equal(t, 1.0, r.Counter(EventsTotal, Labels{"event": "token_delivered", "strategy": "test", "outcome": ResultOK}))
+	assert.Equal(t, 1.0, r.Counter(EventsTotal, Labels{"event": "verify_failed", "strategy": "test", "outcome": "invalid"}))
+	assert.Equal(t, 1.0, r.Counter(EventsTotal, Labels{"event": "verify_succeeded", "strategy": "test", "outcome": ResultOK}))
+	assert.Equal(t, uint64(1), r.Count(EventDuration, Labels{"event": "verify_succeeded", "strategy": "test"}))
+
+	// Failed sends
+	tt.err = errors.New("refused send")
+	_, err = p.RequestToken(nil, "test", "uid2", "recipient")
+	assert.Error(t, err)
+	assert.Equal(t, 1.0, r.Counter(TransportSends, Labels{"transport": "test", "result": ResultError}))
+	assert.Equal(t, 1.0, r.Counter(EventsTotal, Labels{"event": "delivery_failed", "strategy": "test", "outcome": ResultError}))
+}
+
+func TestInstrumentedConsumer(t *testing.T) {
+	r := NewRegistry()
+	tt := &testTransport{}
+	p := passwordless.New(Store{
+		TokenStore: passwordless.NewMemStore(),
+		Metrics:    r,
+		Name:       "mem",
+	})
+	p.SetTransport("test", tt, passwordless.PINGenerator{Length: 4}, time.Minute)
+
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	valid, err := p.VerifyToken(nil, "test", "uid", id, tt.token)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	assert.Equal(t, 1.0, r.Counter(StoreOpsTotal, Labels{"store": "mem", "op": "consume", "result": ResultOK}))
+	assert.Equal(t, 0.0, r.Counter(StoreOpsTotal, Labels{"store": "mem", "op": "verify", "result": ResultOK}))
+	assert.Equal(t, 0.0, r.Counter(StoreOpsTotal, Labels{"store": "mem", "op": "delete", "result": ResultOK}))
+}
@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the default upper bounds of histogram buckets, in
+// seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a Metrics implementation holding metrics in memory. It is an
+// `http.Handler` serving the metrics in the Prometheus text exposition
+// format.
+type Registry struct {
+	// Buckets are the upper bounds of histogram buckets, in seconds. They
+	// must not be changed once metrics have been recorded.
+	Buckets    []float64
+	mut        sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// histogram holds the bucket counts of a histogram.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		Buckets:    DefaultBuckets,
+		counters:   map[string]map[string]float64{},
+		histograms: map[string]map[string]*histogram{},
+	}
+}
+
+// Inc increments the named counter.
+func (r *Registry) Inc(name string, labels Labels) {
+	key := formatLabels(labels)
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.counters[name] == nil {
+		r.counters[name] = map[string]float64{}
+	}
+	r.counters[name][key]++
+}
+
+// Observe records a duration in the named histogram.
+func (r *Registry) Observe(name string, labels Labels, d time.Duration) {
+	key := formatLabels(labels)
+	v := d.Seconds()
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.histograms[name] == nil {
+		r.histograms[name] = map[string]*histogram{}
+	}
+	h := r.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(r.Buckets))}
+		r.histograms[name][key] = h
+	}
+	for i, le := range r.Buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Counter returns the value of the counter with the given labels.
+func (r *Registry) Counter(name string, labels Labels) float64 {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.counters[name][formatLabels(labels)]
+}
+
+// Count returns the number of observations made in the histogram with the
+// given labels.
+func (r *Registry) Count(name string, labels Labels) uint64 {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if h := r.histograms[name][formatLabels(labels)]; h != nil {
+		return h.count
+	}
+	return 0
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+// Write writes the metrics in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	for _, name := range sortedNames(r.counters) {
+		if _, err := fmt.Fprintf(w, "# TYPE %s counter\n", name); err != nil {
+			return err
+		}
+		series := r.counters[name]
+		for _, key := range sortedKeys(series) {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", name, braces(key),
+				formatFloat(series[key])); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range sortedHistogramNames(r.histograms) {
+		if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", name); err != nil {
+			return err
+		}
+		series := r.histograms[name]
+		for _, key := range sortedHistogramKeys(series) {
+			h := series[key]
+			for i, le := range r.Buckets {
+				if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name,
+					braces(joinLabels(key, "le", formatFloat(le))), h.counts[i]); err != nil {
+					return err
+				}
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+				name, braces(joinLabels(key, "le", "+Inf")), h.count,
+				name, braces(key), formatFloat(h.sum),
+				name, braces(key), h.count); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// formatLabels returns the labels formatted as a sorted, comma-separated
+// list of name="value" pairs.
+func formatLabels(labels Labels) string {
+	names := make([]string, 0, len(labels))
+	for n := range labels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = n + "=" + quote(labels[n])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// joinLabels appends a label to a formatted list of labels.
+func joinLabels(key, name, value string) string {
+	pair := name + "=" + quote(value)
+	if key == "" {
+		return pair
+	}
+	return key + "," + pair
+}
+
+// labelEscaper escapes label values as required by the exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quote returns the label value escaped and quoted.
+func quote(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// braces wraps a non-empty list of labels in braces.
+func braces(key string) string {
+	if key == "" {
+		return ""
+	}
+	return "{" + key + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedNames returns the names of the metrics in the map, in order.
+func sortedNames(m map[string]map[string]float64) []string {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedKeys returns the label keys of the series in the map, in order.
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedHistogramNames returns the names of the histograms in the map, in
+// order.
+func sortedHistogramNames(m map[string]map[string]*histogram) []string {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedHistogramKeys returns the label keys of the histograms in the map,
+// in order.
+func sortedHistogramKeys(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.Buckets = []float64{0.1, 1}
+	r.Inc("requests_total", Labels{"strategy": "email", "outcome": "ok"})
+	r.Inc("requests_total", Labels{"outcome": "ok", "strategy": "email"})
+	r.Inc("requests_total", Labels{"strategy": "sms \"x\"\n", "outcome": "ok"})
+	r.Observe("send_seconds", nil, 50*time.Millisecond)
+	r.Observe("send_seconds", nil, 500*time.Millisecond)
+	r.Observe("send_seconds", nil, 5*time.Second)
+
+	assert.Equal(t, 2.0, r.Counter("requests_total", Labels{"strategy": "email", "outcome": "ok"}))
+	assert.Equal(t, uint64(3), r.Count("send_seconds", nil))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"))
+	assert.Equal(t, `# TYPE requests_total counter
+requests_total{outcome="ok",strategy="email"} 2
+requests_total{outcome="ok",strategy="sms \"x\"\n"} 1
+# TYPE send_seconds histogram
+send_seconds_bucket{le="0.1"} 1
+send_seconds_bucket{le="1"} 2
+send_seconds_bucket{le="+Inf"} 3
+send_seconds_sum 5.55
+send_seconds_count 3
+`, w.Body.String())
+}
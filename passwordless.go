@@ -2,6 +2,7 @@ package passwordless
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"context"
@@ -12,6 +13,7 @@ var (
 	ErrNoTransport        = errors.New("no transports have been configured")
 	ErrUnknownStrategy    = errors.New("unknown strategy")
 	ErrNotValidForContext = errors.New("strategy not valid for context")
+	ErrAttemptsExhausted  = errors.New("too many failed attempts; a new token must be requested")
 )
 
 // Strategy defines how to send and what tokens to send to users.
@@ -43,10 +45,92 @@ func (s SimpleStrategy) Valid(context.Context) bool {
 	return true
 }
 
+// AttemptLimiter may be implemented by a Strategy to limit the number of
+// failed attempts that can be made to verify each token it generates.
+type AttemptLimiter interface {
+	// MaxAttempts should return the number of failed verification attempts
+	// permitted before a token is invalidated, or zero for no limit.
+	MaxAttempts(context.Context) int
+}
+
+// ResendLimiter may be implemented by a Strategy to limit how frequently
+// tokens can be requested for the same user.
+type ResendLimiter interface {
+	// ResendCooldown should return the minimum period between token
+	// requests for the same user, and whether requests made within this
+	// period should be silently ignored rather than rejected.
+	ResendCooldown(context.Context) (time.Duration, bool)
+}
+
+// CooldownError is returned when a token is requested too soon after the
+// previous one.
+type CooldownError struct {
+	// Remaining is the time until another token may be requested.
+	Remaining time.Duration
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("token requested too soon; try again in %s",
+		e.Remaining.Round(time.Second))
+}
+
+// DeliveryError is returned when a token could not be sent to the user. The
+// stored token is deleted so that it does not remain valid; if this also
+// fails, RollbackErr holds the reason.
+type DeliveryError struct {
+	SendErr     error
+	RollbackErr error
+}
+
+func (e *DeliveryError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("%v (and failed to delete token: %v)",
+			e.SendErr, e.RollbackErr)
+	}
+	return e.SendErr.Error()
+}
+
+// Unwrap returns the error returned by the transport.
+func (e *DeliveryError) Unwrap() error {
+	return e.SendErr
+}
+
+// LimitedStrategy wraps a Strategy, invalidating its tokens once the given
+// number of failed verification attempts have been made against them, and
+// limiting how frequently tokens can be requested.
+type LimitedStrategy struct {
+	Strategy
+	Attempts int
+	// Cooldown is the minimum period between token requests for the same
+	// user. Requests made within this period return a `CooldownError`, or
+	// are ignored if Coalesce is true.
+	Cooldown time.Duration
+	Coalesce bool
+}
+
+// MaxAttempts returns the number of failed verification attempts permitted
+// for each token.
+func (s LimitedStrategy) MaxAttempts(context.Context) int {
+	return s.Attempts
+}
+
+// ResendCooldown returns the minimum period between token requests, and
+// whether requests within this period are coalesced.
+func (s LimitedStrategy) ResendCooldown(context.Context) (time.Duration, bool) {
+	return s.Cooldown, s.Coalesce
+}
+
 // Passwordless holds a set of named strategies and an associated token store.
 type Passwordless struct {
 	Strategies map[string]Strategy
 	Store      TokenStore
+	// Observers are notified of events occurring during the lifecycle of
+	// tokens.
+	Observers []Observer
+	// Audit, if set, records an entry for every event.
+	Audit AuditLogger
+	// Tracer, if set, is used to trace token requests and verification.
+	Tracer Tracer
 }
 
 // New returns a new Passwordless instance with the specified token store.
@@ -103,49 +187,282 @@ func (p *Passwordless) GetStrategy(ctx context.Context, name string) (Strategy,
 	return t, nil
 }
 
-// RequestToken generates and delivers a token to the given user. If the
-// specified strategy is not known or not valid, an error is returned.
-func (p *Passwordless) RequestToken(ctx context.Context, s, uid, recipient string) error {
+// RequestToken generates and delivers a token to the given user, returning
+// an ID identifying the token. If the specified strategy is not known or not
+// valid, an error is returned. The token is bound to the strategy and to any
+// purpose set with `WithPurpose`.
+func (p *Passwordless) RequestToken(ctx context.Context, s, uid, recipient string) (string, error) {
 	if t, err := p.GetStrategy(ctx, s); err != nil {
-		return err
+		return "", err
+	} else {
+		return p.requestToken(ctx, t, scope(ctx, s), uid, recipient)
+	}
+}
+
+// VerifyToken verifies the provided token is valid for the user. The
+// strategy and purpose should be the same as those used to request the
+// token. If the ID returned by `RequestToken` is known, only that token is
+// checked; otherwise an empty ID checks all of the user's outstanding tokens.
+func (p *Passwordless) VerifyToken(ctx context.Context, s, uid, id, token string) (bool, error) {
+	if t, err := p.GetStrategy(ctx, s); err != nil {
+		return false, err
 	} else {
-		return RequestToken(ctx, p.Store, t, uid, recipient)
+		return p.verifyToken(ctx, t, scope(ctx, s), uid, id, token)
 	}
 }
 
-// VerifyToken verifies the provided token is valid.
-func (p *Passwordless) VerifyToken(ctx context.Context, uid, token string) (bool, error) {
-	return VerifyToken(ctx, p.Store, uid, token)
+// scope returns the Scope of tokens for the named strategy and the purpose
+// held in the context.
+func scope(ctx context.Context, s string) Scope {
+	return Scope{
+		Strategy: s,
+		Purpose:  Purpose(ctx),
+	}
 }
 
 // RequestToken generates, saves and delivers a token to the specified
-// recipient.
-func RequestToken(ctx context.Context, s TokenStore, t Strategy, uid, recipient string) error {
-	tok, err := t.Generate(ctx)
+// recipient, returning the ID of the stored token. The ID is also made
+// available to the transport via `TokenID`. The token can only be verified
+// within the given scope. If the token cannot be delivered, it is deleted
+// and a `*DeliveryError` is returned.
+//
+// If the strategy implements `ResendLimiter` and the user's most recent
+// token was requested within the cooldown period, a `*CooldownError` is
+// returned. If the strategy coalesces such requests, no token is sent and
+// an empty ID is returned instead; the user's outstanding tokens remain
+// valid and can be checked by passing an empty ID to `VerifyToken`.
+func RequestToken(ctx context.Context, s TokenStore, t Strategy, scope Scope, uid, recipient string) (string, error) {
+	return (&Passwordless{Store: s}).requestToken(ctx, t, scope, uid, recipient)
+}
+
+// requestToken implements `RequestToken`, notifying observers of each stage.
+func (p *Passwordless) requestToken(ctx context.Context, t Strategy, scope Scope, uid, recipient string) (id string, err error) {
+	ctx, span := p.startSpan(ctx, "Passwordless.RequestToken", scope)
+	defer func() { endSpan(span, err) }()
+
+	s := p.Store
+	if l, ok := t.(ResendLimiter); ok {
+		if remaining, coalesce := cooldown(ctx, s, t, l, scope, uid); remaining > 0 && coalesce {
+			return "", nil
+		} else if remaining > 0 {
+			return "", &CooldownError{Remaining: remaining}
+		}
+	}
+
+	start := time.Now()
+	gctx, gspan := StartSpan(ctx, "Strategy.Generate")
+	tok, err := t.Generate(gctx)
+	endSpan(gspan, err)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// Store token
-	if err := s.Store(ctx, tok, uid, t.TTL(ctx)); err != nil {
-		return err
+	id, err = s.Store(ctx, tok, uid, scope, t.TTL(ctx))
+	if err != nil {
+		return "", err
 	}
+	span.SetAttribute("token_id", id)
+	e := Event{
+		Strategy:  scope.Strategy,
+		Purpose:   scope.Purpose,
+		UID:       uid,
+		Recipient: recipient,
+		ID:        id,
+	}
+	p.emit(ctx, e.with(EventTokenRequested, start, nil))
+
 	// Send token to user
-	if err := t.Send(ctx, tok, uid, recipient); err != nil {
-		return err
+	start = time.Now()
+	sctx, sspan := StartSpan(withTokenID(ctx, id), "Strategy.Send")
+	err = t.Send(sctx, tok, uid, recipient)
+	endSpan(sspan, err)
+	if err != nil {
+		// Nobody received the token, so remove it
+		p.emit(ctx, e.with(EventDeliveryFailed, start, err))
+		derr := &DeliveryError{SendErr: err}
+		derr.RollbackErr = p.deleteToken(ctx, e, id, ReasonDeliveryFailed)
+		return "", derr
 	}
-	return nil
+	p.emit(ctx, e.with(EventTokenDelivered, start, nil))
+	return id, nil
 }
 
-// VerifyToken checks the given token against the provided token store.
-func VerifyToken(ctx context.Context, s TokenStore, uid, token string) (bool, error) {
-	if isValid, err := s.Verify(ctx, token, uid); err != nil {
-		// Failed to validate
-		return false, err
-	} else if !isValid {
-		// Token is not valid
-		return false, nil
+// cooldown returns the time remaining until a token may next be requested
+// for the user, based on the expiry of their most recent token and the TTL
+// of the strategy.
+//
+// If the store implements `ScopedExister`, only tokens within the scope are
+// considered. Otherwise, the most recent token may have been issued by a
+// strategy with a different TTL, so the time it was issued is capped at the
+// current time, and the cooldown is at most the strategy's period.
+func cooldown(ctx context.Context, s TokenStore, t Strategy, l ResendLimiter, scope Scope, uid string) (time.Duration, bool) {
+	period, coalesce := l.ResendCooldown(ctx)
+	if period <= 0 {
+		return 0, coalesce
+	}
+	var exists bool
+	var exp time.Time
+	var err error
+	if se, ok := s.(ScopedExister); ok {
+		exists, exp, err = se.ExistsInScope(ctx, uid, scope)
+	} else {
+		exists, exp, err = s.Exists(ctx, uid)
+	}
+	if err != nil || !exists || exp.IsZero() {
+		// The cooldown is advisory, so allow the request if the time of
+		// the previous request can't be determined.
+		return 0, coalesce
+	}
+	issued := exp.Add(-t.TTL(ctx))
+	if now := time.Now(); issued.After(now) {
+		issued = now
+	}
+	return period - time.Since(issued), coalesce
+}
+
+// VerifyToken checks the given token against the provided token store. The
+// token is first passed through the strategy's `Sanitize` method to correct
+// any transcription errors made by the user.
+//
+// The stored token must have been issued within the given scope, otherwise
+// `ErrWrongTokenScope` is returned. If `id` is empty, the token is checked
+// against each of the user's outstanding tokens within the scope. Only the
+// matching token is deleted, leaving any others valid.
+//
+// If the strategy implements `AttemptLimiter`, each attempt is recorded
+// against each token checked before the token is verified, so that
+// concurrent attempts cannot exceed the limit, and once the limit is reached
+// the token is deleted. `ErrAttemptsExhausted` is returned if this leaves
+// the user without a valid token.
+func VerifyToken(ctx context.Context, s TokenStore, t Strategy, scope Scope, uid, id, token string) (bool, error) {
+	return (&Passwordless{Store: s}).verifyToken(ctx, t, scope, uid, id, token)
+}
+
+// verifyToken implements `VerifyToken`, notifying observers of the outcome.
+func (p *Passwordless) verifyToken(ctx context.Context, t Strategy, scope Scope, uid, id, token string) (bool, error) {
+	ctx, span := p.startSpan(ctx, "Passwordless.VerifyToken", scope)
+	start := time.Now()
+	e := Event{
+		Strategy: scope.Strategy,
+		Purpose:  scope.Purpose,
+		UID:      uid,
+		ID:       id,
+	}
+	valid, tid, err := p.checkToken(ctx, t, scope, uid, id, token, e)
+	e.ID = tid
+	span.SetAttribute("token_id", tid)
+	span.SetAttribute("valid", valid)
+	endSpan(span, err)
+	if valid {
+		p.emit(ctx, e.with(EventVerifySucceeded, start, err))
 	} else {
-		// Token *is* valid; remove old token
-		return true, s.Delete(ctx, uid)
+		p.emit(ctx, e.with(EventVerifyFailed, start, err))
+	}
+	return valid, err
+}
+
+// checkToken verifies the token, returning the ID of the token found to be
+// valid, if any.
+func (p *Passwordless) checkToken(ctx context.Context, t Strategy, scope Scope, uid, id, token string, e Event) (bool, string, error) {
+	s := p.Store
+	token, err := t.Sanitize(ctx, token)
+	if err != nil {
+		return false, id, err
 	}
+
+	// Determine which tokens to check
+	scan := id == ""
+	ids := []string{id}
+	if scan {
+		if ids, err = s.List(ctx, uid); err != nil {
+			return false, id, err
+		}
+	}
+
+	// Attempts are limited if the strategy requires it
+	max := 0
+	if l, ok := t.(AttemptLimiter); ok {
+		max = l.MaxAttempts(ctx)
+	}
+
+	checked, remaining := 0, 0
+	for _, tid := range ids {
+		if isValid, ts, n, err := ConsumeToken(ctx, s, token, uid, tid, scope, max); err == ErrTokenNotFound && scan {
+			// Token expired since being listed
+			continue
+		} else if err == ErrTokenNotFound {
+			// Token has expired, or has already been used
+			e.ID = tid
+			p.emit(ctx, e.with(EventTokenExpired, time.Time{}, err))
+			return false, id, err
+		} else if err == ErrAttemptsExhausted {
+			// Limit was reached by concurrent attempts
+			checked++
+			if err := p.deleteToken(ctx, e, tid, ReasonAttemptsExhausted); err != nil && err != ErrTokenNotFound {
+				return false, id, err
+			}
+		} else if err != nil {
+			// Failed to validate
+			return false, id, err
+		} else if ts != scope && scan {
+			// Token was issued for something else; ignore it
+			continue
+		} else if ts != scope {
+			// Token is being used for something it wasn't issued for
+			return false, id, ErrWrongTokenScope
+		} else if isValid {
+			// Token *is* valid, and was removed by the store
+			p.tokenDeleted(ctx, e, tid, ReasonConsumed)
+			return true, tid, nil
+		} else if max > 0 && n >= max {
+			// Limit reached; the token can no longer be used
+			checked++
+			if err := p.deleteToken(ctx, e, tid, ReasonAttemptsExhausted); err != nil && err != ErrTokenNotFound {
+				return false, id, err
+			}
+		} else {
+			checked++
+			remaining++
+		}
+	}
+	if checked == 0 {
+		// User has no outstanding tokens
+		p.emit(ctx, e.with(EventTokenExpired, time.Time{}, ErrTokenNotFound))
+		return false, id, ErrTokenNotFound
+	}
+
+	// Token is not valid
+	if max > 0 && remaining == 0 {
+		return false, id, ErrAttemptsExhausted
+	}
+	return false, id, nil
+}
+
+// startSpan starts a span for an operation in the given scope, using the
+// Passwordless tracer if set.
+func (p *Passwordless) startSpan(ctx context.Context, name string, scope Scope) (context.Context, Span) {
+	if p.Tracer != nil {
+		ctx = WithTracer(ctx, p.Tracer)
+	}
+	ctx, span := StartSpan(ctx, name)
+	span.SetAttribute("strategy", scope.Strategy)
+	span.SetAttribute("purpose", scope.Purpose)
+	return ctx, span
+}
+
+// deleteToken deletes the token with the given ID, notifying observers.
+func (p *Passwordless) deleteToken(ctx context.Context, e Event, id, reason string) error {
+	if err := p.Store.Delete(ctx, e.UID, id); err != nil {
+		return err
+	}
+	p.tokenDeleted(ctx, e, id, reason)
+	return nil
+}
+
+// tokenDeleted notifies observers that the token with the given ID was
+// deleted.
+func (p *Passwordless) tokenDeleted(ctx context.Context, e Event, id, reason string) {
+	e.ID = id
+	e.Reason = reason
+	p.emit(ctx, e.with(EventTokenDeleted, time.Time{}, nil))
 }
@@ -2,6 +2,7 @@ package passwordless
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,12 +12,14 @@ import (
 
 type testTransport struct {
 	token     string
+	id        string
 	recipient string
 	err       error
 }
 
 func (t *testTransport) Send(ctx context.Context, token, user, recipient string) error {
 	t.token = token
+	t.id = TokenID(ctx)
 	t.recipient = recipient
 	return t.err
 }
@@ -50,17 +53,315 @@ func TestPasswordless(t *testing.T) {
 	}
 
 	// Check returned token is as expected
-	assert.NoError(t, p.RequestToken(nil, "test", "uid", "recipient"))
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
 	assert.Equal(t, tt.token, tg.token)
+	assert.Equal(t, tt.id, id)
 	assert.Equal(t, tt.recipient, "recipient")
 
 	// Check invalid token is rejected
-	v, err := p.VerifyToken(nil, "uid", "badtoken")
+	v, err := p.VerifyToken(nil, "test", "uid", id, "badtoken")
 	assert.NoError(t, err)
 	assert.False(t, v)
 
 	// Verify token
-	v, err = p.VerifyToken(nil, "uid", tg.token)
+	v, err = p.VerifyToken(nil, "test", "uid", id, tg.token)
+	assert.NoError(t, err)
+	assert.True(t, v)
+
+	// Check token can't be verified twice
+	v, err = p.VerifyToken(nil, "test", "uid", id, tg.token)
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, v)
+
+	// Check token can't be verified with an unknown strategy
+	_, err = p.VerifyToken(nil, "madeup", "uid", id, tg.token)
+	assert.Equal(t, ErrUnknownStrategy, err)
+}
+
+func TestPasswordlessMultipleTokens(t *testing.T) {
+	p := New(NewMemStore())
+
+	tt := &testTransport{}
+	tg := &testGenerator{}
+	p.SetTransport("test", tt, tg, 5*time.Minute)
+
+	// Request two tokens for the same user, as if from two devices
+	tg.token = "1111"
+	id1, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	tg.token = "2222"
+	id2, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	assert.NotEqual(t, id1, id2)
+
+	// Check tokens are not valid for each other's IDs
+	v, err := p.VerifyToken(nil, "test", "uid", id1, "2222")
+	assert.NoError(t, err)
+	assert.False(t, v)
+
+	// Check first token can be found by scanning, leaving the second
+	v, err = p.VerifyToken(nil, "test", "uid", "", "1111")
+	assert.NoError(t, err)
+	assert.True(t, v)
+	ids, err := p.Store.List(nil, "uid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id2}, ids)
+
+	// Verify second token by ID
+	v, err = p.VerifyToken(nil, "test", "uid", id2, "2222")
+	assert.NoError(t, err)
+	assert.True(t, v)
+
+	// Check scanning without tokens fails
+	v, err = p.VerifyToken(nil, "test", "uid", "", "2222")
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, v)
+}
+
+func TestPasswordlessAttempts(t *testing.T) {
+	p := New(NewMemStore())
+
+	tt := &testTransport{}
+	tg := &testGenerator{token: "1337"}
+	p.SetStrategy("test", LimitedStrategy{
+		Strategy: p.SetTransport("test", tt, tg, 5*time.Minute),
+		Attempts: 3,
+	})
+
+	// Check token is deleted after the permitted number of failures
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		v, err := p.VerifyToken(nil, "test", "uid", id, "badtoken")
+		assert.NoError(t, err)
+		assert.False(t, v)
+	}
+	v, err := p.VerifyToken(nil, "test", "uid", id, "badtoken")
+	assert.Equal(t, ErrAttemptsExhausted, err)
+	assert.False(t, v)
+	v, err = p.VerifyToken(nil, "test", "uid", id, tg.token)
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, v)
+
+	// Check a new token starts a new count
+	_, err = p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		v, err := p.VerifyToken(nil, "test", "uid", "", "badtoken")
+		assert.NoError(t, err)
+		assert.False(t, v)
+	}
+	v, err = p.VerifyToken(nil, "test", "uid", "", tg.token)
+	assert.NoError(t, err)
+	assert.True(t, v)
+
+	// Check failures made by scanning count against every token
+	_, err = p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	_, err = p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		v, err := p.VerifyToken(nil, "test", "uid", "", "badtoken")
+		assert.NoError(t, err)
+		assert.False(t, v)
+	}
+	v, err = p.VerifyToken(nil, "test", "uid", "", "badtoken")
+	assert.Equal(t, ErrAttemptsExhausted, err)
+	assert.False(t, v)
+	b, _, err := p.Store.Exists(nil, "uid")
+	assert.NoError(t, err)
+	assert.False(t, b)
+}
+
+func TestPasswordlessAttemptsConcurrent(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	ms := NewMemStore()
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+	rs := NewRedisStore(client)
+	rs.Hasher = testHashers["hmac"]
+	kv := NewKVStore(NewMemKV())
+	kv.Hasher = testHashers["hmac"]
+	for name, s := range map[string]TokenStore{
+		"mem":   ms,
+		"plain": plainStore{ms},
+		"redis": rs,
+		"sql":   newTestSQLStore(t),
+		"kv":    kv,
+	} {
+		p := New(s)
+		tt := &testTransport{}
+		tg := &testGenerator{token: "1337"}
+		p.SetStrategy("test", LimitedStrategy{
+			Strategy: p.SetTransport("test", tt, tg, 5*time.Minute),
+			Attempts: 3,
+		})
+
+		// Concurrent guesses can't exceed the limit
+		id, err := p.RequestToken(ctx, "test", "uid", "recipient")
+		assert.NoError(t, err, name)
+		var wg sync.WaitGroup
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v, _ := p.VerifyToken(ctx, "test", "uid", id, "badtoken")
+				assert.False(t, v, name)
+			}()
+		}
+		wg.Wait()
+		v, err := p.VerifyToken(ctx, "test", "uid", id, tg.token)
+		assert.False(t, v, name)
+		assert.True(t, err == ErrTokenNotFound || err == ErrAttemptsExhausted, "%s: %v", name, err)
+	}
+}
+
+func TestPasswordlessCooldown(t *testing.T) {
+	p := New(NewMemStore())
+
+	tt := &testTransport{}
+	tg := &testGenerator{token: "1337"}
+	ls := LimitedStrategy{
+		Strategy: p.SetTransport("test", tt, tg, 5*time.Minute),
+		Cooldown: 500 * time.Millisecond,
+	}
+	p.SetStrategy("test", ls)
+
+	// Check second request is rejected within cooldown period
+	_, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	_, err = p.RequestToken(nil, "test", "uid", "recipient")
+	if assert.IsType(t, &CooldownError{}, err) {
+		remaining := err.(*CooldownError).Remaining
+		assert.True(t, remaining > 0 && remaining <= ls.Cooldown, remaining)
+	}
+
+	// Check other users are unaffected
+	_, err = p.RequestToken(nil, "test", "anotheruid", "recipient")
+	assert.NoError(t, err)
+
+	// Check requests are permitted once cooldown has passed
+	time.Sleep(ls.Cooldown)
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	// Check coalesced requests are not sent
+	ls.Coalesce = true
+	p.SetStrategy("test", ls)
+	tt.token = ""
+	id, err = p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	assert.Empty(t, id)
+	assert.Empty(t, tt.token)
+
+	// Check outstanding token remains valid
+	v, err := p.VerifyToken(nil, "test", "uid", id, tg.token)
+	assert.NoError(t, err)
+	assert.True(t, v)
+}
+
+// unscopedStore hides any optional methods of the wrapped store.
+type unscopedStore struct {
+	TokenStore
+}
+
+func TestPasswordlessCooldownStrategies(t *testing.T) {
+	for name, store := range map[string]TokenStore{
+		"scoped":   NewMemStore(),
+		"unscoped": unscopedStore{NewMemStore()},
+	} {
+		p := New(store)
+		tt := &testTransport{}
+		tg := &testGenerator{token: "1337"}
+		email := LimitedStrategy{
+			Strategy: p.SetTransport("email", tt, tg, 30*time.Minute),
+			Cooldown: time.Minute,
+		}
+		sms := LimitedStrategy{
+			Strategy: p.SetTransport("sms", tt, tg, 5*time.Minute),
+			Cooldown: time.Minute,
+		}
+		p.SetStrategy("email", email)
+		p.SetStrategy("sms", sms)
+
+		// A token from a strategy with a longer TTL doesn't lock the user
+		// out of another for longer than its cooldown
+		_, err := p.RequestToken(nil, "email", "uid", "recipient")
+		assert.NoError(t, err, name)
+		_, err = p.RequestToken(nil, "sms", "uid", "recipient")
+		if name == "scoped" {
+			assert.NoError(t, err, name)
+			_, err = p.RequestToken(nil, "sms", "uid", "recipient")
+		}
+		if assert.IsType(t, &CooldownError{}, err, name) {
+			remaining := err.(*CooldownError).Remaining
+			assert.True(t, remaining > 0 && remaining <= sms.Cooldown, remaining)
+		}
+	}
+}
+
+func TestPasswordlessDeliveryFailure(t *testing.T) {
+	p := New(NewMemStore())
+
+	tt := &testTransport{err: fmt.Errorf("refused send")}
+	tg := &testGenerator{token: "1337"}
+	p.SetStrategy("test", LimitedStrategy{
+		Strategy: p.SetTransport("test", tt, tg, 5*time.Minute),
+		Cooldown: time.Minute,
+	})
+
+	// Check failed token is not left in the store
+	_, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.IsType(t, &DeliveryError{}, err)
+	exists, _, err := p.Store.Exists(nil, "uid")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	_, err = p.VerifyToken(nil, "test", "uid", tt.id, tg.token)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Check failed token doesn't prevent a retry within the cooldown period
+	tt.err = nil
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
+}
+
+func TestPasswordlessScope(t *testing.T) {
+	p := New(NewMemStore())
+
+	tt := &testTransport{}
+	tg := &testGenerator{token: "1337"}
+	p.SetTransport("a", tt, tg, 5*time.Minute)
+	p.SetTransport("b", tt, tg, 5*time.Minute)
+
+	// Check token can't be verified by another strategy
+	id, err := p.RequestToken(nil, "a", "uid", "recipient")
+	assert.NoError(t, err)
+	v, err := p.VerifyToken(nil, "b", "uid", id, tg.token)
+	assert.Equal(t, ErrWrongTokenScope, err)
+	assert.False(t, v)
+	v, err = p.VerifyToken(nil, "b", "uid", "", tg.token)
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, v)
+	v, err = p.VerifyToken(nil, "a", "uid", id, tg.token)
+	assert.NoError(t, err)
+	assert.True(t, v)
+
+	// Check token can't be verified for another purpose
+	ctx := WithPurpose(nil, "delete-account")
+	id, err = p.RequestToken(ctx, "a", "uid", "recipient")
+	assert.NoError(t, err)
+	v, err = p.VerifyToken(nil, "a", "uid", id, tg.token)
+	assert.Equal(t, ErrWrongTokenScope, err)
+	assert.False(t, v)
+	v, err = p.VerifyToken(WithPurpose(nil, "change-email"), "a", "uid", "", tg.token)
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, v)
+	v, err = p.VerifyToken(ctx, "a", "uid", "", tg.token)
 	assert.NoError(t, err)
 	assert.True(t, v)
 }
@@ -80,26 +381,32 @@ func TestPasswordlessFailures(t *testing.T) {
 	_, err := p.GetStrategy(nil, "madeup")
 	assert.Equal(t, err, ErrUnknownStrategy)
 
-	err = p.RequestToken(nil, "madeup", "", "")
+	_, err = p.RequestToken(nil, "madeup", "", "")
 	assert.Equal(t, err, ErrUnknownStrategy)
 
 	p.SetStrategy("unfriendly", testStrategy{valid: false})
 
-	err = p.RequestToken(nil, "unfriendly", "", "")
+	_, err = p.RequestToken(nil, "unfriendly", "", "")
 	assert.Equal(t, err, ErrNotValidForContext)
 }
 
 func TestRequestToken(t *testing.T) {
 	// Test Generate()
-	assert.EqualError(t, RequestToken(nil, nil, &mockStrategy{
+	_, err := RequestToken(nil, nil, &mockStrategy{
 		generate: func(c context.Context) (string, error) {
 			return "", fmt.Errorf("refused generate")
 		},
-	}, "", ""), "refused generate", "Generate() error should propagate")
+	}, Scope{}, "", "")
+	assert.EqualError(t, err, "refused generate", "Generate() error should propagate")
 
 	// Test Send()
-	assert.EqualError(t, RequestToken(nil, &mockTokenStore{
-		store: func(ctx context.Context, token, uid string, ttl time.Duration) error {
+	deleted := ""
+	_, err = RequestToken(nil, &mockTokenStore{
+		store: func(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (string, error) {
+			return "id", nil
+		},
+		delete: func(ctx context.Context, uid, id string) error {
+			deleted = id
 			return nil
 		},
 	}, &mockStrategy{
@@ -109,12 +416,40 @@ func TestRequestToken(t *testing.T) {
 		send: func(c context.Context, token, user, recipient string) error {
 			return fmt.Errorf("refused send")
 		},
-	}, "", ""), "refused send", "Send() error should propagate")
+	}, Scope{}, "", "")
+	assert.EqualError(t, err, "refused send", "Send() error should propagate")
+	assert.Equal(t, "id", deleted, "token should be deleted when Send() fails")
+	if derr, ok := err.(*DeliveryError); assert.True(t, ok) {
+		assert.NoError(t, derr.RollbackErr)
+		assert.EqualError(t, derr.Unwrap(), "refused send")
+	}
+
+	// Test Send() and Delete()
+	_, err = RequestToken(nil, &mockTokenStore{
+		store: func(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (string, error) {
+			return "id", nil
+		},
+		delete: func(ctx context.Context, uid, id string) error {
+			return fmt.Errorf("refused delete")
+		},
+	}, &mockStrategy{
+		generate: func(c context.Context) (string, error) {
+			return "", nil
+		},
+		send: func(c context.Context, token, user, recipient string) error {
+			return fmt.Errorf("refused send")
+		},
+	}, Scope{}, "", "")
+	assert.EqualError(t, err, "refused send (and failed to delete token: refused delete)")
+	if derr, ok := err.(*DeliveryError); assert.True(t, ok) {
+		assert.EqualError(t, derr.SendErr, "refused send")
+		assert.EqualError(t, derr.RollbackErr, "refused delete")
+	}
 
 	// Test Store()
-	err := RequestToken(nil, &mockTokenStore{
-		store: func(ctx context.Context, token, uid string, ttl time.Duration) error {
-			return fmt.Errorf("refused store")
+	_, err = RequestToken(nil, &mockTokenStore{
+		store: func(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (string, error) {
+			return "", fmt.Errorf("refused store")
 		},
 	}, &mockStrategy{
 		generate: func(c context.Context) (string, error) {
@@ -123,37 +458,146 @@ func TestRequestToken(t *testing.T) {
 		send: func(c context.Context, token, user, recipient string) error {
 			return nil
 		},
-	}, "", "")
+	}, Scope{}, "", "")
 	assert.EqualError(t, err, "refused store", "Store() error should propagate")
+
+	// Test ID is passed to transport and returned
+	id, err := RequestToken(nil, &mockTokenStore{
+		store: func(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (string, error) {
+			return "id", nil
+		},
+	}, &mockStrategy{
+		generate: func(c context.Context) (string, error) {
+			return "", nil
+		},
+		send: func(c context.Context, token, user, recipient string) error {
+			assert.Equal(t, "id", TokenID(c))
+			return nil
+		},
+	}, Scope{}, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "id", id)
 }
 
 func TestVerifyToken(t *testing.T) {
 	valid, err := VerifyToken(nil, &mockTokenStore{
-		verify: func(ctx context.Context, token, uid string) (bool, error) {
-			return false, fmt.Errorf("refused verify")
+		verify: func(ctx context.Context, token, uid, id string) (bool, Scope, error) {
+			return false, Scope{}, fmt.Errorf("refused verify")
 		},
-	}, "", "")
+	}, &mockStrategy{}, Scope{}, "", "id", "")
 	assert.False(t, valid)
 	assert.EqualError(t, err, "refused verify", "Verify() error should propagate")
 
 	valid, err = VerifyToken(nil, &mockTokenStore{
-		verify: func(ctx context.Context, token, uid string) (bool, error) {
-			return false, nil
+		verify: func(ctx context.Context, token, uid, id string) (bool, Scope, error) {
+			return false, Scope{}, nil
 		},
-	}, "", "")
+	}, &mockStrategy{}, Scope{}, "", "id", "")
 	assert.False(t, valid)
 	assert.NoError(t, err)
 
 	valid, err = VerifyToken(nil, &mockTokenStore{
-		verify: func(ctx context.Context, token, uid string) (bool, error) {
-			return true, nil
+		verify: func(ctx context.Context, token, uid, id string) (bool, Scope, error) {
+			return true, Scope{}, nil
 		},
-		delete: func(ctx context.Context, uid string) error {
+		delete: func(ctx context.Context, uid, id string) error {
 			return fmt.Errorf("delete failure")
 		},
-	}, "", "")
-	assert.True(t, valid)
+	}, &mockStrategy{}, Scope{}, "", "id", "")
+	assert.False(t, valid)
 	assert.EqualError(t, err, "delete failure")
+
+	// Test Sanitize()
+	valid, err = VerifyToken(nil, &mockTokenStore{}, &mockStrategy{
+		sanitize: func(c context.Context, t string) (string, error) {
+			return "", fmt.Errorf("refused sanitize")
+		},
+	}, Scope{}, "", "id", "")
+	assert.False(t, valid)
+	assert.EqualError(t, err, "refused sanitize", "Sanitize() error should propagate")
+
+	// Test List()
+	valid, err = VerifyToken(nil, &mockTokenStore{
+		list: func(ctx context.Context, uid string) ([]string, error) {
+			return nil, fmt.Errorf("refused list")
+		},
+	}, &mockStrategy{}, Scope{}, "", "", "")
+	assert.False(t, valid)
+	assert.EqualError(t, err, "refused list", "List() error should propagate")
+
+	// Test only the matching token is deleted when scanning
+	deleted := []string{}
+	valid, err = VerifyToken(nil, &mockTokenStore{
+		list: func(ctx context.Context, uid string) ([]string, error) {
+			return []string{"a", "b", "c"}, nil
+		},
+		verify: func(ctx context.Context, token, uid, id string) (bool, Scope, error) {
+			return id == "b", Scope{}, nil
+		},
+		delete: func(ctx context.Context, uid, id string) error {
+			deleted = append(deleted, id)
+			return nil
+		},
+	}, &mockStrategy{}, Scope{}, "", "", "")
+	assert.True(t, valid)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, deleted)
+
+	// Test RecordFailure()
+	valid, err = VerifyToken(nil, &mockTokenStore{
+		verify: func(ctx context.Context, token, uid, id string) (bool, Scope, error) {
+			return false, Scope{}, nil
+		},
+		recordFailure: func(ctx context.Context, uid, id string) (int, error) {
+			return 0, fmt.Errorf("refused record")
+		},
+	}, LimitedStrategy{Strategy: &mockStrategy{}, Attempts: 1}, Scope{}, "", "id", "")
+	assert.False(t, valid)
+	assert.EqualError(t, err, "refused record", "RecordFailure() error should propagate")
+
+	valid, err = VerifyToken(nil, &mockTokenStore{
+		verify: func(ctx context.Context, token, uid, id string) (bool, Scope, error) {
+			return false, Scope{}, nil
+		},
+		recordFailure: func(ctx context.Context, uid, id string) (int, error) {
+			return 1, nil
+		},
+		delete: func(ctx context.Context, uid, id string) error {
+			return nil
+		},
+	}, LimitedStrategy{Strategy: &mockStrategy{}, Attempts: 1}, Scope{}, "", "id", "")
+	assert.False(t, valid)
+	assert.Equal(t, ErrAttemptsExhausted, err)
+}
+
+func TestVerifyTokenSanitize(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		generator TokenGenerator
+		token     string
+		input     string
+		valid     bool
+	}{
+		{"byte", NewByteGenerator([]byte("abAB"), 4), "abAB", "abAB", true},
+		{"byte-case", NewByteGenerator([]byte("abAB"), 4), "abAB", "ABab", false},
+		{"crockford", NewCrockfordGenerator(6), "0a1b1z", "OAlBiZ", true},
+		{"crockford-wrong", NewCrockfordGenerator(6), "0a1b1z", "OAlBiY", false},
+		{"pin", PINGenerator{Length: 6}, "105861", "lOSBbI", true},
+		{"pin-wrong", PINGenerator{Length: 6}, "105861", "lOSBbO", false},
+	} {
+		ms := NewMemStore()
+		s := SimpleStrategy{
+			Transport:      &testTransport{},
+			TokenGenerator: test.generator,
+			ttl:            time.Hour,
+		}
+		id, err := ms.Store(nil, test.token, "uid", Scope{}, time.Hour)
+		assert.NoError(t, err, test.name)
+		valid, err := VerifyToken(nil, ms, s, Scope{}, "uid", id, test.input)
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.valid, valid, test.name)
+		ms.Release()
+	}
 }
 
 type mockStrategy struct {
@@ -172,6 +616,9 @@ func (m mockStrategy) Generate(ctx context.Context) (string, error) {
 }
 
 func (m mockStrategy) Sanitize(ctx context.Context, t string) (string, error) {
+	if m.sanitize == nil {
+		return t, nil
+	}
 	return m.sanitize(ctx, t)
 }
 
@@ -180,24 +627,34 @@ func (m mockStrategy) Send(ctx context.Context, token, user, recipient string) e
 }
 
 type mockTokenStore struct {
-	store  func(ctx context.Context, token, uid string, ttl time.Duration) error
-	exists func(ctx context.Context, uid string) (bool, time.Time, error)
-	verify func(ctx context.Context, token, uid string) (bool, error)
-	delete func(ctx context.Context, uid string) error
+	store         func(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (string, error)
+	exists        func(ctx context.Context, uid string) (bool, time.Time, error)
+	list          func(ctx context.Context, uid string) ([]string, error)
+	verify        func(ctx context.Context, token, uid, id string) (bool, Scope, error)
+	recordFailure func(ctx context.Context, uid, id string) (int, error)
+	delete        func(ctx context.Context, uid, id string) error
 }
 
-func (m mockTokenStore) Store(ctx context.Context, token, uid string, ttl time.Duration) error {
-	return m.store(ctx, token, uid, ttl)
+func (m mockTokenStore) Store(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (string, error) {
+	return m.store(ctx, token, uid, scope, ttl)
 }
 
 func (m mockTokenStore) Exists(ctx context.Context, uid string) (bool, time.Time, error) {
 	return m.exists(ctx, uid)
 }
 
-func (m mockTokenStore) Verify(ctx context.Context, token, uid string) (bool, error) {
-	return m.verify(ctx, token, uid)
+func (m mockTokenStore) List(ctx context.Context, uid string) ([]string, error) {
+	return m.list(ctx, uid)
+}
+
+func (m mockTokenStore) Verify(ctx context.Context, token, uid, id string) (bool, Scope, error) {
+	return m.verify(ctx, token, uid, id)
+}
+
+func (m mockTokenStore) RecordFailure(ctx context.Context, uid, id string) (int, error) {
+	return m.recordFailure(ctx, uid, id)
 }
 
-func (m mockTokenStore) Delete(ctx context.Context, uid string) error {
-	return m.delete(ctx, uid)
+func (m mockTokenStore) Delete(ctx context.Context, uid, id string) error {
+	return m.delete(ctx, uid, id)
 }
@@ -0,0 +1,222 @@
+// Package session issues signed sessions to users once they have verified a
+// passwordless token, and authenticates subsequent requests.
+//
+// Sessions are HS256-signed JWTs, delivered in a cookie and/or a response
+// header for clients that send them back as bearer tokens.
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	// DefaultLifetime is the default lifetime of sessions.
+	DefaultLifetime = 12 * time.Hour
+	// DefaultRememberLifetime is the default lifetime of sessions for users
+	// that asked to be remembered on their device.
+	DefaultRememberLifetime = 30 * 24 * time.Hour
+	// DefaultCookieName is the default name of the session cookie.
+	DefaultCookieName = "passwordless-session"
+	// MinKeyLength is the minimum length of the key sessions are signed
+	// with.
+	MinKeyLength = 32
+)
+
+var (
+	ErrNoSession      = errors.New("no session present in request")
+	ErrInvalidSession = errors.New("session is invalid or has expired")
+	ErrKeyTooShort    = fmt.Errorf("session key must be at least %d bytes", MinKeyLength)
+)
+
+type ctxKey int
+
+const uidKey ctxKey = 1
+
+// claims are the claims held within a session token.
+type claims struct {
+	jwt.StandardClaims
+	Remember bool `json:"rmb,omitempty"`
+}
+
+// Manager issues and authenticates sessions.
+type Manager struct {
+	key []byte
+	// Lifetime is the lifetime of sessions.
+	Lifetime time.Duration
+	// RememberLifetime is the lifetime of sessions issued to users that
+	// asked to be remembered. These sessions are issued in a persistent
+	// cookie, whereas other sessions end when the browser is closed.
+	RememberLifetime time.Duration
+	// CookieName is the name of the session cookie. If empty, sessions are
+	// not issued or read from cookies.
+	CookieName string
+	// Path is the path of the session cookie.
+	Path string
+	// Secure restricts the session cookie to HTTPS connections.
+	Secure bool
+	// Header, if set, is the name of the response header that the session
+	// token is written to, so that clients can send it back in an
+	// "Authorization: Bearer" header.
+	Header string
+}
+
+// New returns a new Manager that signs sessions with the given key, which
+// should be random. `ErrKeyTooShort` is returned if the key is shorter than
+// `MinKeyLength`, as sessions signed with it could be forged.
+func New(key []byte) (*Manager, error) {
+	if len(key) < MinKeyLength {
+		return nil, ErrKeyTooShort
+	}
+	return &Manager{
+		key:              key,
+		Lifetime:         DefaultLifetime,
+		RememberLifetime: DefaultRememberLifetime,
+		CookieName:       DefaultCookieName,
+		Path:             "/",
+	}, nil
+}
+
+// Issue creates a new session for the user, writing it to the response as
+// configured, and returns the session token. If `remember` is true, the
+// session lasts for RememberLifetime instead of Lifetime.
+func (m *Manager) Issue(w http.ResponseWriter, uid string, remember bool) (string, error) {
+	lifetime := m.Lifetime
+	if remember {
+		lifetime = m.RememberLifetime
+	}
+	now := time.Now()
+	exp := now.Add(lifetime)
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   uid,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: exp.Unix(),
+		},
+		Remember: remember,
+	})
+	tokString, err := tok.SignedString(m.key)
+	if err != nil {
+		return "", err
+	}
+
+	if m.CookieName != "" {
+		cookie := &http.Cookie{
+			Name:     m.CookieName,
+			Value:    tokString,
+			Path:     m.Path,
+			Secure:   m.Secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		if remember {
+			cookie.Expires = exp
+			cookie.MaxAge = int(lifetime / time.Second)
+		}
+		http.SetCookie(w, cookie)
+	}
+	if m.Header != "" {
+		w.Header().Set(m.Header, tokString)
+	}
+	return tokString, nil
+}
+
+// IssueSession issues a session for the user. It can be used as the
+// IssueSession function of `handler.VerifyHandler`.
+func (m *Manager) IssueSession(w http.ResponseWriter, r *http.Request, uid string, remember bool) error {
+	_, err := m.Issue(w, uid, remember)
+	return err
+}
+
+// Clear removes the session cookie. Session tokens held by clients remain
+// valid until they expire.
+func (m *Manager) Clear(w http.ResponseWriter) {
+	if m.CookieName == "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   m.CookieName,
+		Path:   m.Path,
+		MaxAge: -1,
+	})
+}
+
+// Authenticate returns the ID of the user whose session is held in the
+// request, read from an "Authorization: Bearer" header or the session
+// cookie. `ErrNoSession` is returned if no session is present.
+func (m *Manager) Authenticate(r *http.Request) (string, error) {
+	tokString := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		tokString = strings.TrimPrefix(auth, "Bearer ")
+	} else if m.CookieName != "" {
+		if cookie, err := r.Cookie(m.CookieName); err == nil {
+			tokString = cookie.Value
+		}
+	}
+	if tokString == "" {
+		return "", ErrNoSession
+	}
+
+	c := claims{}
+	tok, err := jwt.ParseWithClaims(tokString, &c, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Header["alg"])
+		}
+		return m.key, nil
+	})
+	if err != nil || !tok.Valid || c.Subject == "" {
+		return "", ErrInvalidSession
+	}
+	return c.Subject, nil
+}
+
+// Middleware authenticates requests, making the user's ID available to the
+// wrapped handler via `UID`. Requests without a valid session are passed
+// through unauthenticated.
+func (m *Manager) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if uid, err := m.Authenticate(r); err == nil {
+			r = r.WithContext(WithUID(r.Context(), uid))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Require authenticates requests, making the user's ID available to the
+// wrapped handler via `UID`. Requests without a valid session are rejected
+// with 401 Unauthorized.
+func (m *Manager) Require(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid, err := m.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(WithUID(r.Context(), uid)))
+	})
+}
+
+// WithUID returns a Context containing the ID of the authenticated user.
+func WithUID(ctx context.Context, uid string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, uidKey, uid)
+}
+
+// UID returns the ID of the authenticated user, or an empty string if the
+// request was not authenticated.
+func UID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	uid, _ := ctx.Value(uidKey).(string)
+	return uid
+}
@@ -0,0 +1,140 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestManager returns a Manager whose key is the seed padded to
+// `MinKeyLength`.
+func newTestManager(t *testing.T, seed string) *Manager {
+	key := []byte(seed + strings.Repeat("k", MinKeyLength-len(seed)))
+	m, err := New(key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return m
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(nil)
+	assert.Equal(t, ErrKeyTooShort, err)
+	_, err = New([]byte("secret"))
+	assert.Equal(t, ErrKeyTooShort, err)
+	m, err := New(make([]byte, MinKeyLength))
+	assert.NoError(t, err)
+	assert.NotNil(t, m)
+}
+
+func TestIssueCookie(t *testing.T) {
+	m := newTestManager(t, "secret")
+
+	// Session cookie without remember
+	w := httptest.NewRecorder()
+	tok, err := m.Issue(w, "alice", false)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, tok)
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, DefaultCookieName, cookies[0].Name)
+	assert.Equal(t, tok, cookies[0].Value)
+	assert.Equal(t, 0, cookies[0].MaxAge)
+	assert.True(t, cookies[0].HttpOnly)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	uid, err := m.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", uid)
+
+	// Persistent cookie with remember
+	w = httptest.NewRecorder()
+	_, err = m.Issue(w, "alice", true)
+	assert.NoError(t, err)
+	cookies = w.Result().Cookies()
+	assert.Equal(t, int(DefaultRememberLifetime/time.Second), cookies[0].MaxAge)
+
+	// Clear cookie
+	w = httptest.NewRecorder()
+	m.Clear(w)
+	assert.True(t, w.Result().Cookies()[0].MaxAge < 0)
+}
+
+func TestIssueBearer(t *testing.T) {
+	m := newTestManager(t, "secret")
+	m.CookieName = ""
+	m.Header = "X-Session-Token"
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.IssueSession(w, nil, "bob", false))
+	assert.Empty(t, w.Result().Cookies())
+	header := w.Header().Get("X-Session-Token")
+	assert.NotEmpty(t, header)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+header)
+	uid, err := m.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", uid)
+}
+
+func TestAuthenticateInvalid(t *testing.T) {
+	m := newTestManager(t, "secret")
+
+	// No session
+	_, err := m.Authenticate(httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, ErrNoSession, err)
+
+	// Signed with another key
+	tok, err := newTestManager(t, "other").Issue(httptest.NewRecorder(), "alice", false)
+	assert.NoError(t, err)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	_, err = m.Authenticate(r)
+	assert.Equal(t, ErrInvalidSession, err)
+
+	// Expired
+	m.Lifetime = -time.Minute
+	tok, err = m.Issue(httptest.NewRecorder(), "alice", false)
+	assert.NoError(t, err)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	_, err = m.Authenticate(r)
+	assert.Equal(t, ErrInvalidSession, err)
+}
+
+func TestMiddleware(t *testing.T) {
+	m := newTestManager(t, "secret")
+	tok, err := m.Issue(httptest.NewRecorder(), "alice", false)
+	assert.NoError(t, err)
+
+	var uid string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid = UID(r.Context())
+	})
+
+	// Authenticated request
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	m.Middleware(h).ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "alice", uid)
+
+	// Unauthenticated request is passed through
+	uid = "unset"
+	w := httptest.NewRecorder()
+	m.Middleware(h).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "", uid)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Unauthenticated request is rejected
+	uid = "unset"
+	w = httptest.NewRecorder()
+	m.Require(h).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "unset", uid)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -5,25 +5,134 @@ import (
 	"time"
 
 	"context"
+)
 
-	_ "github.com/pzduniak/mcf/scrypt"
+const (
+	// DefaultMaxTokens is the number of outstanding tokens a store will hold
+	// for each user, unless configured otherwise. When exceeded, the token
+	// closest to expiry is discarded.
+	DefaultMaxTokens = 5
 )
 
 var (
-	ErrTokenNotFound = errors.New("the token does not exist")
-	ErrTokenNotValid = errors.New("the token is incorrect")
+	ErrTokenNotFound   = errors.New("the token does not exist")
+	ErrTokenNotValid   = errors.New("the token is incorrect")
+	ErrWrongTokenScope = errors.New("the token was issued for a different strategy or purpose")
 )
 
-// TokenStore is a storage mechanism for tokens.
+// Scope identifies the strategy that issued a token, and the purpose for
+// which it was issued. A token can only be verified within the same scope.
+type Scope struct {
+	// Strategy is the name of the strategy that issued the token.
+	Strategy string `json:"strategy"`
+	// Purpose is an application-defined purpose, such as "signin" or
+	// "delete-account". See `WithPurpose`.
+	Purpose string `json:"purpose"`
+}
+
+// TokenStore is a storage mechanism for tokens. A user may have several
+// outstanding tokens, each identified by an ID returned when it is stored.
 type TokenStore interface {
-	// Store securely stores the given token with the given expiry time
-	Store(ctx context.Context, token, uid string, ttl time.Duration) error
+	// Store securely stores the given token and its scope with the given
+	// expiry time, returning an opaque ID that identifies it amongst the
+	// user's tokens.
+	Store(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (string, error)
 	// Exists returns true if a token is stored for the user. If the expiry
 	// time is available this is also returned, otherwise it will be zero
-	// and can be tested with `Time.IsZero()`.
+	// and can be tested with `Time.IsZero()`. Where the user holds several
+	// tokens, the latest expiry time is returned.
 	Exists(ctx context.Context, uid string) (bool, time.Time, error)
-	// Verify returns true if the given token is valid for the user
-	Verify(ctx context.Context, token, uid string) (bool, error)
-	// Delete removes the token for the specified  user
-	Delete(ctx context.Context, uid string) error
+	// List returns the IDs of the user's outstanding tokens, most recently
+	// stored first.
+	List(ctx context.Context, uid string) ([]string, error)
+	// Verify returns true if the given token is valid for the user's token
+	// of the given ID, along with the scope the token was stored with.
+	Verify(ctx context.Context, token, uid, id string) (bool, Scope, error)
+	// RecordFailure records a failed attempt to verify the user's token,
+	// returning the total number of failed attempts made against it.
+	RecordFailure(ctx context.Context, uid, id string) (int, error)
+	// Delete removes the user's token of the given ID, or all of the user's
+	// tokens if the ID is empty. `ErrTokenNotFound` should be returned if
+	// the token of the given ID does not exist, so that a token deleted by
+	// two requests at once is only consumed once.
+	Delete(ctx context.Context, uid, id string) error
+}
+
+// TokenConsumer is implemented by stores that can verify and delete a token
+// in a single atomic operation, so that a token cannot be used by two
+// concurrent requests, nor guessed more often than permitted. Where
+// implemented, `VerifyToken` uses `Consume` rather than `RecordFailure`,
+// `Verify` and `Delete`.
+type TokenConsumer interface {
+	// Consume verifies the token as `Verify`, and if it is valid and was
+	// stored with the given scope, deletes it. `ErrTokenNotFound` is
+	// returned if the token has already been consumed. A token stored with
+	// a different scope is not verified, but its scope is returned.
+	//
+	// If maxAttempts is positive, the attempt is counted against the token
+	// before it is verified, and the number of attempts made is returned.
+	// If maxAttempts attempts have already been made, the token is not
+	// verified and `ErrAttemptsExhausted` is returned.
+	Consume(ctx context.Context, token, uid, id string, scope Scope, maxAttempts int) (bool, Scope, int, error)
+}
+
+// ScopedExister is implemented by stores that can report the tokens held
+// for a user within a single scope. Where implemented, resend cooldowns are
+// determined from the user's tokens for the strategy being requested, rather
+// than from their tokens for every strategy.
+type ScopedExister interface {
+	// ExistsInScope returns true if a token is stored for the user within
+	// the given scope, along with the latest expiry time of such tokens, as
+	// `Exists`.
+	ExistsInScope(ctx context.Context, uid string, scope Scope) (bool, time.Time, error)
+}
+
+// ConsumeToken verifies the token and, if it is valid and was stored with
+// the given scope, deletes it, as `TokenConsumer`. If the store does not
+// implement `TokenConsumer`, the attempt is recorded, and the token verified
+// and deleted, in separate operations. The attempt is then counted whatever
+// the scope of the token, and the token is only consumed once if the
+// store's `Delete` returns `ErrTokenNotFound` for a token already deleted.
+func ConsumeToken(ctx context.Context, s TokenStore, token, uid, id string, scope Scope, maxAttempts int) (bool, Scope, int, error) {
+	if c, ok := s.(TokenConsumer); ok {
+		return c.Consume(ctx, token, uid, id, scope, maxAttempts)
+	}
+	n, err := reserveAttempt(ctx, s, uid, id, maxAttempts)
+	if err != nil {
+		return false, Scope{}, n, err
+	}
+	valid, ts, err := s.Verify(ctx, token, uid, id)
+	if err != nil || !valid || ts != scope {
+		return valid, ts, n, err
+	}
+	if err := s.Delete(ctx, uid, id); err != nil {
+		return false, Scope{}, n, err
+	}
+	return true, ts, n, nil
+}
+
+// reserveAttempt records an attempt against the token before it is
+// verified, so that concurrent attempts cannot exceed the limit, returning
+// `ErrAttemptsExhausted` if maxAttempts attempts had already been made. No
+// attempt is recorded if maxAttempts is not positive.
+func reserveAttempt(ctx context.Context, s TokenStore, uid, id string, maxAttempts int) (int, error) {
+	if maxAttempts <= 0 {
+		return 0, nil
+	}
+	n, err := s.RecordFailure(ctx, uid, id)
+	if err != nil {
+		return 0, err
+	} else if n > maxAttempts {
+		return n, ErrAttemptsExhausted
+	}
+	return n, nil
+}
+
+// NewTokenID returns a new random ID suitable for identifying a stored token.
+func NewTokenID() (string, error) {
+	b, err := randBytes(crockfordBytes, 20)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
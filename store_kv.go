@@ -0,0 +1,481 @@
+package passwordless
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"context"
+)
+
+const (
+	// DefaultKVPrefix is the default prefix of the keys written by
+	// `KVStore`.
+	DefaultKVPrefix = "passwordless::"
+
+	// kvLockTTL is the time after which a lock on a user's index is
+	// released if its holder fails to release it.
+	kvLockTTL = 5 * time.Second
+	// kvLockRetry is the interval between attempts to take a lock.
+	kvLockRetry = 5 * time.Millisecond
+)
+
+var (
+	ErrIndexLocked = errors.New("timed out waiting for the token index lock")
+)
+
+// KVStore is a Store that keeps tokens in any `KV`, such as `MemKV`,
+// `RedisKV` or `appengine.MemcacheKV`. Tokens are hashed, counted and
+// expired in the same way whichever KV is used.
+//
+// Each token is held under its own key, which is deleted when the token is
+// consumed, so a token can't be used by two requests at once. An index of
+// each user's tokens is kept for `Exists` and `List`, and to discard tokens
+// when the user has too many. As the index is updated separately from the
+// tokens, it may briefly list a token that was deleted concurrently.
+//
+// If the KV implements `KVAdder`, updates to each user's index are
+// serialised by a lock held in the KV. Otherwise, concurrent requests for
+// the same user may lose updates to the index, so a token may be missing
+// from `List` and escape `MaxTokens`, although it can still be verified by
+// its ID.
+//
+// If the KV implements `KVIncrementer`, failed attempts are counted
+// atomically. Otherwise, attempts made concurrently may be counted once.
+type KVStore struct {
+	// MaxTokens is the number of outstanding tokens held for each user.
+	MaxTokens int
+	// Hasher hashes tokens before they are stored. If nil, `DefaultHasher`
+	// is used.
+	Hasher TokenHasher
+	// Prefix is prepended to every key written to the KV.
+	Prefix string
+
+	kv KV
+}
+
+// kvToken is the stored form of a token.
+type kvToken struct {
+	HashedToken []byte    `json:"hash"`
+	Scope       Scope     `json:"scope"`
+	Expires     time.Time `json:"expires"`
+}
+
+// kvIndexEntry records one of a user's tokens in their index.
+type kvIndexEntry struct {
+	ID      string    `json:"id"`
+	Scope   Scope     `json:"scope"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewKVStore creates and returns a new `KVStore` holding tokens in kv.
+func NewKVStore(kv KV) *KVStore {
+	return &KVStore{
+		MaxTokens: DefaultMaxTokens,
+		Prefix:    DefaultKVPrefix,
+		kv:        kv,
+	}
+}
+
+// tokenKey returns the key holding the token. Token IDs never contain a
+// colon, so keys of different users can't collide.
+func (s *KVStore) tokenKey(uid, id string) string {
+	return s.Prefix + "token:" + uid + ":" + id
+}
+
+// attemptsKey returns the key counting failed attempts against the token.
+func (s *KVStore) attemptsKey(uid, id string) string {
+	return s.Prefix + "attempts:" + uid + ":" + id
+}
+
+// indexKey returns the key holding the index of the user's tokens.
+func (s *KVStore) indexKey(uid string) string {
+	return s.Prefix + "index:" + uid
+}
+
+// index returns the user's unexpired tokens, latest expiry first.
+func (s *KVStore) index(ctx context.Context, uid string) ([]kvIndexEntry, error) {
+	b, err := s.kv.Get(ctx, s.indexKey(uid))
+	if err == ErrKeyNotFound {
+		return []kvIndexEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries := []kvIndexEntry{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	live := entries[:0]
+	for _, e := range entries {
+		if now.Before(e.Expires) {
+			live = append(live, e)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].Expires.After(live[j].Expires)
+	})
+	return live, nil
+}
+
+// setIndex writes the user's index, which expires with the last of their
+// tokens.
+func (s *KVStore) setIndex(ctx context.Context, uid string, entries []kvIndexEntry) error {
+	if len(entries) == 0 {
+		if err := s.kv.Delete(ctx, s.indexKey(uid)); err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return s.kv.Set(ctx, s.indexKey(uid), b, time.Until(entries[0].Expires))
+}
+
+// token returns the user's token, or `ErrTokenNotFound` if it does not exist
+// or has expired.
+func (s *KVStore) token(ctx context.Context, uid, id string) (kvToken, error) {
+	t := kvToken{}
+	b, err := s.kv.Get(ctx, s.tokenKey(uid, id))
+	if err == ErrKeyNotFound {
+		return t, ErrTokenNotFound
+	} else if err != nil {
+		return t, err
+	}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return t, err
+	}
+	if time.Now().After(t.Expires) {
+		return t, ErrTokenNotFound
+	}
+	return t, nil
+}
+
+// remove deletes the token and its attempt count, returning
+// `ErrTokenNotFound` if the token did not exist.
+func (s *KVStore) remove(ctx context.Context, uid, id string) error {
+	err := s.kv.Delete(ctx, s.tokenKey(uid, id))
+	if err == ErrKeyNotFound {
+		return ErrTokenNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := s.kv.Delete(ctx, s.attemptsKey(uid, id)); err != nil && err != ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// lockKey returns the key locking the user's index.
+func (s *KVStore) lockKey(uid string) string {
+	return s.Prefix + "lock:" + uid
+}
+
+// updateIndex reads the user's index, passes it to update and writes back
+// the entries returned. If the KV implements `KVAdder`, the index is locked
+// while it is updated.
+func (s *KVStore) updateIndex(ctx context.Context, uid string, update func([]kvIndexEntry) ([]kvIndexEntry, error)) error {
+	if a, ok := s.kv.(KVAdder); ok {
+		unlock, err := s.lock(ctx, a, uid)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	entries, err := s.index(ctx, uid)
+	if err != nil {
+		return err
+	}
+	entries, err = update(entries)
+	if err != nil {
+		return err
+	}
+	return s.setIndex(ctx, uid, entries)
+}
+
+// lock takes the lock on the user's index, waiting until it is released by
+// any other holder, returning a function that releases it.
+// `ErrIndexLocked` is returned if the lock can't be taken within twice
+// `kvLockTTL`, by which time a lock left by a failed holder has expired.
+//
+// The lock holds a random value identifying its owner, and is only released
+// if it still holds that value. As the KV can't compare and delete in one
+// operation, a lock held for more than half of `kvLockTTL` is left to
+// expire instead, so it can't be taken by another owner in between.
+func (s *KVStore) lock(ctx context.Context, a KVAdder, uid string) (func(), error) {
+	key := s.lockKey(uid)
+	owner, err := NewTokenID()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(2 * kvLockTTL)
+	for {
+		if ok, err := a.Add(ctx, key, []byte(owner), kvLockTTL); err != nil {
+			return nil, err
+		} else if ok {
+			taken := time.Now()
+			return func() { s.unlock(ctx, key, owner, taken) }, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrIndexLocked
+		}
+		select {
+		case <-time.After(kvLockRetry):
+		case <-orBackground(ctx).Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// unlock releases the lock if it is still held by owner, and was taken
+// recently enough that it can't expire before it is deleted.
+func (s *KVStore) unlock(ctx context.Context, key, owner string, taken time.Time) {
+	if time.Since(taken) > kvLockTTL/2 {
+		return
+	}
+	if b, err := s.kv.Get(ctx, key); err == nil && string(b) == owner {
+		s.kv.Delete(ctx, key)
+	}
+}
+
+// unindex removes the token from the user's index.
+func (s *KVStore) unindex(ctx context.Context, uid, id string) error {
+	return s.updateIndex(ctx, uid, func(entries []kvIndexEntry) ([]kvIndexEntry, error) {
+		for i, e := range entries {
+			if e.ID == id {
+				return append(entries[:i], entries[i+1:]...), nil
+			}
+		}
+		return entries, nil
+	})
+}
+
+// Store hashes the token and stores it under its own key, adding it to the
+// user's index.
+func (s *KVStore) Store(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (id string, err error) {
+	ctx, span := StartSpan(ctx, "KVStore.Store")
+	defer func() { endSpan(span, err) }()
+
+	hashToken, err := hasherOrDefault(s.Hasher).Hash(token)
+	if err != nil {
+		return "", err
+	}
+	id, err = NewTokenID()
+	if err != nil {
+		return "", err
+	}
+	if ttl <= 0 {
+		// Token has already expired, so needn't be stored
+		return id, nil
+	}
+
+	exp := time.Now().Add(ttl)
+	b, err := json.Marshal(kvToken{
+		HashedToken: hashToken,
+		Scope:       scope,
+		Expires:     exp,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := s.kv.Set(ctx, s.tokenKey(uid, id), b, ttl); err != nil {
+		return "", err
+	}
+
+	err = s.updateIndex(ctx, uid, func(entries []kvIndexEntry) ([]kvIndexEntry, error) {
+		entries = append(entries, kvIndexEntry{ID: id, Scope: scope, Expires: exp})
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Expires.After(entries[j].Expires)
+		})
+
+		// Discard the tokens closest to expiry if the user has too many
+		if len(entries) > s.MaxTokens && s.MaxTokens > 0 {
+			for _, e := range entries[s.MaxTokens:] {
+				if err := s.remove(ctx, uid, e.ID); err != nil && err != ErrTokenNotFound {
+					return nil, err
+				}
+			}
+			entries = entries[:s.MaxTokens]
+		}
+		return entries, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Exists returns true if the user's index lists an unexpired token.
+func (s *KVStore) Exists(ctx context.Context, uid string) (_ bool, _ time.Time, err error) {
+	ctx, span := StartSpan(ctx, "KVStore.Exists")
+	defer func() { endSpan(span, err) }()
+
+	entries, err := s.index(ctx, uid)
+	if err != nil {
+		return false, time.Time{}, err
+	} else if len(entries) == 0 {
+		return false, time.Time{}, nil
+	}
+	return true, entries[0].Expires, nil
+}
+
+// ExistsInScope returns true if the user's index lists an unexpired token
+// within the scope.
+func (s *KVStore) ExistsInScope(ctx context.Context, uid string, scope Scope) (_ bool, _ time.Time, err error) {
+	ctx, span := StartSpan(ctx, "KVStore.ExistsInScope")
+	defer func() { endSpan(span, err) }()
+
+	entries, err := s.index(ctx, uid)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	for _, e := range entries {
+		if e.Scope == scope {
+			return true, e.Expires, nil
+		}
+	}
+	return false, time.Time{}, nil
+}
+
+// List returns the IDs of the user's unexpired tokens.
+func (s *KVStore) List(ctx context.Context, uid string) (_ []string, err error) {
+	ctx, span := StartSpan(ctx, "KVStore.List")
+	defer func() { endSpan(span, err) }()
+
+	entries, err := s.index(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+	}
+	return ids, nil
+}
+
+// Verify checks the token against the user's stored token.
+func (s *KVStore) Verify(ctx context.Context, token, uid, id string) (_ bool, _ Scope, err error) {
+	ctx, span := StartSpan(ctx, "KVStore.Verify")
+	defer func() { endSpan(span, err) }()
+
+	t, err := s.token(ctx, uid, id)
+	if err != nil {
+		return false, Scope{}, err
+	}
+	valid, err := VerifyHash(s.Hasher, token, t.HashedToken)
+	if err != nil {
+		return false, Scope{}, err
+	}
+	return valid, t.Scope, nil
+}
+
+// Consume verifies the token, deleting it if valid and within the scope.
+// If a concurrent request deletes the token first, `ErrTokenNotFound` is
+// returned.
+func (s *KVStore) Consume(ctx context.Context, token, uid, id string, scope Scope, maxAttempts int) (_ bool, _ Scope, _ int, err error) {
+	ctx, span := StartSpan(ctx, "KVStore.Consume")
+	defer func() { endSpan(span, err) }()
+
+	t, err := s.token(ctx, uid, id)
+	if err != nil {
+		return false, Scope{}, 0, err
+	} else if t.Scope != scope {
+		return false, t.Scope, 0, nil
+	}
+	n := 0
+	if maxAttempts > 0 {
+		// Count the attempt first, so concurrent attempts can't exceed the
+		// limit
+		if n, err = s.countAttempt(ctx, uid, id, t); err != nil {
+			return false, Scope{}, 0, err
+		} else if n > maxAttempts {
+			return false, Scope{}, n, ErrAttemptsExhausted
+		}
+	}
+	valid, err := VerifyHash(s.Hasher, token, t.HashedToken)
+	if err != nil {
+		return false, Scope{}, n, err
+	} else if !valid {
+		return false, t.Scope, n, nil
+	}
+	if err := s.remove(ctx, uid, id); err != nil {
+		return false, Scope{}, n, err
+	}
+	// The token has been consumed, so failing to remove it from the index
+	// only leaves a stale entry, which expires with the token
+	s.unindex(ctx, uid, id)
+	return true, t.Scope, n, nil
+}
+
+// RecordFailure increments the number of failed attempts made against the
+// user's token.
+func (s *KVStore) RecordFailure(ctx context.Context, uid, id string) (_ int, err error) {
+	ctx, span := StartSpan(ctx, "KVStore.RecordFailure")
+	defer func() { endSpan(span, err) }()
+
+	t, err := s.token(ctx, uid, id)
+	if err != nil {
+		return 0, err
+	}
+	return s.countAttempt(ctx, uid, id, t)
+}
+
+// countAttempt increments the number of attempts made against the token,
+// returning the new count.
+func (s *KVStore) countAttempt(ctx context.Context, uid, id string, t kvToken) (int, error) {
+	ttl := time.Until(t.Expires)
+	if ttl <= 0 {
+		return 0, ErrTokenNotFound
+	}
+	if inc, ok := s.kv.(KVIncrementer); ok {
+		n, err := inc.Incr(ctx, s.attemptsKey(uid, id), ttl)
+		return int(n), err
+	}
+
+	// The count is kept apart from the token, so that a token consumed
+	// concurrently is never written back
+	n := 0
+	b, err := s.kv.Get(ctx, s.attemptsKey(uid, id))
+	if err == nil {
+		if n, err = strconv.Atoi(string(b)); err != nil {
+			return 0, err
+		}
+	} else if err != ErrKeyNotFound {
+		return 0, err
+	}
+	n++
+	if err := s.kv.Set(ctx, s.attemptsKey(uid, id), []byte(strconv.Itoa(n)), ttl); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Delete removes the user's token, or all of the user's tokens if no ID is
+// given. `ErrTokenNotFound` is returned if the token does not exist.
+func (s *KVStore) Delete(ctx context.Context, uid, id string) (err error) {
+	ctx, span := StartSpan(ctx, "KVStore.Delete")
+	defer func() { endSpan(span, err) }()
+
+	if id != "" {
+		removeErr := s.remove(ctx, uid, id)
+		if removeErr != nil && removeErr != ErrTokenNotFound {
+			return removeErr
+		}
+		if err := s.unindex(ctx, uid, id); err != nil {
+			return err
+		}
+		return removeErr
+	}
+	return s.updateIndex(ctx, uid, func(entries []kvIndexEntry) ([]kvIndexEntry, error) {
+		for _, e := range entries {
+			if err := s.remove(ctx, uid, e.ID); err != nil && err != ErrTokenNotFound {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+}
@@ -0,0 +1,316 @@
+package passwordless
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testKVStores returns a KVStore for each KV, which should all behave the
+// same.
+func testKVStores(t *testing.T) map[string]*KVStore {
+	_, client := newTestRedis(t)
+	stores := map[string]*KVStore{
+		"mem":   NewKVStore(NewMemKV()),
+		"redis": NewKVStore(NewRedisKV(client)),
+		"plain": NewKVStore(plainKV{NewMemKV()}),
+	}
+	for _, s := range stores {
+		s.Hasher = testHashers["hmac"]
+	}
+	return stores
+}
+
+func TestKVStore(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testKVStores(t) {
+		b, exp, err := s.Exists(ctx, "uid")
+		assert.False(t, b, name)
+		assert.True(t, exp.IsZero(), name)
+		assert.NoError(t, err, name)
+
+		_, err = s.Store(ctx, "", "uid", Scope{}, -time.Hour)
+		assert.NoError(t, err, name)
+		b, exp, err = s.Exists(ctx, "uid")
+		assert.False(t, b, name)
+		assert.True(t, exp.IsZero(), name)
+		assert.NoError(t, err, name)
+
+		_, err = s.Store(ctx, "", "uid", Scope{}, time.Hour)
+		assert.NoError(t, err, name)
+		b, exp, err = s.Exists(ctx, "uid")
+		assert.True(t, b, name)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), exp, time.Minute, name)
+		assert.NoError(t, err, name)
+	}
+}
+
+func TestKVStoreVerify(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testKVStores(t) {
+		// Token doesn't exist
+		b, _, err := s.Verify(ctx, "badtoken", "uid", "id")
+		assert.False(t, b, name)
+		assert.Equal(t, ErrTokenNotFound, err, name)
+
+		// Token expired
+		id, err := s.Store(ctx, "", "uid", Scope{}, -time.Hour)
+		assert.NoError(t, err, name)
+		b, _, err = s.Verify(ctx, "badtoken", "uid", id)
+		assert.False(t, b, name)
+		assert.Equal(t, ErrTokenNotFound, err, name)
+
+		// Token wrong, with scope returned
+		scope := Scope{Strategy: "email", Purpose: "signin"}
+		id, err = s.Store(ctx, "token", "uid", scope, time.Hour)
+		assert.NoError(t, err, name)
+		b, sc, err := s.Verify(ctx, "badtoken", "uid", id)
+		assert.False(t, b, name)
+		assert.Equal(t, scope, sc, name)
+		assert.NoError(t, err, name)
+
+		// Token correct
+		b, sc, err = s.Verify(ctx, "token", "uid", id)
+		assert.True(t, b, name)
+		assert.Equal(t, scope, sc, name)
+		assert.NoError(t, err, name)
+
+		// Token of another user
+		_, _, err = s.Verify(ctx, "token", "uid2", id)
+		assert.Equal(t, ErrTokenNotFound, err, name)
+	}
+}
+
+func TestKVStoreRecordFailure(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testKVStores(t) {
+		// Token doesn't exist
+		n, err := s.RecordFailure(ctx, "uid", "id")
+		assert.Equal(t, 0, n, name)
+		assert.Equal(t, ErrTokenNotFound, err, name)
+
+		// Failures are counted
+		id, err := s.Store(ctx, "token", "uid", Scope{}, time.Hour)
+		assert.NoError(t, err, name)
+		for i := 1; i <= 2; i++ {
+			n, err = s.RecordFailure(ctx, "uid", id)
+			assert.Equal(t, i, n, name)
+			assert.NoError(t, err, name)
+		}
+
+		// New token has its own count
+		id2, err := s.Store(ctx, "token", "uid", Scope{}, time.Hour)
+		assert.NoError(t, err, name)
+		n, err = s.RecordFailure(ctx, "uid", id2)
+		assert.Equal(t, 1, n, name)
+		assert.NoError(t, err, name)
+
+		// Deleting token removes count
+		assert.NoError(t, s.Delete(ctx, "uid", id), name)
+		_, err = s.RecordFailure(ctx, "uid", id)
+		assert.Equal(t, ErrTokenNotFound, err, name)
+	}
+}
+
+// consumingKV deletes tokens from the wrapped KV as soon as they are read,
+// as if they were consumed by a concurrent request.
+type consumingKV struct {
+	KV
+}
+
+func (kv consumingKV) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := kv.KV.Get(ctx, key)
+	if strings.Contains(key, "token:") {
+		kv.KV.Delete(ctx, key)
+	}
+	return b, err
+}
+
+func TestKVStoreRecordFailureConsumed(t *testing.T) {
+	ctx := context.Background()
+	mkv := NewMemKV()
+	s := NewKVStore(consumingKV{plainKV{mkv}})
+	s.Hasher = testHashers["hmac"]
+
+	// Token consumed while the failure is recorded isn't written back
+	id, err := s.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	n, err := s.RecordFailure(ctx, "uid", id)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, err)
+	_, err = mkv.Get(ctx, s.tokenKey("uid", id))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, _, err = s.Verify(ctx, "token", "uid", id)
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestKVStoreMultiple(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testKVStores(t) {
+		s.MaxTokens = 2
+
+		// Tokens are listed most recent first
+		id1, err := s.Store(ctx, "token1", "uid", Scope{}, time.Hour)
+		assert.NoError(t, err, name)
+		id2, err := s.Store(ctx, "token2", "uid", Scope{}, 2*time.Hour)
+		assert.NoError(t, err, name)
+		ids, err := s.List(ctx, "uid")
+		assert.NoError(t, err, name)
+		assert.Equal(t, []string{id2, id1}, ids, name)
+
+		// Token closest to expiry is discarded when there are too many
+		id3, err := s.Store(ctx, "token3", "uid", Scope{}, 3*time.Hour)
+		assert.NoError(t, err, name)
+		ids, err = s.List(ctx, "uid")
+		assert.NoError(t, err, name)
+		assert.Equal(t, []string{id3, id2}, ids, name)
+		_, _, err = s.Verify(ctx, "token1", "uid", id1)
+		assert.Equal(t, ErrTokenNotFound, err, name)
+
+		// Deleting a token leaves the others
+		assert.NoError(t, s.Delete(ctx, "uid", id3), name)
+		ids, err = s.List(ctx, "uid")
+		assert.NoError(t, err, name)
+		assert.Equal(t, []string{id2}, ids, name)
+
+		// Deleting without an ID removes all tokens
+		assert.NoError(t, s.Delete(ctx, "uid", ""), name)
+		ids, err = s.List(ctx, "uid")
+		assert.NoError(t, err, name)
+		assert.Empty(t, ids, name)
+		_, _, err = s.Verify(ctx, "token2", "uid", id2)
+		assert.Equal(t, ErrTokenNotFound, err, name)
+	}
+}
+
+func TestKVStoreConcurrent(t *testing.T) {
+	ctx := context.Background()
+	stores := testKVStores(t)
+	stores["slow"] = NewKVStore(slowKV{NewMemKV()})
+	stores["slow"].Hasher = testHashers["hmac"]
+	for name, s := range stores {
+		if _, ok := s.kv.(KVAdder); !ok {
+			// Index updates may be lost without a lock
+			continue
+		}
+		s.MaxTokens = 20
+
+		// Every token is indexed when stored at once
+		var wg sync.WaitGroup
+		ids := make([]string, 20)
+		for i := range ids {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				id, err := s.Store(ctx, "token", "uid", Scope{}, time.Hour)
+				assert.NoError(t, err, name)
+				ids[i] = id
+			}(i)
+		}
+		wg.Wait()
+		listed, err := s.List(ctx, "uid")
+		assert.NoError(t, err, name)
+		assert.ElementsMatch(t, ids, listed, name)
+	}
+}
+
+func TestKVStoreConsume(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testKVStores(t) {
+		scope := Scope{Strategy: "email"}
+		id, err := s.Store(ctx, "token", "uid", scope, time.Hour)
+		assert.NoError(t, err, name)
+
+		// Tokens are only consumed if valid and within scope
+		b, _, _, err := s.Consume(ctx, "badtoken", "uid", id, scope, 0)
+		assert.False(t, b, name)
+		assert.NoError(t, err, name)
+		b, sc, _, err := s.Consume(ctx, "token", "uid", id, Scope{}, 0)
+		assert.False(t, b, name)
+		assert.Equal(t, scope, sc, name)
+		assert.NoError(t, err, name)
+
+		// Only one of many concurrent requests can consume the token
+		var wg sync.WaitGroup
+		var mut sync.Mutex
+		consumed := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b, _, _, err := s.Consume(ctx, "token", "uid", id, scope, 0)
+				if err != nil {
+					assert.Equal(t, ErrTokenNotFound, err, name)
+				}
+				if b {
+					mut.Lock()
+					consumed++
+					mut.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 1, consumed, name)
+		ids, err := s.List(ctx, "uid")
+		assert.NoError(t, err, name)
+		assert.Empty(t, ids, name)
+	}
+}
+
+func TestKVStoreLock(t *testing.T) {
+	ctx := context.Background()
+	kv := NewMemKV()
+	s := NewKVStore(kv)
+	key := s.lockKey("uid")
+
+	// Lock is released by its owner
+	unlock, err := s.lock(ctx, kv, "uid")
+	assert.NoError(t, err)
+	unlock()
+	_, err = kv.Get(ctx, key)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// Lock taken by another owner after expiring is left alone
+	unlock, err = s.lock(ctx, kv, "uid")
+	assert.NoError(t, err)
+	assert.NoError(t, kv.Set(ctx, key, []byte("other"), kvLockTTL))
+	unlock()
+	b, err := kv.Get(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "other", string(b))
+}
+
+// indexFailingKV fails to write the index of the wrapped KV.
+type indexFailingKV struct {
+	KV
+}
+
+func (kv indexFailingKV) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if strings.Contains(key, "index:") {
+		return errors.New("index unavailable")
+	}
+	return kv.KV.Set(ctx, key, value, ttl)
+}
+
+func TestKVStoreConsumeUnindexFails(t *testing.T) {
+	ctx := context.Background()
+	mkv := NewMemKV()
+	s := NewKVStore(mkv)
+	s.Hasher = testHashers["hmac"]
+	id, err := s.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+
+	// Token is consumed even if it can't be removed from the index
+	s.kv = indexFailingKV{mkv}
+	b, _, _, err := s.Consume(ctx, "token", "uid", id, Scope{}, 0)
+	assert.True(t, b)
+	assert.NoError(t, err)
+	_, _, err = s.Verify(ctx, "token", "uid", id)
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.Equal(t, ErrTokenNotFound, s.Delete(ctx, "uid", "missing"))
+}
@@ -1,36 +1,104 @@
 package passwordless
 
 import (
+	"container/heap"
+	"container/list"
+	"hash/fnv"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/pzduniak/mcf"
 	"context"
 )
 
+const (
+	// DefaultMemShards is the number of shards used by `NewMemStore`.
+	DefaultMemShards = 16
+)
+
+// EvictionPolicy determines which token is discarded when a `MemStore` is
+// full.
+type EvictionPolicy int
+
+const (
+	// EvictEarliestExpiry discards the token closest to expiry.
+	EvictEarliestExpiry EvictionPolicy = iota
+	// EvictLRU discards the token least recently stored or verified.
+	EvictLRU
+)
+
 // MemStore is a Store that keeps tokens in memory, expiring them periodically
 // when they expire.
+//
+// Users are divided between shards, each with its own lock, so that requests
+// for different users rarely contend.
 type MemStore struct {
-	mut         sync.Mutex
-	data        map[string]memToken
+	// MaxTokens is the number of outstanding tokens held for each user.
+	MaxTokens int
+	// MaxEntries is the number of tokens held across all users. When
+	// exceeded, tokens are discarded according to `Eviction`, so that
+	// memory can't be exhausted by requesting tokens for many users. The
+	// limit is divided evenly between shards. If zero, the number of tokens
+	// is unlimited.
+	MaxEntries int
+	// Eviction determines which token is discarded when `MaxEntries` is
+	// exceeded.
+	Eviction EvictionPolicy
+	// Hasher hashes tokens before they are stored. If nil, `DefaultHasher`
+	// is used.
+	Hasher TokenHasher
+
+	shards      []*memShard
 	cleaner     *time.Ticker
 	quitCleaner chan (struct{})
 }
 
 type memToken struct {
 	UID         string
+	ID          string
 	HashedToken []byte
+	Scope       Scope
 	Expires     time.Time
+	Attempts    int
+
+	// index is the position of the token in its shard's expiry heap.
+	index int
+	// elem is the token's element in its shard's LRU list.
+	elem *list.Element
+}
+
+// memShard holds the tokens of a subset of users.
+type memShard struct {
+	mut    sync.Mutex
+	data   map[string]map[string]*memToken
+	expiry memExpiry
+	lru    *list.List
 }
 
 // NewMemStore creates and returns a new `MemStore`
 func NewMemStore() *MemStore {
+	return NewMemStoreWithShards(DefaultMemShards)
+}
+
+// NewMemStoreWithShards creates and returns a new `MemStore` dividing users
+// between the given number of shards.
+func NewMemStoreWithShards(n int) *MemStore {
+	if n < 1 {
+		n = 1
+	}
 	ct := time.NewTicker(time.Second)
 	ms := &MemStore{
-		data:        make(map[string]memToken),
+		MaxTokens:   DefaultMaxTokens,
+		shards:      make([]*memShard, n),
 		quitCleaner: make(chan struct{}),
 		cleaner:     ct,
 	}
+	for i := range ms.shards {
+		ms.shards[i] = &memShard{
+			data: make(map[string]map[string]*memToken),
+			lru:  list.New(),
+		}
+	}
 	// Run cleaner periodically
 	go func(quit chan struct{}) {
 	ticker:
@@ -49,71 +117,238 @@ func NewMemStore() *MemStore {
 	return ms
 }
 
+// shard returns the shard holding the user's tokens.
+func (s *MemStore) shard(uid string) *memShard {
+	h := fnv.New32a()
+	h.Write([]byte(uid))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// shardCapacity returns the number of tokens each shard may hold, or zero if
+// unlimited.
+func (s *MemStore) shardCapacity() int {
+	if s.MaxEntries <= 0 {
+		return 0
+	}
+	n := s.MaxEntries / len(s.shards)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
 func (s *MemStore) Store(ctx context.Context, token, uid string,
-	ttl time.Duration) error {
-	hashToken, err := mcf.Create([]byte(token))
+	scope Scope, ttl time.Duration) (id string, err error) {
+	_, span := StartSpan(ctx, "MemStore.Store")
+	defer func() { endSpan(span, err) }()
+
+	hashToken, err := hasherOrDefault(s.Hasher).Hash(token)
+	if err != nil {
+		return "", err
+	}
+	id, err = NewTokenID()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	s.mut.Lock()
-	defer s.mut.Unlock()
-	s.data[uid] = memToken{
+	sh := s.shard(uid)
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	sh.add(&memToken{
 		UID:         uid,
+		ID:          id,
 		HashedToken: hashToken,
+		Scope:       scope,
 		Expires:     time.Now().Add(ttl),
-	}
+	})
+	s.trim(sh, uid)
 
-	return nil
+	return id, nil
 }
 
-func (s *MemStore) Exists(ctx context.Context, uid string) (bool, time.Time, error) {
-	if t, ok := s.data[uid]; !ok {
-		// No known token for this user
-		return false, time.Time{}, nil
-	} else if time.Now().After(t.Expires) {
-		// Token exists, but expired
-		return false, time.Time{}, nil
-	} else {
-		// Token exists and is still valid
-		return true, t.Expires, nil
+func (s *MemStore) Exists(ctx context.Context, uid string) (_ bool, _ time.Time, err error) {
+	_, span := StartSpan(ctx, "MemStore.Exists")
+	defer func() { endSpan(span, err) }()
+
+	return s.exists(uid, nil)
+}
+
+// ExistsInScope returns true if a token is held for the user within the
+// scope, along with the latest expiry time of such tokens.
+func (s *MemStore) ExistsInScope(ctx context.Context, uid string, scope Scope) (_ bool, _ time.Time, err error) {
+	_, span := StartSpan(ctx, "MemStore.ExistsInScope")
+	defer func() { endSpan(span, err) }()
+
+	return s.exists(uid, &scope)
+}
+
+// exists returns the latest expiry time of the user's tokens, only
+// considering those within the scope if not nil.
+func (s *MemStore) exists(uid string, scope *Scope) (bool, time.Time, error) {
+	sh := s.shard(uid)
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	exp := time.Time{}
+	for _, t := range sh.data[uid] {
+		if scope != nil && t.Scope != *scope {
+			continue
+		}
+		if time.Now().Before(t.Expires) && t.Expires.After(exp) {
+			exp = t.Expires
+		}
 	}
+	return !exp.IsZero(), exp, nil
 }
 
-func (s *MemStore) Verify(ctx context.Context, token, uid string) (bool, error) {
-	if t, ok := s.data[uid]; !ok {
-		// No token in database
-		return false, ErrTokenNotFound
-	} else if time.Now().After(t.Expires) {
-		// Token exists but has expired
-		return false, ErrTokenNotFound
-	} else if valid, err := mcf.Verify([]byte(token), t.HashedToken); err != nil {
+func (s *MemStore) List(ctx context.Context, uid string) (_ []string, err error) {
+	_, span := StartSpan(ctx, "MemStore.List")
+	defer func() { endSpan(span, err) }()
+
+	sh := s.shard(uid)
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	tokens := sh.data[uid]
+	ids := make([]string, 0, len(tokens))
+	for id, t := range tokens {
+		if time.Now().Before(t.Expires) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return tokens[ids[i]].Expires.After(tokens[ids[j]].Expires)
+	})
+	return ids, nil
+}
+
+func (s *MemStore) Verify(ctx context.Context, token, uid, id string) (_ bool, _ Scope, err error) {
+	_, span := StartSpan(ctx, "MemStore.Verify")
+	defer func() { endSpan(span, err) }()
+
+	_, t, err := s.load(uid, id, Scope{}, 0)
+	if err != nil {
+		// Token doesn't exist, or has expired
+		return false, Scope{}, err
+	} else if valid, err := VerifyHash(s.Hasher, token, t.HashedToken); err != nil {
 		// Couldn't validate token
-		return false, err
+		return false, Scope{}, err
 	} else if !valid {
 		// Token does not validate against hashed token
-		return false, nil
+		return false, t.Scope, nil
 	} else {
 		// Token is valid!
-		return true, nil
+		return true, t.Scope, nil
+	}
+}
+
+// Consume verifies the token, deleting it if valid and within the scope.
+// The attempt is counted under the lock, and the token verified without
+// holding it, and then only deleted if it is still held, so if a concurrent
+// request consumes it first, `ErrTokenNotFound` is returned.
+func (s *MemStore) Consume(ctx context.Context, token, uid, id string, scope Scope, maxAttempts int) (_ bool, _ Scope, _ int, err error) {
+	_, span := StartSpan(ctx, "MemStore.Consume")
+	defer func() { endSpan(span, err) }()
+
+	tp, t, err := s.load(uid, id, scope, maxAttempts)
+	if err != nil || t.Scope != scope {
+		return false, t.Scope, t.Attempts, err
 	}
+	valid, err := VerifyHash(s.Hasher, token, t.HashedToken)
+	if err != nil {
+		return false, Scope{}, t.Attempts, err
+	} else if !valid {
+		return false, t.Scope, t.Attempts, nil
+	}
+
+	sh := s.shard(uid)
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	if sh.data[uid][id] != tp {
+		// Token was consumed or replaced by another request
+		return false, Scope{}, t.Attempts, ErrTokenNotFound
+	}
+	sh.remove(tp)
+	return true, t.Scope, t.Attempts, nil
+}
+
+// load returns the user's unexpired token of the given ID, along with a
+// copy that can be read without holding the lock. If the token is within
+// the scope and maxAttempts is positive, an attempt is counted against it,
+// or `ErrAttemptsExhausted` returned if the limit has been reached.
+func (s *MemStore) load(uid, id string, scope Scope, maxAttempts int) (*memToken, memToken, error) {
+	sh := s.shard(uid)
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	tp, ok := sh.data[uid][id]
+	if !ok || time.Now().After(tp.Expires) {
+		return nil, memToken{}, ErrTokenNotFound
+	}
+	sh.lru.MoveToFront(tp.elem)
+	if tp.Scope == scope && maxAttempts > 0 {
+		if tp.Attempts >= maxAttempts {
+			return nil, memToken{}, ErrAttemptsExhausted
+		}
+		tp.Attempts++
+	}
+	return tp, *tp, nil
 }
 
-func (s *MemStore) Delete(ctx context.Context, uid string) error {
-	s.mut.Lock()
-	defer s.mut.Unlock()
-	delete(s.data, uid)
+func (s *MemStore) RecordFailure(ctx context.Context, uid, id string) (_ int, err error) {
+	_, span := StartSpan(ctx, "MemStore.RecordFailure")
+	defer func() { endSpan(span, err) }()
+
+	sh := s.shard(uid)
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	t, ok := sh.data[uid][id]
+	if !ok || time.Now().After(t.Expires) {
+		return 0, ErrTokenNotFound
+	}
+	t.Attempts++
+	return t.Attempts, nil
+}
+
+func (s *MemStore) Delete(ctx context.Context, uid, id string) (err error) {
+	_, span := StartSpan(ctx, "MemStore.Delete")
+	defer func() { endSpan(span, err) }()
+
+	sh := s.shard(uid)
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+	if id == "" {
+		for _, t := range sh.data[uid] {
+			sh.remove(t)
+		}
+		return nil
+	}
+	t, ok := sh.data[uid][id]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	sh.remove(t)
 	return nil
 }
 
+// Len returns the number of tokens held, including any that have expired
+// but not yet been cleaned.
+func (s *MemStore) Len() int {
+	n := 0
+	for _, sh := range s.shards {
+		sh.mut.Lock()
+		n += len(sh.expiry)
+		sh.mut.Unlock()
+	}
+	return n
+}
+
 // Clean removes expired entries from the store.
 func (s *MemStore) Clean() {
-	s.mut.Lock()
-	defer s.mut.Unlock()
-	for uid, token := range s.data {
-		if time.Now().After(token.Expires) {
-			delete(s.data, uid)
+	now := time.Now()
+	for _, sh := range s.shards {
+		sh.mut.Lock()
+		for len(sh.expiry) > 0 && now.After(sh.expiry[0].Expires) {
+			sh.remove(sh.expiry[0])
 		}
+		sh.mut.Unlock()
 	}
 }
 
@@ -121,5 +356,86 @@ func (s *MemStore) Clean() {
 func (s *MemStore) Release() {
 	s.cleaner.Stop()
 	close(s.quitCleaner)
-	s.data = nil
+	for _, sh := range s.shards {
+		sh.mut.Lock()
+		sh.data = nil
+		sh.expiry = nil
+		sh.lru.Init()
+		sh.mut.Unlock()
+	}
+}
+
+// trim discards the user's tokens closest to expiry if they have too many,
+// and then tokens of any user if the shard is full. The caller must hold
+// the shard's lock.
+func (s *MemStore) trim(sh *memShard, uid string) {
+	tokens := sh.data[uid]
+	for len(tokens) > s.MaxTokens && s.MaxTokens > 0 {
+		var oldest *memToken
+		for _, t := range tokens {
+			if oldest == nil || t.Expires.Before(oldest.Expires) {
+				oldest = t
+			}
+		}
+		sh.remove(oldest)
+	}
+
+	if max := s.shardCapacity(); max > 0 {
+		for len(sh.expiry) > max {
+			if s.Eviction == EvictLRU {
+				sh.remove(sh.lru.Back().Value.(*memToken))
+			} else {
+				sh.remove(sh.expiry[0])
+			}
+		}
+	}
+}
+
+// add adds the token to the shard. The caller must hold the lock.
+func (sh *memShard) add(t *memToken) {
+	tokens, ok := sh.data[t.UID]
+	if !ok {
+		tokens = make(map[string]*memToken)
+		sh.data[t.UID] = tokens
+	}
+	tokens[t.ID] = t
+	heap.Push(&sh.expiry, t)
+	t.elem = sh.lru.PushFront(t)
+}
+
+// remove removes the token from the shard. The caller must hold the lock.
+func (sh *memShard) remove(t *memToken) {
+	heap.Remove(&sh.expiry, t.index)
+	sh.lru.Remove(t.elem)
+	tokens := sh.data[t.UID]
+	delete(tokens, t.ID)
+	if len(tokens) == 0 {
+		delete(sh.data, t.UID)
+	}
+}
+
+// memExpiry is a heap of tokens ordered by expiry time, earliest first.
+type memExpiry []*memToken
+
+func (h memExpiry) Len() int           { return len(h) }
+func (h memExpiry) Less(i, j int) bool { return h[i].Expires.Before(h[j].Expires) }
+
+func (h memExpiry) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *memExpiry) Push(x interface{}) {
+	t := x.(*memToken)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *memExpiry) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return t
 }
@@ -0,0 +1,165 @@
+package passwordless
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	memSnapshotVersion = 1
+)
+
+var (
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+)
+
+// memSnapshot is the serialised form of a MemStore's tokens.
+type memSnapshot struct {
+	Version int                `json:"version"`
+	Created time.Time          `json:"created"`
+	Tokens  []memSnapshotToken `json:"tokens"`
+}
+
+type memSnapshotToken struct {
+	UID         string    `json:"uid"`
+	ID          string    `json:"id"`
+	HashedToken []byte    `json:"hash"`
+	Scope       Scope     `json:"scope"`
+	Expires     time.Time `json:"expires"`
+	Attempts    int       `json:"attempts"`
+}
+
+// Snapshot writes the store's unexpired tokens to w. Tokens are written as
+// hashed, so the snapshot cannot be used to recover them, but it should
+// still be kept private.
+func (s *MemStore) Snapshot(w io.Writer) error {
+	snap := memSnapshot{
+		Version: memSnapshotVersion,
+		Created: time.Now(),
+		Tokens:  []memSnapshotToken{},
+	}
+	for _, sh := range s.shards {
+		sh.mut.Lock()
+		for _, t := range sh.expiry {
+			if snap.Created.After(t.Expires) {
+				continue
+			}
+			snap.Tokens = append(snap.Tokens, memSnapshotToken{
+				UID:         t.UID,
+				ID:          t.ID,
+				HashedToken: t.HashedToken,
+				Scope:       t.Scope,
+				Expires:     t.Expires,
+				Attempts:    t.Attempts,
+			})
+		}
+		sh.mut.Unlock()
+	}
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// Restore reads a snapshot written by `Snapshot` from r, adding its tokens
+// to the store and returning the number added. Tokens that have expired
+// since the snapshot was written, or that are already held, are skipped.
+// Tokens are discarded as usual if `MaxTokens` or `MaxEntries` is exceeded.
+func (s *MemStore) Restore(r io.Reader) (int, error) {
+	snap := memSnapshot{}
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return 0, err
+	}
+	if snap.Version != memSnapshotVersion {
+		return 0, fmt.Errorf("%w: %d", ErrSnapshotVersion, snap.Version)
+	}
+	n := 0
+	now := time.Now()
+	for _, t := range snap.Tokens {
+		if now.After(t.Expires) {
+			continue
+		}
+		sh := s.shard(t.UID)
+		sh.mut.Lock()
+		if _, ok := sh.data[t.UID][t.ID]; !ok {
+			sh.add(&memToken{
+				UID:         t.UID,
+				ID:          t.ID,
+				HashedToken: t.HashedToken,
+				Scope:       t.Scope,
+				Expires:     t.Expires,
+				Attempts:    t.Attempts,
+			})
+			s.trim(sh, t.UID)
+			n++
+		}
+		sh.mut.Unlock()
+	}
+	return n, nil
+}
+
+// SaveSnapshot writes a snapshot of the store to the file at path. The
+// snapshot is written to a temporary file in the same directory, which then
+// replaces the file, so that an existing snapshot is never left partially
+// written.
+func (s *MemStore) SaveSnapshot(path string) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := s.Snapshot(f); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot restores the snapshot held in the file at path, returning the
+// number of tokens added. If the file does not exist, no tokens are added
+// and no error is returned, so it can be called on first start.
+func (s *MemStore) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return s.Restore(f)
+}
+
+// SnapshotEvery saves a snapshot of the store to the file at path at the
+// given interval, and once more when the context is done. Errors are passed
+// to onError, if not nil.
+func (s *MemStore) SnapshotEvery(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.SaveSnapshot(path); err != nil && onError != nil {
+				onError(err)
+			}
+		case <-ctx.Done():
+			if err := s.SaveSnapshot(path); err != nil && onError != nil {
+				onError(err)
+			}
+			return
+		}
+	}
+}
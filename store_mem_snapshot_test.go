@@ -0,0 +1,114 @@
+package passwordless
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemStoreSnapshot(t *testing.T) {
+	ms := NewMemStore()
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+	scope := Scope{Strategy: "email", Purpose: "signin"}
+	id1, err := ms.Store(nil, "1337", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	id2, err := ms.Store(nil, "1338", "uid2", Scope{}, 50*time.Millisecond)
+	assert.NoError(t, err)
+	_, err = ms.Store(nil, "1339", "uid3", Scope{}, -time.Hour)
+	assert.NoError(t, err)
+	_, err = ms.RecordFailure(nil, "uid", id1)
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, ms.Snapshot(buf))
+	assert.NotContains(t, buf.String(), "1337")
+
+	// Tokens expiring while the store is down are skipped
+	time.Sleep(100 * time.Millisecond)
+	ms2 := NewMemStore()
+	defer ms2.Release()
+	ms2.Hasher = testHashers["hmac"]
+	n, err := ms2.Restore(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, _, err = ms2.Verify(nil, "1338", "uid2", id2)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Restored tokens keep their scope and attempts
+	valid, sc, err := ms2.Verify(nil, "1337", "uid", id1)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, scope, sc)
+	attempts, err := ms2.RecordFailure(nil, "uid", id1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// Tokens already held are not restored again
+	n, err = ms2.Restore(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Unknown versions are rejected
+	_, err = ms2.Restore(bytes.NewBufferString(`{"version":99}`))
+	assert.True(t, errors.Is(err, ErrSnapshotVersion))
+}
+
+func TestMemStoreSaveSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tokens.json")
+
+	ms := NewMemStore()
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+
+	// Missing snapshot is ignored
+	n, err := ms.LoadSnapshot(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	id, err := ms.Store(nil, "1337", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, ms.SaveSnapshot(path))
+	assert.NoError(t, ms.SaveSnapshot(path))
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	ms2 := NewMemStore()
+	defer ms2.Release()
+	ms2.Hasher = testHashers["hmac"]
+	n, err = ms2.LoadSnapshot(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	valid, _, err := ms2.Verify(nil, "1337", "uid", id)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// Failed writes leave the existing snapshot in place
+	assert.Error(t, ms.SaveSnapshot(filepath.Join(dir, "missing", "tokens.json")))
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+
+	// Snapshot is saved when the context is done
+	os.Remove(path)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ms.SnapshotEvery(ctx, path, time.Hour, func(err error) { t.Error(err) })
+		close(done)
+	}()
+	cancel()
+	<-done
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
@@ -1,6 +1,8 @@
 package passwordless
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,20 +18,20 @@ func TestMemStore(t *testing.T) {
 	assert.True(t, exp.IsZero())
 	assert.NoError(t, err)
 
-	err = ms.Store(nil, "", "uid", -time.Hour)
+	_, err = ms.Store(nil, "", "uid", Scope{}, -time.Hour)
 	b, exp, err = ms.Exists(nil, "uid")
 	assert.False(t, b)
 	assert.True(t, exp.IsZero())
 	assert.NoError(t, err)
 
-	err = ms.Store(nil, "", "uid", time.Hour)
+	_, err = ms.Store(nil, "", "uid", Scope{}, time.Hour)
 	b, exp, err = ms.Exists(nil, "uid")
 	assert.True(t, b)
 	assert.False(t, exp.IsZero())
 	assert.NoError(t, err)
 
 	// Test keys are expired correctly
-	err = ms.Store(nil, "", "expuid", time.Second)
+	_, err = ms.Store(nil, "", "expuid", Scope{}, time.Second)
 	assert.NoError(t, err)
 	b, _, _ = ms.Exists(nil, "expuid")
 	assert.True(t, b)
@@ -48,25 +50,249 @@ func TestMemStoreVerify(t *testing.T) {
 	assert.NotNil(t, ms)
 
 	// Token doesn't exist
-	b, err := ms.Verify(nil, "badtoken", "uid")
+	b, _, err := ms.Verify(nil, "badtoken", "uid", "id")
 	assert.False(t, b)
 	assert.Equal(t, ErrTokenNotFound, err)
 
 	// Token expired
-	err = ms.Store(nil, "", "uid", -time.Hour)
-	b, err = ms.Verify(nil, "badtoken", "uid")
+	id, err := ms.Store(nil, "", "uid", Scope{}, -time.Hour)
+	b, _, err = ms.Verify(nil, "badtoken", "uid", id)
 	assert.False(t, b)
 	assert.Equal(t, ErrTokenNotFound, err)
 
 	// Token wrong
-	err = ms.Store(nil, "token", "uid", time.Hour)
-	b, err = ms.Verify(nil, "badtoken", "uid")
+	id, err = ms.Store(nil, "token", "uid", Scope{}, time.Hour)
+	b, _, err = ms.Verify(nil, "badtoken", "uid", id)
 	assert.False(t, b)
 	assert.NoError(t, err)
 
 	// Token correct
-	b, err = ms.Verify(nil, "token", "uid")
+	b, _, err = ms.Verify(nil, "token", "uid", id)
 	assert.True(t, b)
 	assert.NoError(t, err)
 
+	// Token scope is returned
+	scope := Scope{Strategy: "email", Purpose: "signin"}
+	id, err = ms.Store(nil, "token", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	b, sc, err := ms.Verify(nil, "badtoken", "uid", id)
+	assert.False(t, b)
+	assert.Equal(t, scope, sc)
+	assert.NoError(t, err)
+
+	// Token correct, but for another user
+	b, _, err = ms.Verify(nil, "token", "anotheruid", id)
+	assert.False(t, b)
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestMemStoreRecordFailure(t *testing.T) {
+	ms := NewMemStore()
+	assert.NotNil(t, ms)
+
+	// Token doesn't exist
+	n, err := ms.RecordFailure(nil, "uid", "id")
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Failures are counted
+	id, err := ms.Store(nil, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	n, err = ms.RecordFailure(nil, "uid", id)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, err)
+	n, err = ms.RecordFailure(nil, "uid", id)
+	assert.Equal(t, 2, n)
+	assert.NoError(t, err)
+
+	// New token has its own count
+	id2, err := ms.Store(nil, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	n, err = ms.RecordFailure(nil, "uid", id2)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, err)
+	n, err = ms.RecordFailure(nil, "uid", id)
+	assert.Equal(t, 3, n)
+	assert.NoError(t, err)
+}
+
+func TestMemStoreMultiple(t *testing.T) {
+	ms := NewMemStore()
+	ms.MaxTokens = 2
+
+	// Tokens are listed most recent first
+	id1, err := ms.Store(nil, "token1", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	id2, err := ms.Store(nil, "token2", "uid", Scope{}, 2*time.Hour)
+	assert.NoError(t, err)
+	ids, err := ms.List(nil, "uid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id2, id1}, ids)
+
+	// Token closest to expiry is discarded when there are too many
+	id3, err := ms.Store(nil, "token3", "uid", Scope{}, 3*time.Hour)
+	assert.NoError(t, err)
+	ids, err = ms.List(nil, "uid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id3, id2}, ids)
+	_, exp, err := ms.Exists(nil, "uid")
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(3*time.Hour), exp, time.Minute)
+
+	// Deleting a token leaves the others
+	assert.NoError(t, ms.Delete(nil, "uid", id3))
+	ids, err = ms.List(nil, "uid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id2}, ids)
+	assert.Equal(t, ErrTokenNotFound, ms.Delete(nil, "uid", id3))
+
+	// Deleting without an ID removes all tokens
+	_, err = ms.Store(nil, "token4", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, ms.Delete(nil, "uid", ""))
+	ids, err = ms.List(nil, "uid")
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestMemStoreConsume(t *testing.T) {
+	ms := NewMemStore()
+	defer ms.Release()
+	ms.Hasher = slowHasher{testHashers["hmac"]}
+	scope := Scope{Strategy: "test"}
+
+	// Run under the race detector; only one request may consume each token
+	for i := 0; i < 20; i++ {
+		id, err := ms.Store(nil, "1337", "uid", scope, time.Hour)
+		assert.NoError(t, err)
+		var wg sync.WaitGroup
+		var mut sync.Mutex
+		consumed := 0
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				valid, _, _, err := ms.Consume(nil, "1337", "uid", id, scope, 0)
+				if err != nil {
+					assert.Equal(t, ErrTokenNotFound, err)
+				} else if valid {
+					mut.Lock()
+					consumed++
+					mut.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 1, consumed)
+	}
+}
+
+func TestMemStoreEviction(t *testing.T) {
+	// Token closest to expiry is evicted when full
+	ms := NewMemStoreWithShards(1)
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+	ms.MaxEntries = 2
+	id1, err := ms.Store(nil, "token", "uid1", Scope{}, 2*time.Hour)
+	assert.NoError(t, err)
+	_, err = ms.Store(nil, "token", "uid2", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	id3, err := ms.Store(nil, "token", "uid3", Scope{}, 3*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, ms.Len())
+	ids, _ := ms.List(nil, "uid1")
+	assert.Equal(t, []string{id1}, ids)
+	ids, _ = ms.List(nil, "uid2")
+	assert.Empty(t, ids)
+	ids, _ = ms.List(nil, "uid3")
+	assert.Equal(t, []string{id3}, ids)
+
+	// Token least recently used is evicted when full
+	ms = NewMemStoreWithShards(1)
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+	ms.MaxEntries = 2
+	ms.Eviction = EvictLRU
+	id1, err = ms.Store(nil, "token", "uid1", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	_, err = ms.Store(nil, "token", "uid2", Scope{}, 2*time.Hour)
+	assert.NoError(t, err)
+	valid, _, err := ms.Verify(nil, "token", "uid1", id1)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	_, err = ms.Store(nil, "token", "uid3", Scope{}, 3*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, ms.Len())
+	ids, _ = ms.List(nil, "uid1")
+	assert.Equal(t, []string{id1}, ids)
+	ids, _ = ms.List(nil, "uid2")
+	assert.Empty(t, ids)
+
+	// Capacity is divided between shards
+	ms = NewMemStoreWithShards(4)
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+	ms.MaxEntries = 100
+	for i := 0; i < 1000; i++ {
+		_, err := ms.Store(nil, "token", fmt.Sprint("uid", i), Scope{}, time.Hour)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 100, ms.Len())
+}
+
+func TestMemStoreClean(t *testing.T) {
+	ms := NewMemStoreWithShards(2)
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+	for i := 0; i < 10; i++ {
+		_, err := ms.Store(nil, "token", fmt.Sprint("uid", i), Scope{}, -time.Duration(i)*time.Second)
+		assert.NoError(t, err)
+		_, err = ms.Store(nil, "token", fmt.Sprint("uid", i), Scope{}, time.Duration(i+1)*time.Hour)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 20, ms.Len())
+
+	// Only expired tokens are removed
+	ms.Clean()
+	assert.Equal(t, 10, ms.Len())
+	for i := 0; i < 10; i++ {
+		ids, err := ms.List(nil, fmt.Sprint("uid", i))
+		assert.NoError(t, err)
+		assert.Len(t, ids, 1)
+	}
+}
+
+func TestMemStoreConcurrent(t *testing.T) {
+	ms := NewMemStoreWithShards(4)
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+	ms.MaxEntries = 50
+	ms.Eviction = EvictLRU
+
+	// Run under the race detector to check shards are locked correctly
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				uid := fmt.Sprint("uid", (i*100+j)%20)
+				id, err := ms.Store(nil, "token", uid, Scope{}, time.Hour)
+				assert.NoError(t, err)
+				ms.Exists(nil, uid)
+				ms.List(nil, uid)
+				if _, _, err := ms.Verify(nil, "token", uid, id); err != nil {
+					// Token may have been evicted by another goroutine
+					assert.Equal(t, ErrTokenNotFound, err)
+				}
+				ms.RecordFailure(nil, uid, id)
+				if j%10 == 0 {
+					ms.Delete(nil, uid, "")
+					ms.Clean()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, ms.Len() <= 50)
 }
@@ -2,86 +2,382 @@ package passwordless
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
 	"time"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/pzduniak/mcf"
 )
 
 const (
-	redisPrefix = "passwordless-token::"
+	// DefaultRedisPrefix is the default prefix of the keys holding tokens.
+	DefaultRedisPrefix = "passwordless-token::"
 )
 
-// RedisStore is a Store that keeps tokens in Redis.
+// redisStoreScript adds a token to the user's hash, discarding expired
+// tokens and those closest to expiry if the user has too many, and expires
+// the hash along with the last of its tokens.
+//
+// KEYS[1] is the user's hash. ARGV is the token ID, the encoded token, the
+// current time in milliseconds and the maximum number of tokens.
+var redisStoreScript = redis.NewScript(`
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+local now = tonumber(ARGV[3])
+local max = tonumber(ARGV[4])
+local live = {}
+local fields = redis.call("HGETALL", KEYS[1])
+for i = 1, #fields, 2 do
+	local ok, t = pcall(cjson.decode, fields[i + 1])
+	local exp = ok and tonumber(t.exp) or 0
+	if exp > 0 and exp <= now then
+		redis.call("HDEL", KEYS[1], fields[i])
+	else
+		table.insert(live, {fields[i], exp})
+	end
+end
+table.sort(live, function(a, b) return a[2] > b[2] end)
+if max > 0 then
+	for i = max + 1, #live do
+		redis.call("HDEL", KEYS[1], live[i][1])
+	end
+end
+if #live > 0 and live[1][2] > now then
+	redis.call("PEXPIRE", KEYS[1], live[1][2] - now)
+end
+return 1
+`)
+
+// redisAttemptScript returns an unexpired token from the user's hash. If
+// the token is within the scope and the number of attempts is limited, an
+// attempt is first counted against it, so that concurrent attempts cannot
+// exceed the limit. Returns {1, token} if found, {0} if the token does not
+// exist, or {-1} if the limit has been reached.
+//
+// KEYS[1] is the user's hash. ARGV is the token ID, the current time in
+// milliseconds, the maximum number of attempts, and the strategy and purpose
+// of the scope.
+var redisAttemptScript = redis.NewScript(`
+local v = redis.call("HGET", KEYS[1], ARGV[1])
+if not v then
+	return {0}
+end
+local t = cjson.decode(v)
+if t.exp and tonumber(t.exp) <= tonumber(ARGV[2]) then
+	return {0}
+end
+local max = tonumber(ARGV[3])
+if max > 0 and t.scope.strategy == ARGV[4] and t.scope.purpose == ARGV[5] then
+	if (t.attempts or 0) >= max then
+		return {-1}
+	end
+	t.attempts = (t.attempts or 0) + 1
+	v = cjson.encode(t)
+	redis.call("HSET", KEYS[1], ARGV[1], v)
+end
+return {1, v}
+`)
+
+// redisConsumeScript deletes a token from the user's hash if it still holds
+// the hashed token that was verified, returning 0 if not. Failed attempts
+// counted since the token was verified don't prevent it being consumed.
+//
+// KEYS[1] is the user's hash. ARGV is the token ID and the base64-encoded
+// hashed token.
+var redisConsumeScript = redis.NewScript(`
+local v = redis.call("HGET", KEYS[1], ARGV[1])
+if not v or cjson.decode(v).hash ~= ARGV[2] then
+	return 0
+end
+redis.call("HDEL", KEYS[1], ARGV[1])
+return 1
+`)
+
+// redisFailureScript increments the number of failed attempts made against
+// an unexpired token, returning the new count, or -1 if the token does not
+// exist.
+//
+// KEYS[1] is the user's hash. ARGV is the token ID and the current time in
+// milliseconds.
+var redisFailureScript = redis.NewScript(`
+local v = redis.call("HGET", KEYS[1], ARGV[1])
+if not v then
+	return -1
+end
+local t = cjson.decode(v)
+if t.exp and tonumber(t.exp) <= tonumber(ARGV[2]) then
+	return -1
+end
+t.attempts = (t.attempts or 0) + 1
+redis.call("HSET", KEYS[1], ARGV[1], cjson.encode(t))
+return t.attempts
+`)
+
+// RedisStore is a Store that keeps tokens in Redis. Each user's tokens are
+// held in a single hash, keyed by token ID. Operations that modify tokens
+// are performed atomically by server-side scripts, so that concurrent
+// requests cannot both consume the same token, or lose failed attempts.
 type RedisStore struct {
+	// MaxTokens is the number of outstanding tokens held for each user.
+	MaxTokens int
+	// Hasher hashes tokens before they are stored. If nil, `DefaultHasher`
+	// is used.
+	Hasher TokenHasher
+	// Prefix is prepended to the user ID to form the key of the hash
+	// holding the user's tokens.
+	Prefix string
+	// HashTag wraps the user ID in braces when forming the key, so that in
+	// Redis Cluster it is held in the same slot as other keys using the
+	// same hash tag.
+	HashTag bool
+
 	client redis.UniversalClient
 }
 
+type redisToken struct {
+	HashedToken []byte    `json:"hash"`
+	Scope       Scope     `json:"scope"`
+	Expires     time.Time `json:"expires"`
+	// ExpiresMillis duplicates Expires in a form that can be read by
+	// scripts.
+	ExpiresMillis int64 `json:"exp"`
+	Attempts      int   `json:"attempts"`
+}
+
 // NewRedisStore creates and returns a new `RedisStore`.
 func NewRedisStore(client redis.UniversalClient) *RedisStore {
 	return &RedisStore{
-		client: client,
+		MaxTokens: DefaultMaxTokens,
+		Prefix:    DefaultRedisPrefix,
+		client:    client,
 	}
 }
 
-func redisKey(uid string) string {
-	return redisPrefix + uid
+// key returns the key of the hash holding the user's tokens.
+func (s RedisStore) key(uid string) string {
+	if s.HashTag {
+		return s.Prefix + "{" + uid + "}"
+	}
+	return s.Prefix + uid
+}
+
+// tokens returns the user's unexpired tokens keyed by ID.
+func (s RedisStore) tokens(ctx context.Context, uid string) (map[string]redisToken, error) {
+	r, err := s.client.HGetAll(ctx, s.key(uid)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	tokens := make(map[string]redisToken, len(r))
+	for id, v := range r {
+		t := redisToken{}
+		if err := json.Unmarshal([]byte(v), &t); err != nil {
+			return nil, err
+		}
+		if time.Now().Before(t.Expires) {
+			tokens[id] = t
+		}
+	}
+	return tokens, nil
+}
+
+// token returns the user's token of the given ID, or ErrTokenNotFound if it
+// does not exist or has expired.
+func (s RedisStore) token(ctx context.Context, uid, id string) (redisToken, error) {
+	t := redisToken{}
+	r, err := s.client.HGet(ctx, s.key(uid), id).Result()
+	if err == redis.Nil {
+		return t, ErrTokenNotFound
+	} else if err != nil {
+		return t, err
+	}
+	if err := json.Unmarshal([]byte(r), &t); err != nil {
+		return t, err
+	}
+	if time.Now().After(t.Expires) {
+		return t, ErrTokenNotFound
+	}
+	return t, nil
 }
 
 // Store a generated token in redis for a user.
-func (s RedisStore) Store(ctx context.Context, token, uid string, ttl time.Duration) error {
-	hashToken, err := mcf.Create([]byte(token))
+func (s RedisStore) Store(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (id string, err error) {
+	ctx, span := StartSpan(orBackground(ctx), "RedisStore.Store")
+	defer func() { endSpan(span, err) }()
+
+	hashToken, err := hasherOrDefault(s.Hasher).Hash(token)
 	if err != nil {
-		return err
+		return "", err
 	}
-	r := s.client.Set(ctx, redisKey(uid), hashToken, ttl)
-	if r.Err() != nil {
-		return r.Err()
+	id, err = NewTokenID()
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	now := time.Now()
+	exp := now.Add(ttl)
+	b, err := json.Marshal(redisToken{
+		HashedToken:   hashToken,
+		Scope:         scope,
+		Expires:       exp,
+		ExpiresMillis: millis(exp),
+	})
+	if err != nil {
+		return "", err
+	}
+	err = redisStoreScript.Run(ctx, s.client, []string{s.key(uid)},
+		id, b, millis(now), s.MaxTokens).Err()
+	if err != nil {
+		return "", err
+	}
+	return id, nil
 }
 
 // Exists checks to see if a token exists.
-func (s RedisStore) Exists(ctx context.Context, uid string) (bool, time.Time, error) {
-	dur, err := s.client.TTL(ctx, redisKey(uid)).Result()
+func (s RedisStore) Exists(ctx context.Context, uid string) (_ bool, _ time.Time, err error) {
+	ctx, span := StartSpan(orBackground(ctx), "RedisStore.Exists")
+	defer func() { endSpan(span, err) }()
+
+	tokens, err := s.tokens(ctx, uid)
 	if err != nil {
-		if err == redis.Nil {
-			return false, time.Time{}, nil
-		}
 		return false, time.Time{}, err
 	}
-	expiry := time.Now().Add(dur)
-	if time.Now().After(expiry) {
+	ids := sortTokenIDs(tokens)
+	if len(ids) == 0 {
 		return false, time.Time{}, nil
 	}
-	return true, expiry, nil
+	return true, tokens[ids[0]].Expires, nil
 }
 
-// Verify checks to see if a token exists and is valid for a user.
-func (s RedisStore) Verify(ctx context.Context, token, uid string) (bool, error) {
-	r, err := s.client.Get(ctx, redisKey(uid)).Result()
+// ExistsInScope checks to see if a token exists within the scope.
+func (s RedisStore) ExistsInScope(ctx context.Context, uid string, scope Scope) (_ bool, _ time.Time, err error) {
+	ctx, span := StartSpan(orBackground(ctx), "RedisStore.ExistsInScope")
+	defer func() { endSpan(span, err) }()
+
+	tokens, err := s.tokens(ctx, uid)
 	if err != nil {
-		if err == redis.Nil {
-			return false, ErrTokenNotFound
+		return false, time.Time{}, err
+	}
+	for _, id := range sortTokenIDs(tokens) {
+		if tokens[id].Scope == scope {
+			return true, tokens[id].Expires, nil
 		}
-		return false, err
 	}
-	valid, err := mcf.Verify([]byte(token), []byte(r))
+	return false, time.Time{}, nil
+}
+
+// List returns the IDs of the user's tokens.
+func (s RedisStore) List(ctx context.Context, uid string) (_ []string, err error) {
+	ctx, span := StartSpan(orBackground(ctx), "RedisStore.List")
+	defer func() { endSpan(span, err) }()
+
+	tokens, err := s.tokens(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	return sortTokenIDs(tokens), nil
+}
+
+// Verify checks to see if a token exists and is valid for a user.
+func (s RedisStore) Verify(ctx context.Context, token, uid, id string) (_ bool, _ Scope, err error) {
+	ctx, span := StartSpan(orBackground(ctx), "RedisStore.Verify")
+	defer func() { endSpan(span, err) }()
+
+	t, err := s.token(ctx, uid, id)
+	if err != nil {
+		return false, Scope{}, err
+	}
+	valid, err := VerifyHash(s.Hasher, token, t.HashedToken)
+	if err != nil {
+		return false, Scope{}, err
+	}
+	return valid, t.Scope, nil
+}
+
+// Consume verifies the token, deleting it if valid and within the scope.
+// The attempt is counted, and the token read, by a single script, and the
+// token is only deleted if it is still held, so if a concurrent request
+// consumes it first, `ErrTokenNotFound` is returned.
+func (s RedisStore) Consume(ctx context.Context, token, uid, id string, scope Scope, maxAttempts int) (_ bool, _ Scope, _ int, err error) {
+	ctx, span := StartSpan(orBackground(ctx), "RedisStore.Consume")
+	defer func() { endSpan(span, err) }()
+
+	r, err := redisAttemptScript.Run(ctx, s.client, []string{s.key(uid)},
+		id, millis(time.Now()), maxAttempts, scope.Strategy, scope.Purpose).Slice()
 	if err != nil {
-		return false, err
+		return false, Scope{}, 0, err
 	}
-	if !valid {
-		return false, nil
+	if status, _ := r[0].(int64); status == 0 {
+		return false, Scope{}, 0, ErrTokenNotFound
+	} else if status < 0 {
+		return false, Scope{}, 0, ErrAttemptsExhausted
 	}
-	return true, nil
+	raw, _ := r[1].(string)
+	t := redisToken{}
+	if err := json.Unmarshal([]byte(raw), &t); err != nil {
+		return false, Scope{}, 0, err
+	}
+	if t.Scope != scope {
+		return false, t.Scope, 0, nil
+	}
+	valid, err := VerifyHash(s.Hasher, token, t.HashedToken)
+	if err != nil {
+		return false, Scope{}, t.Attempts, err
+	} else if !valid {
+		return false, t.Scope, t.Attempts, nil
+	}
+	n, err := redisConsumeScript.Run(ctx, s.client, []string{s.key(uid)},
+		id, base64.StdEncoding.EncodeToString(t.HashedToken)).Int()
+	if err != nil {
+		return false, Scope{}, t.Attempts, err
+	} else if n == 0 {
+		// Token was consumed by another request
+		return false, Scope{}, t.Attempts, ErrTokenNotFound
+	}
+	return true, t.Scope, t.Attempts, nil
+}
+
+// RecordFailure increments the number of failed attempts made against a
+// user's token.
+func (s RedisStore) RecordFailure(ctx context.Context, uid, id string) (_ int, err error) {
+	ctx, span := StartSpan(orBackground(ctx), "RedisStore.RecordFailure")
+	defer func() { endSpan(span, err) }()
+
+	n, err := redisFailureScript.Run(ctx, s.client, []string{s.key(uid)},
+		id, millis(time.Now())).Int()
+	if err != nil {
+		return 0, err
+	} else if n < 0 {
+		return 0, ErrTokenNotFound
+	}
+	return n, nil
 }
 
-// Delete removes a key from the store.
-func (s RedisStore) Delete(ctx context.Context, uid string) error {
-	_, err := s.client.Del(ctx, redisKey(uid)).Result()
+// Delete removes a token from the store, or all of the user's tokens if
+// no ID is given.
+func (s RedisStore) Delete(ctx context.Context, uid, id string) (err error) {
+	ctx, span := StartSpan(orBackground(ctx), "RedisStore.Delete")
+	defer func() { endSpan(span, err) }()
+
+	if id == "" {
+		_, err = s.client.Del(ctx, s.key(uid)).Result()
+	} else {
+		_, err = s.client.HDel(ctx, s.key(uid), id).Result()
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// sortTokenIDs returns the IDs of the given tokens, ordered by descending
+// expiry time.
+func sortTokenIDs(tokens map[string]redisToken) []string {
+	ids := make([]string, 0, len(tokens))
+	for id := range tokens {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return tokens[ids[i]].Expires.After(tokens[ids[j]].Expires)
+	})
+	return ids
+}
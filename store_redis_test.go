@@ -1,115 +1,374 @@
 package passwordless
 
 import (
+	"context"
+	"encoding/base64"
 	"log"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
 )
 
-type rval struct {
-	v string
-	d time.Duration
-}
-
-type redisMock struct {
-	redis.UniversalClient
-	store map[string]rval
-}
-
-func newRedisMock() *redisMock {
-	return &redisMock{
-		store: map[string]rval{},
-	}
-}
-
-func (r redisMock) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
-	val := rval{
-		d: expiration,
-	}
-	switch v := value.(type) {
-	case []byte:
-		val.v = string(v)
-	}
-	r.store[key] = val
-	return redis.NewStatusResult(key, nil)
-}
-
-func (r redisMock) TTL(key string) *redis.DurationCmd {
-	v, ok := r.store[key]
-	if !ok {
-		return redis.NewDurationResult(-1*time.Second, nil)
-	}
-	cmd := redis.NewDurationResult(v.d, nil)
-	return cmd
-}
-
-func (r redisMock) Get(key string) *redis.StringCmd {
-	v, ok := r.store[key]
-	if !ok {
-		return redis.NewStringResult("", redis.Nil)
-	}
-	if time.Now().After(time.Now().Add(v.d)) {
-		delete(r.store, key)
-		return redis.NewStringResult("", redis.Nil)
-	}
-	return redis.NewStringResult(v.v, nil)
-}
-
-func (r redisMock) Del(keys ...string) *redis.IntCmd {
-	for _, k := range keys {
-		delete(r.store, k)
-	}
-	return redis.NewIntResult(1, nil)
+// newTestRedis returns a client connected to an in-process Redis server
+// that is stopped when the test ends.
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, redis.UniversalClient) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
 }
 
 func TestRedisStore(t *testing.T) {
-	ms := NewRedisStore(newRedisMock())
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	ms := NewRedisStore(client)
 	assert.NotNil(t, ms)
 
-	b, exp, err := ms.Exists(nil, "uid")
+	b, exp, err := ms.Exists(ctx, "uid")
 	assert.False(t, b)
 	assert.True(t, exp.IsZero())
 	assert.NoError(t, err)
 
-	err = ms.Store(nil, "", "uid", -time.Hour)
-	b, exp, err = ms.Exists(nil, "uid")
+	_, err = ms.Store(ctx, "", "uid", Scope{}, -time.Hour)
+	b, exp, err = ms.Exists(ctx, "uid")
 	assert.False(t, b)
 	assert.True(t, exp.IsZero())
 	assert.NoError(t, err)
 
-	err = ms.Store(nil, "", "uid", time.Hour)
-	b, exp, err = ms.Exists(nil, "uid")
+	_, err = ms.Store(ctx, "", "uid", Scope{}, time.Hour)
+	b, exp, err = ms.Exists(ctx, "uid")
 	log.Println(b, exp, err)
 	assert.True(t, b)
 	assert.False(t, exp.IsZero())
 }
 
 func TestRedisStoreVerify(t *testing.T) {
-	ms := NewRedisStore(newRedisMock())
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	ms := NewRedisStore(client)
 	assert.NotNil(t, ms)
 
 	// Token doesn't exist
-	b, err := ms.Verify(nil, "badtoken", "uid")
+	b, _, err := ms.Verify(ctx, "badtoken", "uid", "id")
 	assert.False(t, b)
 	assert.Equal(t, ErrTokenNotFound, err)
 
 	// Token expired
-	err = ms.Store(nil, "", "uid", -time.Hour)
-	b, err = ms.Verify(nil, "badtoken", "uid")
+	id, err := ms.Store(ctx, "", "uid", Scope{}, -time.Hour)
+	b, _, err = ms.Verify(ctx, "badtoken", "uid", id)
 	assert.False(t, b)
 	assert.Equal(t, ErrTokenNotFound, err)
 
 	// Token wrong
-	err = ms.Store(nil, "token", "uid", time.Hour)
-	b, err = ms.Verify(nil, "badtoken", "uid")
+	id, err = ms.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	b, _, err = ms.Verify(ctx, "badtoken", "uid", id)
 	assert.False(t, b)
 	assert.NoError(t, err)
 
 	// Token correct
-	b, err = ms.Verify(nil, "token", "uid")
+	b, _, err = ms.Verify(ctx, "token", "uid", id)
 	assert.True(t, b)
 	assert.NoError(t, err)
+
+	// Token scope is returned
+	scope := Scope{Strategy: "email", Purpose: "signin"}
+	id, err = ms.Store(ctx, "token", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	b, sc, err := ms.Verify(ctx, "badtoken", "uid", id)
+	assert.False(t, b)
+	assert.Equal(t, scope, sc)
+	assert.NoError(t, err)
+}
+
+func TestRedisStoreRecordFailure(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	ms := NewRedisStore(client)
+	assert.NotNil(t, ms)
+
+	// Token doesn't exist
+	n, err := ms.RecordFailure(ctx, "uid", "id")
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Failures are counted
+	id, err := ms.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	n, err = ms.RecordFailure(ctx, "uid", id)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, err)
+	n, err = ms.RecordFailure(ctx, "uid", id)
+	assert.Equal(t, 2, n)
+	assert.NoError(t, err)
+
+	// New token has its own count
+	id2, err := ms.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	n, err = ms.RecordFailure(ctx, "uid", id2)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, err)
+
+	// Deleting token removes count
+	err = ms.Delete(ctx, "uid", id)
+	assert.NoError(t, err)
+	n, err = ms.RecordFailure(ctx, "uid", id)
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestRedisStoreMultiple(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	ms := NewRedisStore(client)
+	ms.MaxTokens = 2
+
+	// Tokens are listed most recent first
+	id1, err := ms.Store(ctx, "token1", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	id2, err := ms.Store(ctx, "token2", "uid", Scope{}, 2*time.Hour)
+	assert.NoError(t, err)
+	ids, err := ms.List(ctx, "uid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id2, id1}, ids)
+
+	// Token closest to expiry is discarded when there are too many
+	id3, err := ms.Store(ctx, "token3", "uid", Scope{}, 3*time.Hour)
+	assert.NoError(t, err)
+	ids, err = ms.List(ctx, "uid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id3, id2}, ids)
+
+	// Deleting a token leaves the others
+	assert.NoError(t, ms.Delete(ctx, "uid", id3))
+	ids, err = ms.List(ctx, "uid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id2}, ids)
+
+	// Deleting without an ID removes all tokens
+	assert.NoError(t, ms.Delete(ctx, "uid", ""))
+	ids, err = ms.List(ctx, "uid")
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestRedisStoreConsume(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	ms := NewRedisStore(client)
+	ms.Hasher = testHashers["hmac"]
+	scope := Scope{Strategy: "email", Purpose: "signin"}
+
+	// Token doesn't exist
+	b, _, _, err := ms.Consume(ctx, "token", "uid", "id", scope, 0)
+	assert.False(t, b)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Wrong token or scope leaves the token in place
+	id, err := ms.Store(ctx, "token", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	b, _, _, err = ms.Consume(ctx, "badtoken", "uid", id, scope, 0)
+	assert.False(t, b)
+	assert.NoError(t, err)
+	b, sc, _, err := ms.Consume(ctx, "token", "uid", id, Scope{Purpose: "other"}, 0)
+	assert.False(t, b)
+	assert.Equal(t, scope, sc)
+	assert.NoError(t, err)
+
+	// Correct token is consumed
+	b, sc, _, err = ms.Consume(ctx, "token", "uid", id, scope, 0)
+	assert.True(t, b)
+	assert.Equal(t, scope, sc)
+	assert.NoError(t, err)
+	b, _, _, err = ms.Consume(ctx, "token", "uid", id, scope, 0)
+	assert.False(t, b)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Token is consumed despite failures counted since it was verified,
+	// but not if it was replaced
+	id, err = ms.Store(ctx, "token", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	tok, err := ms.token(ctx, "uid", id)
+	assert.NoError(t, err)
+	hash := base64.StdEncoding.EncodeToString(tok.HashedToken)
+	_, err = ms.RecordFailure(ctx, "uid", id)
+	assert.NoError(t, err)
+	n, err := redisConsumeScript.Run(ctx, client, []string{ms.key("uid")}, id, "other").Int()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = redisConsumeScript.Run(ctx, client, []string{ms.key("uid")}, id, hash).Int()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Attempts are counted before verifying, and refused once exhausted
+	id, err = ms.Store(ctx, "token", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		b, _, n, err = ms.Consume(ctx, "badtoken", "uid", id, scope, 2)
+		assert.False(t, b)
+		assert.Equal(t, i, n)
+		assert.NoError(t, err)
+	}
+	b, _, _, err = ms.Consume(ctx, "token", "uid", id, scope, 2)
+	assert.False(t, b)
+	assert.Equal(t, ErrAttemptsExhausted, err)
+
+	// Attempts in another scope aren't counted
+	id, err = ms.Store(ctx, "token", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	_, _, n, err = ms.Consume(ctx, "badtoken", "uid", id, Scope{}, 2)
+	assert.Equal(t, 0, n)
+	assert.NoError(t, err)
+	tok, err = ms.token(ctx, "uid", id)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tok.Attempts)
+}
+
+// countingHasher counts the tokens verified by the wrapped hasher.
+type countingHasher struct {
+	TokenHasher
+	n *int64
+}
+
+func (h countingHasher) Verify(token string, hash []byte) (bool, error) {
+	atomic.AddInt64(h.n, 1)
+	return h.TokenHasher.Verify(token, hash)
+}
+
+func TestRedisStoreConsumeAttempts(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	ms := NewRedisStore(client)
+	var verified int64
+	ms.Hasher = countingHasher{testHashers["hmac"], &verified}
+
+	// Only the permitted number of concurrent guesses are verified
+	id, err := ms.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, err := ms.Consume(ctx, "badtoken", "uid", id, Scope{}, 3)
+			assert.True(t, err == nil || err == ErrAttemptsExhausted, "%v", err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(3), verified)
+
+	// Concurrent failures don't stop the correct token being consumed
+	id, err = ms.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	consumed := make(chan bool, 1)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 0 {
+				b, _, _, err := ms.Consume(ctx, "token", "uid", id, Scope{}, 20)
+				assert.NoError(t, err)
+				consumed <- b
+				return
+			}
+			ms.Consume(ctx, "badtoken", "uid", id, Scope{}, 20)
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, <-consumed)
+}
+
+func TestRedisStoreNilContext(t *testing.T) {
+	_, client := newTestRedis(t)
+	ms := NewRedisStore(client)
+	ms.Hasher = testHashers["hmac"]
+
+	id, err := ms.Store(nil, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	b, _, err := ms.Verify(nil, "token", "uid", id)
+	assert.NoError(t, err)
+	assert.True(t, b)
+	b, _, _, err = ms.Consume(nil, "token", "uid", id, Scope{}, 0)
+	assert.NoError(t, err)
+	assert.True(t, b)
+}
+
+func TestRedisStoreConsumeConcurrent(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	ms := NewRedisStore(client)
+	ms.Hasher = testHashers["hmac"]
+
+	id, err := ms.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+
+	// Only one of many concurrent requests can consume the token
+	var wg sync.WaitGroup
+	var mut sync.Mutex
+	consumed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, _, _, err := ms.Consume(ctx, "token", "uid", id, Scope{}, 0)
+			if err != nil {
+				assert.Equal(t, ErrTokenNotFound, err)
+			}
+			if b {
+				mut.Lock()
+				consumed++
+				mut.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, consumed)
+
+	// Failures made concurrently are all counted
+	id, err = ms.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ms.RecordFailure(ctx, "uid", id)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	n, err := ms.RecordFailure(ctx, "uid", id)
+	assert.NoError(t, err)
+	assert.Equal(t, 11, n)
+}
+
+func TestRedisStoreKeys(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+
+	// Default prefix
+	ms := NewRedisStore(client)
+	_, err := ms.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, mr.Exists("passwordless-token::uid"))
+
+	// Custom prefix with hash tag
+	ms.Prefix = "app:tokens:"
+	ms.HashTag = true
+	id, err := ms.Store(ctx, "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, mr.Exists("app:tokens:{uid}"))
+	b, _, err := ms.Verify(ctx, "token", "uid", id)
+	assert.True(t, b)
+	assert.NoError(t, err)
+
+	// Key expires with the last token
+	ttl := mr.TTL("app:tokens:{uid}")
+	assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour, ttl)
+	_, err = ms.Store(ctx, "token", "uid", Scope{}, 2*time.Hour)
+	assert.NoError(t, err)
+	ttl = mr.TTL("app:tokens:{uid}")
+	assert.True(t, ttl > 119*time.Minute && ttl <= 2*time.Hour, ttl)
 }
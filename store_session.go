@@ -16,29 +16,68 @@ import (
 var (
 	ErrNoResponseWriter = errors.New("Context passed to CookieStore.Store " +
 		"does not contain a ResponseWriter")
-	ErrInvalidTokenUID = errors.New("invalid UID in token")
-	ErrInvalidTokenPIN = errors.New("invalid PIN in token")
-	ErrWrongTokenUID   = errors.New("wrong UID in token")
+	ErrInvalidTokenUID  = errors.New("invalid UID in token")
+	ErrInvalidTokenPIN  = errors.New("invalid PIN in token")
+	ErrWrongTokenUID    = errors.New("wrong UID in token")
+	ErrNoCookieKeys     = errors.New("no cookie keys were provided")
+	ErrUnknownCookieKey = errors.New("token was signed with an unknown key")
 )
 
 // CookieStore stores tokens in a encrypted cookie on the user's browser.
 // This token is then decrypted and checked against the provided value to
 // determine of the token is valid.
+//
+// Each browser holds a single token, so storing a new token replaces any
+// previous token held by the same browser. The token ID is held in the
+// token's "jti" claim.
+//
+// As the cookie is held by the client, deleting the token cannot prevent a
+// captured cookie from being replayed until it expires, nor can failed
+// attempts be reliably counted. To prevent this, set `Consumed` to a
+// registry shared by all servers verifying tokens.
 type CookieStore struct {
-	sk   []byte
-	cs   *securecookie.SecureCookie
-	Path string
-	Key  string
+	keys   []CookieKey
+	codecs []securecookie.Codec
+	Path   string
+	Key    string
+	// Consumed records the IDs of deleted tokens, which are then rejected
+	// until they expire. If it implements `AttemptRegistry`, failed
+	// attempts are also counted. If nil, replays are not detected.
+	Consumed ConsumedRegistry
 }
 
 // NewCookieStore creates a new signed and encrypted CookieStore.
 func NewCookieStore(signingKey, authKey, encrKey []byte) *CookieStore {
-	return &CookieStore{
-		Path: "/",
-		Key:  "passwordless",
-		sk:   signingKey,
-		cs:   securecookie.New(authKey, encrKey),
+	cs, _ := NewCookieStoreWithKeys(CookieKey{
+		SigningKey:    signingKey,
+		AuthKey:       authKey,
+		EncryptionKey: encrKey,
+	})
+	return cs
+}
+
+// NewCookieStoreWithKeys creates a new signed and encrypted CookieStore
+// using the given key ring. New tokens are signed and encrypted with the
+// first key, and tokens created with any of the keys are accepted, so keys
+// can be rotated without invalidating outstanding tokens. Where more than
+// one key is given, each must have a unique ID.
+func NewCookieStoreWithKeys(keys ...CookieKey) (*CookieStore, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoCookieKeys
+	}
+	if err := checkCookieKeyIDs(keys); err != nil {
+		return nil, err
 	}
+	pairs := make([][]byte, 0, 2*len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k.AuthKey, k.EncryptionKey)
+	}
+	return &CookieStore{
+		Path:   "/",
+		Key:    "passwordless",
+		keys:   keys,
+		codecs: securecookie.CodecsFromPairs(pairs...),
+	}, nil
 }
 
 // Store encrypts and writes the token to the curent response.
@@ -47,119 +86,279 @@ func NewCookieStore(signingKey, authKey, encrKey []byte) *CookieStore {
 // expiry *must* be validated on receipt.
 //
 // This function requires that a ResponseWriter is present in the context.
-func (s *CookieStore) Store(ctx context.Context, token, uid string, ttl time.Duration) error {
+func (s *CookieStore) Store(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (id string, err error) {
+	_, span := StartSpan(ctx, "CookieStore.Store")
+	defer func() { endSpan(span, err) }()
+
 	rw, _ := fromContext(ctx)
 	if rw == nil {
-		return ErrNoResponseWriter
+		return "", ErrNoResponseWriter
 	}
-
-	// Create signed token
-	exp := time.Now().Add(ttl)
-	tokString, err := s.newToken(token, uid, exp)
+	id, err = NewTokenID()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// Encode and encrypt cookie value
-	encoded, err := s.cs.Encode(s.Key, tokString)
+	// Create signed token
+	exp := time.Now().Add(ttl)
+	tokString, err := s.newToken(token, uid, id, scope, exp)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// Emit cookie into response
-	cookie := &http.Cookie{
-		Expires: exp,
-		MaxAge:  int(ttl / time.Second),
-		Name:    s.Key,
-		Value:   encoded,
-		Path:    s.Path,
-	}
-	http.SetCookie(rw, cookie)
-
-	return nil
+	return id, s.setCookie(rw, tokString, exp)
 }
 
 func (s *CookieStore) Exists(ctx context.Context, uid string) (bool, time.Time, error) {
-	// Read cookie
-	_, req := fromContext(ctx)
-	var cookie *http.Cookie
-	var err error
-
-	if cookie, err = req.Cookie(s.Key); err != nil {
+	claims, err := s.claims(ctx, uid)
+	if err != nil {
 		return false, time.Time{}, err
 	}
 
-	// Read JWT string from cookie
-	var tokString string
-	if err = s.cs.Decode(s.Key, cookie.Value, &tokString); err != nil {
-		return false, time.Time{}, err
-	}
-	// Parse JWT string
-	tok, claims, err := s.parseToken(tokString)
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	return true, exp, nil
+}
 
-	// Reject invalid JWTs
-	if err != nil || !tok.Valid {
+// ExistsInScope returns true if the cookie holds a token for the user
+// within the scope.
+func (s *CookieStore) ExistsInScope(ctx context.Context, uid string, scope Scope) (bool, time.Time, error) {
+	claims, err := s.claims(ctx, uid)
+	if err != nil {
 		return false, time.Time{}, err
 	}
-
-	// Check token is for the same UID
-	if u, ok := claims["uid"].(string); !ok {
-		// Token contains bad UID
-		return false, time.Time{}, ErrInvalidTokenUID
-	} else if u != uid {
-		// Token is for a different UID
-		return false, time.Time{}, ErrWrongTokenUID
+	if stg, _ := claims["stg"].(string); stg != scope.Strategy {
+		return false, time.Time{}, nil
+	} else if pur, _ := claims["pur"].(string); pur != scope.Purpose {
+		return false, time.Time{}, nil
 	}
 
 	exp := time.Unix(int64(claims["exp"].(float64)), 0)
 	return true, exp, nil
 }
 
+// List returns the ID of the token held in the cookie.
+func (s *CookieStore) List(ctx context.Context, uid string) ([]string, error) {
+	claims, err := s.claims(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	id, _ := claims["jti"].(string)
+	return []string{id}, nil
+}
+
 // Verify reads the cookie from the request and verifies it against the
 // provided values, returning true on success.
-func (s *CookieStore) Verify(ctx context.Context, pin, uid string) (bool, error) {
+func (s *CookieStore) Verify(ctx context.Context, pin, uid, id string) (_ bool, _ Scope, err error) {
+	_, span := StartSpan(ctx, "CookieStore.Verify")
+	defer func() { endSpan(span, err) }()
+
 	_, req := fromContext(ctx)
-	var cookie *http.Cookie
-	var err error
-	if cookie, err = req.Cookie(s.Key); err != nil {
-		return false, err
+	tokString, err := s.getCookie(req)
+	if err != nil {
+		return false, Scope{}, err
 	}
 
-	var tokString string
-	if err = s.cs.Decode(s.Key, cookie.Value, &tokString); err != nil {
-		return false, err
+	valid, scope, err := s.verifyToken(tokString, pin, uid, id)
+	if err != nil {
+		return false, Scope{}, err
+	} else if consumed, err := s.isConsumed(ctx, id); err != nil {
+		return false, Scope{}, err
+	} else if consumed {
+		// Token has already been used
+		return false, Scope{}, ErrTokenNotFound
 	}
-
-	return s.verifyToken(tokString, pin, uid)
+	return valid, scope, nil
 }
 
-// Delete deletes the cookie.
+// RecordFailure records a failed attempt against the token held in the
+// cookie.
+//
+// If the `Consumed` registry implements `AttemptRegistry`, attempts are
+// counted by the registry. Otherwise, the count is held within the cookie,
+// which is re-issued to the current response. As the client then holds the
+// count, an attacker able to replay an earlier cookie can reset it.
 //
 // This function requires that a ResponseWriter is present in the context.
-func (s *CookieStore) Delete(ctx context.Context, uid string) error {
+func (s *CookieStore) RecordFailure(ctx context.Context, uid, id string) (int, error) {
 	rw, _ := fromContext(ctx)
+	if rw == nil {
+		return 0, ErrNoResponseWriter
+	}
+	claims, err := s.claims(ctx, uid)
+	if err != nil {
+		return 0, err
+	} else if jti, _ := claims["jti"].(string); jti != id {
+		// Cookie holds a different token
+		return 0, ErrTokenNotFound
+	}
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	if r, ok := s.Consumed.(AttemptRegistry); ok {
+		return r.RecordAttempt(ctx, id, exp)
+	}
+
+	// Increment attempts and re-sign token with the original expiry
+	n := 1
+	if a, ok := claims["att"].(float64); ok {
+		n = int(a) + 1
+	}
+	claims["att"] = n
+	tokString, err := s.signToken(claims)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, s.setCookie(rw, tokString, exp)
+}
+
+// Delete deletes the cookie. If a registry is configured and the request
+// holds the token, it is marked as consumed; `ErrTokenNotFound` is returned
+// if it had already been consumed.
+//
+// This function requires that a ResponseWriter is present in the context.
+func (s *CookieStore) Delete(ctx context.Context, uid, id string) error {
+	rw, req := fromContext(ctx)
 	if rw == nil {
 		return ErrNoResponseWriter
 	}
 	cookie := &http.Cookie{
-		MaxAge: 0,
+		MaxAge: -1,
 		Name:   s.Key,
 		Path:   s.Path,
 	}
 	http.SetCookie(rw, cookie)
+
+	if s.Consumed == nil {
+		return nil
+	}
+	claims, err := s.readClaims(req, uid)
+	if err != nil {
+		// Request doesn't hold a valid token, so there's nothing to replay
+		return nil
+	}
+	jti, _ := claims["jti"].(string)
+	if id != "" && jti != id {
+		// Cookie holds a different token
+		return nil
+	}
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	if ok, err := s.Consumed.MarkConsumed(ctx, jti, exp); err != nil {
+		return err
+	} else if !ok {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// claims returns the claims of the token held in the request cookie, as
+// `readClaims`, returning `ErrTokenNotFound` if it has been consumed.
+func (s *CookieStore) claims(ctx context.Context, uid string) (jwt.MapClaims, error) {
+	_, req := fromContext(ctx)
+	claims, err := s.readClaims(req, uid)
+	if err != nil {
+		return nil, err
+	}
+	jti, _ := claims["jti"].(string)
+	if consumed, err := s.isConsumed(ctx, jti); err != nil {
+		return nil, err
+	} else if consumed {
+		return nil, ErrTokenNotFound
+	}
+	return claims, nil
+}
+
+// isConsumed returns true if the token of the given ID has been consumed.
+func (s *CookieStore) isConsumed(ctx context.Context, id string) (bool, error) {
+	if s.Consumed == nil {
+		return false, nil
+	}
+	return s.Consumed.IsConsumed(ctx, id)
+}
+
+// setCookie encodes, encrypts and emits the token string as a cookie
+// expiring at the given time.
+func (s *CookieStore) setCookie(rw http.ResponseWriter, tokString string, exp time.Time) error {
+	encoded, err := securecookie.EncodeMulti(s.Key, tokString, s.codecs...)
+	if err != nil {
+		return err
+	}
+
+	cookie := &http.Cookie{
+		Expires: exp,
+		MaxAge:  int(time.Until(exp) / time.Second),
+		Name:    s.Key,
+		Value:   encoded,
+		Path:    s.Path,
+	}
+	http.SetCookie(rw, cookie)
 	return nil
 }
 
+// getCookie reads and decrypts the token string from the request cookie.
+func (s *CookieStore) getCookie(req *http.Request) (string, error) {
+	if req == nil {
+		return "", http.ErrNoCookie
+	}
+	cookie, err := req.Cookie(s.Key)
+	if err != nil {
+		return "", err
+	}
+
+	var tokString string
+	if err := securecookie.DecodeMulti(s.Key, cookie.Value, &tokString, s.codecs...); err != nil {
+		return "", err
+	}
+	return tokString, nil
+}
+
+// readClaims reads, decrypts and parses the token held in the request cookie,
+// returning its claims if it is valid and for the given user.
+func (s *CookieStore) readClaims(req *http.Request, uid string) (jwt.MapClaims, error) {
+	tokString, err := s.getCookie(req)
+	if err != nil {
+		return nil, err
+	}
+	tok, claims, err := s.parseToken(tokString)
+
+	// Reject invalid JWTs
+	if err != nil || !tok.Valid {
+		return nil, err
+	}
+
+	// Check token is for the same UID
+	if u, ok := claims["uid"].(string); !ok {
+		// Token contains bad UID
+		return nil, ErrInvalidTokenUID
+	} else if u != uid {
+		// Token is for a different UID
+		return nil, ErrWrongTokenUID
+	}
+	return claims, nil
+}
+
 // newToken creates and returns a new *unencrypted* JWT token containing the
-// pin and user ID.
-func (s *CookieStore) newToken(pin, uid string, exp time.Time) (string, error) {
-	tok := jwt.New(jwt.SigningMethodHS256)
-	tok.Claims = jwt.MapClaims{
+// pin, user ID, token ID and scope.
+func (s *CookieStore) newToken(pin, uid, id string, scope Scope, exp time.Time) (string, error) {
+	return s.signToken(jwt.MapClaims{
 		"exp": exp.Unix(),
 		"uid": uid,
 		"pin": pin,
+		"jti": id,
+		"stg": scope.Strategy,
+		"pur": scope.Purpose,
+	})
+}
+
+// signToken creates and returns a new *unencrypted* JWT token containing the
+// given claims, signed with the current key.
+func (s *CookieStore) signToken(claims jwt.MapClaims) (string, error) {
+	key := s.keys[0]
+	tok := jwt.New(jwt.SigningMethodHS256)
+	tok.Claims = claims
+	if key.ID != "" {
+		tok.Header["kid"] = key.ID
 	}
-	return tok.SignedString(s.sk)
+	return tok.SignedString(key.SigningKey)
 }
 
 // parseToken parses the token stored in the given strinng.
@@ -169,28 +368,44 @@ func (s *CookieStore) parseToken(t string) (*jwt.Token, jwt.MapClaims, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("verifyToken: unexpected signing method %s", token.Header["alg"])
 		}
-		return s.sk, nil
+		kid, _ := token.Header["kid"].(string)
+		for _, k := range s.keys {
+			if k.ID == kid {
+				return k.SigningKey, nil
+			}
+		}
+		return nil, ErrUnknownCookieKey
 	})
 	return tok, claims, err
 }
 
-// verifyToken verifies an *unencrypted* JWT token.
-func (s *CookieStore) verifyToken(t, pin, uid string) (bool, error) {
+// verifyToken verifies an *unencrypted* JWT token, returning the scope it
+// was issued for.
+func (s *CookieStore) verifyToken(t, pin, uid, id string) (bool, Scope, error) {
 	tok, claims, err := s.parseToken(t)
 
 	// Reject invalid JWTs
 	if err != nil || !tok.Valid {
-		return false, err
+		return false, Scope{}, err
+	}
+
+	// Reject tokens with a different ID, as they have been replaced
+	if jti, _ := claims["jti"].(string); jti != id {
+		return false, Scope{}, ErrTokenNotFound
 	}
 
+	scope := Scope{}
+	scope.Strategy, _ = claims["stg"].(string)
+	scope.Purpose, _ = claims["pur"].(string)
+
 	// Check token matches supplied data.
 	if u, ok := claims["uid"].(string); !ok {
-		return false, ErrInvalidTokenUID
+		return false, Scope{}, ErrInvalidTokenUID
 	} else if p, ok := claims["pin"].(string); !ok {
-		return false, ErrInvalidTokenPIN
+		return false, Scope{}, ErrInvalidTokenPIN
 	} else {
 		validUID := (u == uid)
 		validPIN := (1 == subtle.ConstantTimeCompare([]byte(p), []byte(pin)))
-		return validUID && validPIN, nil
+		return validUID && validPIN, scope, nil
 	}
 }
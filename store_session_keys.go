@@ -0,0 +1,86 @@
+package passwordless
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	ErrInvalidCookieKey = errors.New("cookie key has no signing or authentication key")
+	ErrCookieKeyID      = errors.New("cookie keys in a key ring must have unique, non-empty IDs")
+)
+
+// CookieKey is a set of keys used by a CookieStore to sign, authenticate and
+// optionally encrypt tokens. The ID is written to the "kid" header of tokens
+// signed with the key, so that the key can be found when verifying them. A
+// key ring of more than one key must give each key a unique ID.
+//
+// When encoded as JSON, keys are base64 encoded:
+//
+//	{"id": "2024-06", "signing": "...", "auth": "...", "encryption": "..."}
+type CookieKey struct {
+	ID            string `json:"id"`
+	SigningKey    []byte `json:"signing"`
+	AuthKey       []byte `json:"auth"`
+	EncryptionKey []byte `json:"encryption,omitempty"`
+}
+
+// ParseCookieKeys parses a JSON array of cookie keys, current key first.
+func ParseCookieKeys(data []byte) ([]CookieKey, error) {
+	keys := []CookieKey{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoCookieKeys
+	}
+	for _, k := range keys {
+		if len(k.SigningKey) == 0 || len(k.AuthKey) == 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidCookieKey, k.ID)
+		}
+	}
+	if err := checkCookieKeyIDs(keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// checkCookieKeyIDs returns `ErrCookieKeyID` if the key ring has more than
+// one key and any ID is empty or repeated, as tokens are only verified with
+// the key whose ID matches.
+func checkCookieKeyIDs(keys []CookieKey) error {
+	if len(keys) < 2 {
+		return nil
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if k.ID == "" || seen[k.ID] {
+			return fmt.Errorf("%w: %q", ErrCookieKeyID, k.ID)
+		}
+		seen[k.ID] = true
+	}
+	return nil
+}
+
+// LoadCookieKeys reads a JSON array of cookie keys from the given file. See
+// `ParseCookieKeys`.
+func LoadCookieKeys(path string) ([]CookieKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCookieKeys(data)
+}
+
+// CookieKeysFromEnv reads a JSON array of cookie keys from the named
+// environment variable. See `ParseCookieKeys`.
+func CookieKeysFromEnv(name string) ([]CookieKey, error) {
+	data, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, ErrNoCookieKeys
+	}
+	return ParseCookieKeys([]byte(data))
+}
@@ -0,0 +1,157 @@
+package passwordless
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testKeyA = CookieKey{
+		ID:            "a",
+		SigningKey:    []byte("signing-a"),
+		AuthKey:       []byte("auth-a"),
+		EncryptionKey: []byte("encryptionkey-a!"),
+	}
+	testKeyB = CookieKey{
+		ID:            "b",
+		SigningKey:    []byte("signing-b"),
+		AuthKey:       []byte("auth-b"),
+		EncryptionKey: []byte("encryptionkey-b!"),
+	}
+)
+
+// storeCookie stores a token with the CookieStore, returning a request
+// bearing the resulting cookie.
+func storeCookie(t *testing.T, cs *CookieStore, token, uid string) (string, *http.Request) {
+	rec := NewResponseRecorder()
+	id, err := cs.Store(SetContext(nil, rec, nil), token, uid, Scope{}, time.Hour)
+	assert.NoError(t, err)
+	req, err := http.NewRequest("", "", nil)
+	assert.NoError(t, err)
+	for _, c := range rec.Response().Cookies() {
+		req.AddCookie(c)
+	}
+	return id, req
+}
+
+func TestCookieStoreKeyRotation(t *testing.T) {
+	_, err := NewCookieStoreWithKeys()
+	assert.Equal(t, ErrNoCookieKeys, err)
+
+	old, err := NewCookieStoreWithKeys(testKeyA)
+	assert.NoError(t, err)
+	id, req := storeCookie(t, old, "token", "uid")
+
+	// Tokens are signed with the current key ID
+	tokString, err := old.getCookie(req)
+	assert.NoError(t, err)
+	tok, _, err := old.parseToken(tokString)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", tok.Header["kid"])
+
+	// After rotation, tokens signed with the old key still verify
+	cs, err := NewCookieStoreWithKeys(testKeyB, testKeyA)
+	assert.NoError(t, err)
+	v, _, err := cs.Verify(SetContext(nil, nil, req), "token", "uid", id)
+	assert.NoError(t, err)
+	assert.True(t, v)
+
+	// New tokens use the new key, and are rejected by the old store
+	id, req = storeCookie(t, cs, "token", "uid")
+	v, _, err = cs.Verify(SetContext(nil, nil, req), "token", "uid", id)
+	assert.NoError(t, err)
+	assert.True(t, v)
+	v, _, err = old.Verify(SetContext(nil, nil, req), "token", "uid", id)
+	assert.Error(t, err)
+	assert.False(t, v)
+
+	// Once the old key is retired, its tokens are rejected
+	id, req = storeCookie(t, old, "token", "uid")
+	cs, err = NewCookieStoreWithKeys(testKeyB)
+	assert.NoError(t, err)
+	v, _, err = cs.Verify(SetContext(nil, nil, req), "token", "uid", id)
+	assert.Error(t, err)
+	assert.False(t, v)
+}
+
+func TestCookieStoreKeyIDs(t *testing.T) {
+	noID := testKeyB
+	noID.ID = ""
+
+	// A single key needn't have an ID
+	_, err := NewCookieStoreWithKeys(noID)
+	assert.NoError(t, err)
+
+	// Every key in a larger ring must have a unique ID
+	_, err = NewCookieStoreWithKeys(noID, testKeyA)
+	assert.True(t, errors.Is(err, ErrCookieKeyID))
+	_, err = NewCookieStoreWithKeys(testKeyA, noID)
+	assert.True(t, errors.Is(err, ErrCookieKeyID))
+	_, err = NewCookieStoreWithKeys(testKeyA, testKeyB, testKeyA)
+	assert.True(t, errors.Is(err, ErrCookieKeyID))
+
+	_, err = ParseCookieKeys([]byte(`[
+		{"signing": "c2lnbmluZy1i", "auth": "YXV0aC1i"},
+		{"signing": "c2lnbmluZy1h", "auth": "YXV0aC1h"}
+	]`))
+	assert.True(t, errors.Is(err, ErrCookieKeyID))
+}
+
+func TestCookieStoreUnknownKeyID(t *testing.T) {
+	// A token whose kid is not in the key ring is rejected, even if
+	// encrypted with a known key
+	a, _ := NewCookieStoreWithKeys(testKeyA)
+	b, _ := NewCookieStoreWithKeys(CookieKey{
+		ID:            "b",
+		SigningKey:    testKeyA.SigningKey,
+		AuthKey:       testKeyA.AuthKey,
+		EncryptionKey: testKeyA.EncryptionKey,
+	})
+	id, req := storeCookie(t, b, "token", "uid")
+	v, _, err := a.Verify(SetContext(nil, nil, req), "token", "uid", id)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrUnknownCookieKey.Error())
+	assert.False(t, v)
+}
+
+func TestLoadCookieKeys(t *testing.T) {
+	data := `[
+		{"id": "b", "signing": "c2lnbmluZy1i", "auth": "YXV0aC1i", "encryption": "ZW5jcnlwdGlvbmtleS1iIQ=="},
+		{"id": "a", "signing": "c2lnbmluZy1h", "auth": "YXV0aC1h", "encryption": "ZW5jcnlwdGlvbmtleS1hIQ=="}
+	]`
+
+	// From file
+	path := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+	keys, err := LoadCookieKeys(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []CookieKey{testKeyB, testKeyA}, keys)
+
+	_, err = LoadCookieKeys(path + ".missing")
+	assert.True(t, os.IsNotExist(err))
+
+	// From environment
+	os.Setenv("PWL_TEST_COOKIE_KEYS", data)
+	defer os.Unsetenv("PWL_TEST_COOKIE_KEYS")
+	keys, err = CookieKeysFromEnv("PWL_TEST_COOKIE_KEYS")
+	assert.NoError(t, err)
+	assert.Equal(t, []CookieKey{testKeyB, testKeyA}, keys)
+
+	_, err = CookieKeysFromEnv("PWL_TEST_COOKIE_KEYS_MISSING")
+	assert.Equal(t, ErrNoCookieKeys, err)
+
+	// Invalid key rings
+	_, err = ParseCookieKeys([]byte(`[]`))
+	assert.Equal(t, ErrNoCookieKeys, err)
+	_, err = ParseCookieKeys([]byte(`[{"id": "a", "signing": "c2lnbmluZy1h"}]`))
+	assert.True(t, errors.Is(err, ErrInvalidCookieKey))
+	_, err = ParseCookieKeys([]byte(`{`))
+	assert.Error(t, err)
+}
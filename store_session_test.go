@@ -14,33 +14,37 @@ func TestSessionStoreToken(t *testing.T) {
 	now := time.Now()
 	cs := NewCookieStore([]byte{}, []byte{}, []byte{})
 
-	valid, err := cs.verifyToken("", "1337", "userid")
+	valid, _, err := cs.verifyToken("", "1337", "userid", "id")
 	assert.Error(t, err)
 	assert.False(t, valid)
 
-	tok, err := cs.newToken("1337", "userid", now.Add(time.Hour))
+	tok, err := cs.newToken("1337", "userid", "id", Scope{}, now.Add(time.Hour))
 	assert.NoError(t, err)
 
-	valid, err = cs.verifyToken(tok, "1337", "userid")
+	valid, _, err = cs.verifyToken(tok, "1337", "userid", "id")
 	assert.NoError(t, err)
 	assert.True(t, valid)
 
-	valid, err = cs.verifyToken(tok, "1338", "userid")
+	valid, _, err = cs.verifyToken(tok, "1338", "userid", "id")
 	assert.NoError(t, err)
 	assert.False(t, valid)
 
-	valid, err = cs.verifyToken(tok, "1337", "userie")
+	valid, _, err = cs.verifyToken(tok, "1337", "userie", "id")
 	assert.NoError(t, err)
 	assert.False(t, valid)
 
-	valid, err = cs.verifyToken(tok+" ", "1337", "userid")
+	valid, _, err = cs.verifyToken(tok, "1337", "userid", "anotherid")
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, valid)
+
+	valid, _, err = cs.verifyToken(tok+" ", "1337", "userid", "id")
 	assert.Error(t, err)
 	assert.False(t, valid)
 
 	// Check token expiry
-	tok, err = cs.newToken("1337", "userid", now.Add(-time.Hour))
+	tok, err = cs.newToken("1337", "userid", "id", Scope{}, now.Add(-time.Hour))
 	assert.NoError(t, err, "negative TTL should not fail")
-	valid, err = cs.verifyToken(tok, "1337", "userid")
+	valid, _, err = cs.verifyToken(tok, "1337", "userid", "id")
 	assert.Error(t, err, "expired should produce error")
 	assert.False(t, valid, "expired should not validate")
 }
@@ -49,7 +53,7 @@ func TestSessionStoreExists(t *testing.T) {
 	cs := NewCookieStore([]byte(""), []byte(""), []byte("testtesttesttest"))
 
 	// Fail when attempting to Store with bad context
-	err := cs.Store(nil, "", "", time.Hour)
+	_, err := cs.Store(nil, "", "", Scope{}, time.Hour)
 	assert.Equal(t, err, ErrNoResponseWriter)
 
 	// Fail when attempting to Verify without valid cookie
@@ -62,7 +66,7 @@ func TestSessionStoreExists(t *testing.T) {
 	// Write token to cookie
 	rec := NewResponseRecorder()
 	ctx := SetContext(nil, rec, nil)
-	err = cs.Store(ctx, "token", "uid", time.Hour)
+	id, err := cs.Store(ctx, "token", "uid", Scope{}, time.Hour)
 	assert.NoError(t, err)
 	assert.NotNil(t, rec.Header().Get("Set-Cookie"))
 
@@ -80,6 +84,21 @@ func TestSessionStoreExists(t *testing.T) {
 	assert.True(t, v)
 	assert.NotEqual(t, time.Time{}, tm)
 
+	// Check ExistsInScope only considers the token's scope
+	v, tm, err = cs.ExistsInScope(SetContext(nil, nil, req), "uid", Scope{})
+	assert.NoError(t, err)
+	assert.True(t, v)
+	assert.NotEqual(t, time.Time{}, tm)
+	v, tm, err = cs.ExistsInScope(SetContext(nil, nil, req), "uid", Scope{Strategy: "other"})
+	assert.NoError(t, err)
+	assert.False(t, v)
+	assert.Equal(t, time.Time{}, tm)
+
+	// Check List
+	ids, err := cs.List(SetContext(nil, nil, req), "uid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id}, ids)
+
 	// Check Exists fails for wrong uid
 	v, tm, err = cs.Exists(SetContext(nil, nil, req), "anotheruid")
 	assert.Equal(t, err, ErrWrongTokenUID)
@@ -101,7 +120,7 @@ func TestSessionStoreVerify(t *testing.T) {
 	// Write token to cookie
 	rec := NewResponseRecorder()
 	ctx := SetContext(nil, rec, nil)
-	err := cs.Store(ctx, "token", "uid", time.Hour)
+	id, err := cs.Store(ctx, "token", "uid", Scope{}, time.Hour)
 	assert.NoError(t, err)
 	assert.NotNil(t, rec.Header().Get("Set-Cookie"))
 
@@ -114,25 +133,157 @@ func TestSessionStoreVerify(t *testing.T) {
 	}
 
 	// Verify bad token fails
-	v, err := cs.Verify(SetContext(nil, nil, req), "badtoken", "uid")
+	v, _, err := cs.Verify(SetContext(nil, nil, req), "badtoken", "uid", id)
 	assert.NoError(t, err)
 	assert.False(t, v)
 
 	// Verify good token succeeds
-	v, err = cs.Verify(SetContext(nil, nil, req), "token", "uid")
+	v, _, err = cs.Verify(SetContext(nil, nil, req), "token", "uid", id)
+	assert.NoError(t, err)
+	assert.True(t, v)
+
+	// Verify scope is returned
+	rec = NewResponseRecorder()
+	scope := Scope{Strategy: "email", Purpose: "signin"}
+	id, err = cs.Store(SetContext(nil, rec, nil), "token", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	req2, err := http.NewRequest("", "", nil)
+	assert.NoError(t, err)
+	for _, c := range rec.Response().Cookies() {
+		req2.AddCookie(c)
+	}
+	v, sc, err := cs.Verify(SetContext(nil, nil, req2), "token", "uid", id)
+	assert.NoError(t, err)
+	assert.True(t, v)
+	assert.Equal(t, scope, sc)
+
+	// Verify good token fails for a different ID
+	v, _, err = cs.Verify(SetContext(nil, nil, req), "token", "uid", "anotherid")
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, v)
+}
+
+func TestSessionStoreRecordFailure(t *testing.T) {
+	cs := NewCookieStore([]byte(""), []byte(""), []byte("testtesttesttest"))
+
+	// Fail without a ResponseWriter
+	_, err := cs.RecordFailure(nil, "uid", "id")
+	assert.Equal(t, ErrNoResponseWriter, err)
+
+	// Write token to cookie
+	rec := NewResponseRecorder()
+	id, err := cs.Store(SetContext(nil, rec, nil), "token", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+
+	// Each failure re-issues the cookie with an incremented count
+	for i := 1; i <= 3; i++ {
+		req, err := http.NewRequest("", "", nil)
+		assert.NoError(t, err)
+		for _, c := range rec.Response().Cookies() {
+			req.AddCookie(c)
+		}
+		rec = NewResponseRecorder()
+		n, err := cs.RecordFailure(SetContext(nil, rec, req), "uid", id)
+		assert.NoError(t, err)
+		assert.Equal(t, i, n)
+	}
+
+	// Check the re-issued cookie still verifies
+	req, err := http.NewRequest("", "", nil)
+	assert.NoError(t, err)
+	for _, c := range rec.Response().Cookies() {
+		req.AddCookie(c)
+	}
+	v, _, err := cs.Verify(SetContext(nil, nil, req), "token", "uid", id)
 	assert.NoError(t, err)
 	assert.True(t, v)
+
+	// Check failures can't be recorded against another user's token
+	_, err = cs.RecordFailure(SetContext(nil, NewResponseRecorder(), req), "anotheruid", id)
+	assert.Equal(t, ErrWrongTokenUID, err)
+
+	// Check failures can't be recorded against a replaced token
+	_, err = cs.RecordFailure(SetContext(nil, NewResponseRecorder(), req), "uid", "anotherid")
+	assert.Equal(t, ErrTokenNotFound, err)
 }
 
 func TestSessionStoreDelete(t *testing.T) {
 	cs := NewCookieStore([]byte(""), []byte(""), []byte(""))
-	err := cs.Delete(nil, "")
+	err := cs.Delete(nil, "", "")
 	assert.Equal(t, ErrNoResponseWriter, err)
 
 	rec := NewResponseRecorder()
-	err = cs.Delete(SetContext(nil, rec, nil), "")
+	err = cs.Delete(SetContext(nil, rec, nil), "", "")
 	assert.Nil(t, err)
 	assert.NotEmpty(t, rec.Header().Get("Set-Cookie"))
+	cookies := rec.Response().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, -1, cookies[0].MaxAge)
+	}
+}
+
+func TestSessionStoreReplay(t *testing.T) {
+	cs := NewCookieStore([]byte("sign"), []byte("auth"), []byte("testtesttesttest"))
+	cs.Consumed = NewMemConsumedRegistry()
+	p := New(cs)
+	strategy := p.SetTransport("test", &testTransport{}, &testGenerator{token: "1337"}, time.Hour)
+	scope := Scope{}
+
+	id, req := storeCookie(t, cs, "1337", "uid")
+
+	// Token can be used once
+	valid, err := VerifyToken(SetContext(nil, NewResponseRecorder(), req), cs, strategy, scope, "uid", id, "1337")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// Replaying the captured cookie fails
+	ctx := SetContext(nil, NewResponseRecorder(), req)
+	valid, err = VerifyToken(ctx, cs, strategy, scope, "uid", id, "1337")
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, valid)
+	b, _, err := cs.Exists(ctx, "uid")
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, b)
+	_, err = cs.List(ctx, "uid")
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Concurrent verifications are caught when the token is deleted
+	id, req = storeCookie(t, cs, "1337", "uid")
+	ctx = SetContext(nil, NewResponseRecorder(), req)
+	assert.NoError(t, cs.Delete(ctx, "uid", id))
+	assert.Equal(t, ErrTokenNotFound, cs.Delete(ctx, "uid", id))
+
+	// Other tokens are unaffected
+	id, req = storeCookie(t, cs, "1337", "uid")
+	valid, err = VerifyToken(SetContext(nil, NewResponseRecorder(), req), cs, strategy, scope, "uid", id, "1337")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
+
+func TestSessionStoreReplayAttempts(t *testing.T) {
+	cs := NewCookieStore([]byte("sign"), []byte("auth"), []byte("testtesttesttest"))
+	cs.Consumed = NewMemConsumedRegistry()
+	p := New(cs)
+	strategy := LimitedStrategy{
+		Strategy: p.SetTransport("test", &testTransport{}, &testGenerator{token: "1337"}, time.Hour),
+		Attempts: 3,
+	}
+
+	// Replaying the original cookie doesn't reset the count of attempts
+	id, req := storeCookie(t, cs, "1337", "uid")
+	for i := 1; i < 3; i++ {
+		valid, err := VerifyToken(SetContext(nil, NewResponseRecorder(), req), cs, strategy, Scope{}, "uid", id, "0000")
+		assert.NoError(t, err)
+		assert.False(t, valid)
+	}
+	valid, err := VerifyToken(SetContext(nil, NewResponseRecorder(), req), cs, strategy, Scope{}, "uid", id, "0000")
+	assert.Equal(t, ErrAttemptsExhausted, err)
+	assert.False(t, valid)
+
+	// The correct token can no longer be used
+	valid, err = VerifyToken(SetContext(nil, NewResponseRecorder(), req), cs, strategy, Scope{}, "uid", id, "1337")
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, valid)
 }
 
 type ResponseRecorder struct {
@@ -0,0 +1,449 @@
+package passwordless
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"context"
+)
+
+const (
+	// DefaultSQLTable is the default name of the table holding tokens.
+	DefaultSQLTable = "passwordless_tokens"
+)
+
+// Dialect describes the differences between SQL databases that matter to
+// `SQLStore`.
+type Dialect struct {
+	Name string
+	// Placeholder returns the placeholder for the n'th parameter of a
+	// query, counting from 1.
+	Placeholder func(n int) string
+}
+
+var (
+	DialectSQLite   = Dialect{Name: "sqlite", Placeholder: questionPlaceholder}
+	DialectMySQL    = Dialect{Name: "mysql", Placeholder: questionPlaceholder}
+	DialectPostgres = Dialect{Name: "postgres", Placeholder: dollarPlaceholder}
+)
+
+func questionPlaceholder(n int) string { return "?" }
+func dollarPlaceholder(n int) string   { return fmt.Sprintf("$%d", n) }
+
+// sqlMigration is a statement creating or updating the schema. `{table}` is
+// replaced by the table name.
+type sqlMigration struct {
+	Statement string
+	// Dialects holds statements to use in place of Statement, keyed by
+	// dialect name. An empty statement is recorded as applied without
+	// being run.
+	Dialects map[string]string
+}
+
+// sqlMigrations are the migrations creating and updating the schema, in
+// order. Migrations must not be modified once released; add new ones
+// instead. Each must succeed if it has already been applied, as MySQL
+// commits schema changes before the migration is recorded.
+var sqlMigrations = []sqlMigration{{
+	Statement: `CREATE TABLE IF NOT EXISTS {table} (
+		uid VARCHAR(255) NOT NULL,
+		id VARCHAR(64) NOT NULL,
+		hash VARCHAR(255) NOT NULL,
+		strategy VARCHAR(255) NOT NULL,
+		purpose VARCHAR(255) NOT NULL,
+		expires BIGINT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (uid, id)
+	)`,
+	Dialects: map[string]string{
+		// MySQL doesn't support CREATE INDEX IF NOT EXISTS, so the index
+		// is created with the table
+		"mysql": `CREATE TABLE IF NOT EXISTS {table} (
+		uid VARCHAR(255) NOT NULL,
+		id VARCHAR(64) NOT NULL,
+		hash VARCHAR(255) NOT NULL,
+		strategy VARCHAR(255) NOT NULL,
+		purpose VARCHAR(255) NOT NULL,
+		expires BIGINT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (uid, id),
+		INDEX {table}_expires (expires)
+	)`,
+	},
+}, {
+	Statement: `CREATE INDEX IF NOT EXISTS {table}_expires ON {table} (expires)`,
+	Dialects:  map[string]string{"mysql": ""},
+}}
+
+// statement returns the migration's statement for the dialect.
+func (m sqlMigration) statement(d Dialect) string {
+	if q, ok := m.Dialects[d.Name]; ok {
+		return q
+	}
+	return m.Statement
+}
+
+// SQLStore is a Store that keeps tokens in a SQL database using
+// `database/sql`. The schema is created and updated by `Migrate`, which
+// should be called before the store is used. Expired tokens are ignored,
+// but should be removed periodically with `Clean` or `CleanEvery`.
+type SQLStore struct {
+	// MaxTokens is the number of outstanding tokens held for each user.
+	MaxTokens int
+	// Hasher hashes tokens before they are stored. If nil, `DefaultHasher`
+	// is used.
+	Hasher TokenHasher
+
+	db      *sql.DB
+	dialect Dialect
+	table   string
+}
+
+// NewSQLStore creates and returns a new `SQLStore` holding tokens in the
+// `DefaultSQLTable` table of the database.
+func NewSQLStore(db *sql.DB, dialect Dialect) *SQLStore {
+	return NewSQLStoreWithTable(db, dialect, DefaultSQLTable)
+}
+
+// NewSQLStoreWithTable creates and returns a new `SQLStore` holding tokens
+// in the named table. A table named `<table>_migrations` records the
+// migrations applied.
+func NewSQLStoreWithTable(db *sql.DB, dialect Dialect, table string) *SQLStore {
+	return &SQLStore{
+		MaxTokens: DefaultMaxTokens,
+		db:        db,
+		dialect:   dialect,
+		table:     table,
+	}
+}
+
+// query rewrites a query for the dialect, replacing `{table}` with the
+// table name and each `?` with the dialect's placeholder.
+func (s *SQLStore) query(q string) string {
+	q = strings.Replace(q, "{table}", s.table, -1)
+	b := strings.Builder{}
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString(s.dialect.Placeholder(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Migrate creates or updates the schema, applying any migrations that have
+// not yet been applied.
+//
+// Each migration is applied in a transaction along with the record of its
+// version. MySQL commits schema changes implicitly, so if Migrate is
+// interrupted there, a change may be kept without being recorded; every
+// migration can be applied again, so Migrate can simply be called again.
+func (s *SQLStore) Migrate(ctx context.Context) error {
+	ctx = orBackground(ctx)
+	if _, err := s.db.ExecContext(ctx, s.query(
+		`CREATE TABLE IF NOT EXISTS {table}_migrations (version INTEGER NOT NULL PRIMARY KEY)`)); err != nil {
+		return err
+	}
+	var version sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, s.query(
+		`SELECT MAX(version) FROM {table}_migrations`)).Scan(&version); err != nil {
+		return err
+	}
+	for v := int(version.Int64); v < len(sqlMigrations); v++ {
+		if err := s.migrate(ctx, v+1); err != nil {
+			return fmt.Errorf("migration %d: %w", v+1, err)
+		}
+	}
+	return nil
+}
+
+// migrate applies the given migration, recording it as applied.
+func (s *SQLStore) migrate(ctx context.Context, version int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if q := sqlMigrations[version-1].statement(s.dialect); q != "" {
+		if _, err := tx.ExecContext(ctx, s.query(q)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, s.query(
+		`INSERT INTO {table}_migrations (version) VALUES (?)`), version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) Store(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (id string, err error) {
+	ctx, span := StartSpan(orBackground(ctx), "SQLStore.Store")
+	defer func() { endSpan(span, err) }()
+
+	hashToken, err := hasherOrDefault(s.Hasher).Hash(token)
+	if err != nil {
+		return "", err
+	}
+	id, err = NewTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err := tx.ExecContext(ctx, s.query(
+		`INSERT INTO {table} (uid, id, hash, strategy, purpose, expires, attempts) VALUES (?, ?, ?, ?, ?, ?, 0)`),
+		uid, id, string(hashToken), scope.Strategy, scope.Purpose, millis(now.Add(ttl))); err != nil {
+		return "", err
+	}
+
+	// Discard expired tokens, and those closest to expiry if the user has
+	// too many
+	if _, err := tx.ExecContext(ctx, s.query(
+		`DELETE FROM {table} WHERE uid = ? AND expires <= ?`), uid, millis(now)); err != nil {
+		return "", err
+	}
+	if s.MaxTokens > 0 {
+		ids, err := s.list(ctx, tx, uid)
+		if err != nil {
+			return "", err
+		}
+		for i := s.MaxTokens; i < len(ids); i++ {
+			if _, err := tx.ExecContext(ctx, s.query(
+				`DELETE FROM {table} WHERE uid = ? AND id = ?`), uid, ids[i]); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+func (s *SQLStore) Exists(ctx context.Context, uid string) (bool, time.Time, error) {
+	var exp sql.NullInt64
+	err := s.db.QueryRowContext(orBackground(ctx), s.query(
+		`SELECT MAX(expires) FROM {table} WHERE uid = ? AND expires > ?`),
+		uid, millis(time.Now())).Scan(&exp)
+	if err != nil || !exp.Valid {
+		return false, time.Time{}, err
+	}
+	return true, fromMillis(exp.Int64), nil
+}
+
+// ExistsInScope returns true if a token is stored for the user within the
+// scope, along with the latest expiry time of such tokens.
+func (s *SQLStore) ExistsInScope(ctx context.Context, uid string, scope Scope) (bool, time.Time, error) {
+	var exp sql.NullInt64
+	err := s.db.QueryRowContext(orBackground(ctx), s.query(
+		`SELECT MAX(expires) FROM {table} WHERE uid = ? AND strategy = ? AND purpose = ? AND expires > ?`),
+		uid, scope.Strategy, scope.Purpose, millis(time.Now())).Scan(&exp)
+	if err != nil || !exp.Valid {
+		return false, time.Time{}, err
+	}
+	return true, fromMillis(exp.Int64), nil
+}
+
+func (s *SQLStore) List(ctx context.Context, uid string) ([]string, error) {
+	return s.list(orBackground(ctx), s.db, uid)
+}
+
+// sqlQueryer is implemented by both *sql.DB and *sql.Tx.
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// list returns the IDs of the user's unexpired tokens, latest expiry first.
+func (s *SQLStore) list(ctx context.Context, q sqlQueryer, uid string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, s.query(
+		`SELECT id FROM {table} WHERE uid = ? AND expires > ? ORDER BY expires DESC`),
+		uid, millis(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLStore) Verify(ctx context.Context, token, uid, id string) (_ bool, _ Scope, err error) {
+	ctx, span := StartSpan(orBackground(ctx), "SQLStore.Verify")
+	defer func() { endSpan(span, err) }()
+
+	return s.verify(ctx, token, uid, id)
+}
+
+// verify verifies the token against the user's stored token.
+func (s *SQLStore) verify(ctx context.Context, token, uid, id string) (bool, Scope, error) {
+	var hash string
+	scope := Scope{}
+	err := s.db.QueryRowContext(ctx, s.query(
+		`SELECT hash, strategy, purpose FROM {table} WHERE uid = ? AND id = ? AND expires > ?`),
+		uid, id, millis(time.Now())).Scan(&hash, &scope.Strategy, &scope.Purpose)
+	if err == sql.ErrNoRows {
+		return false, Scope{}, ErrTokenNotFound
+	} else if err != nil {
+		return false, Scope{}, err
+	}
+	valid, err := VerifyHash(s.Hasher, token, []byte(hash))
+	if err != nil {
+		return false, Scope{}, err
+	}
+	return valid, scope, nil
+}
+
+// Consume verifies the token, deleting it if valid and within the scope. If
+// maxAttempts is above zero, the attempt is counted before the token is
+// verified, and `ErrAttemptsExhausted` is returned if maxAttempts attempts
+// have already been made. If a concurrent request deletes the token first,
+// `ErrTokenNotFound` is returned.
+func (s *SQLStore) Consume(ctx context.Context, token, uid, id string, scope Scope, maxAttempts int) (_ bool, _ Scope, _ int, err error) {
+	ctx, span := StartSpan(orBackground(ctx), "SQLStore.Consume")
+	defer func() { endSpan(span, err) }()
+
+	now := millis(time.Now())
+	var reserved int64
+	if maxAttempts > 0 {
+		// Reserve the attempt in the same statement that checks the limit,
+		// so concurrent requests can't exceed it
+		r, err := s.db.ExecContext(ctx, s.query(
+			`UPDATE {table} SET attempts = attempts + 1
+			WHERE uid = ? AND id = ? AND expires > ? AND strategy = ? AND purpose = ? AND attempts < ?`),
+			uid, id, now, scope.Strategy, scope.Purpose, maxAttempts)
+		if err != nil {
+			return false, Scope{}, 0, err
+		}
+		if reserved, err = r.RowsAffected(); err != nil {
+			return false, Scope{}, 0, err
+		}
+	}
+
+	var hash string
+	var attempts int
+	ts := Scope{}
+	err = s.db.QueryRowContext(ctx, s.query(
+		`SELECT hash, strategy, purpose, attempts FROM {table} WHERE uid = ? AND id = ? AND expires > ?`),
+		uid, id, now).Scan(&hash, &ts.Strategy, &ts.Purpose, &attempts)
+	if err == sql.ErrNoRows {
+		return false, Scope{}, 0, ErrTokenNotFound
+	} else if err != nil {
+		return false, Scope{}, 0, err
+	}
+	if ts != scope {
+		return false, ts, 0, nil
+	}
+	if maxAttempts > 0 && reserved == 0 {
+		return false, Scope{}, attempts, ErrAttemptsExhausted
+	}
+	valid, err := VerifyHash(s.Hasher, token, []byte(hash))
+	if err != nil || !valid {
+		return false, ts, attempts, err
+	}
+
+	r, err := s.db.ExecContext(ctx, s.query(
+		`DELETE FROM {table} WHERE uid = ? AND id = ? AND hash = ? AND expires > ?`),
+		uid, id, hash, now)
+	if err != nil {
+		return false, Scope{}, attempts, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return false, Scope{}, attempts, err
+	} else if n == 0 {
+		// Token was consumed by another request
+		return false, Scope{}, attempts, ErrTokenNotFound
+	}
+	return true, ts, attempts, nil
+}
+
+func (s *SQLStore) RecordFailure(ctx context.Context, uid, id string) (int, error) {
+	ctx = orBackground(ctx)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := millis(time.Now())
+	r, err := tx.ExecContext(ctx, s.query(
+		`UPDATE {table} SET attempts = attempts + 1 WHERE uid = ? AND id = ? AND expires > ?`),
+		uid, id, now)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, ErrTokenNotFound
+	}
+	var attempts int
+	if err := tx.QueryRowContext(ctx, s.query(
+		`SELECT attempts FROM {table} WHERE uid = ? AND id = ?`),
+		uid, id).Scan(&attempts); err != nil {
+		return 0, err
+	}
+	return attempts, tx.Commit()
+}
+
+func (s *SQLStore) Delete(ctx context.Context, uid, id string) error {
+	ctx = orBackground(ctx)
+	if id == "" {
+		_, err := s.db.ExecContext(ctx, s.query(
+			`DELETE FROM {table} WHERE uid = ?`), uid)
+		return err
+	}
+	r, err := s.db.ExecContext(ctx, s.query(
+		`DELETE FROM {table} WHERE uid = ? AND id = ?`), uid, id)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// Clean removes expired tokens from the store, returning the number
+// removed.
+func (s *SQLStore) Clean(ctx context.Context) (int64, error) {
+	r, err := s.db.ExecContext(orBackground(ctx), s.query(
+		`DELETE FROM {table} WHERE expires <= ?`), millis(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+// CleanEvery removes expired tokens from the store at the given interval,
+// until the context is done. Errors are passed to onError, if not nil.
+func (s *SQLStore) CleanEvery(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Clean(ctx); err != nil && onError != nil {
+				onError(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
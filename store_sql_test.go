@@ -0,0 +1,246 @@
+package passwordless
+
+import (
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"context"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSQLStore(t *testing.T) *SQLStore {
+	db, err := sql.Open("sqlite3", "file::memory:?cache=shared&_busy_timeout=5000")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Keep the in-memory database alive for the duration of the test
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	suffix, _ := NewTokenID()
+	s := NewSQLStoreWithTable(db, DialectSQLite, "tokens_"+suffix)
+	s.Hasher = testHashers["hmac"]
+	assert.NoError(t, s.Migrate(nil))
+	return s
+}
+
+func TestSQLStoreMigrate(t *testing.T) {
+	s := newTestSQLStore(t)
+
+	// Migrating again is a no-op
+	assert.NoError(t, s.Migrate(nil))
+	var version int
+	assert.NoError(t, s.db.QueryRow(s.query(`SELECT MAX(version) FROM {table}_migrations`)).Scan(&version))
+	assert.Equal(t, len(sqlMigrations), version)
+
+	// Migrations are repeated safely if they weren't recorded
+	_, err := s.db.Exec(s.query(`DELETE FROM {table}_migrations`))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Migrate(nil))
+	assert.NoError(t, s.db.QueryRow(s.query(`SELECT MAX(version) FROM {table}_migrations`)).Scan(&version))
+	assert.Equal(t, len(sqlMigrations), version)
+}
+
+func TestSQLMigrationStatement(t *testing.T) {
+	m := sqlMigrations[1]
+	assert.Contains(t, m.statement(DialectSQLite), "IF NOT EXISTS")
+	assert.Contains(t, m.statement(DialectPostgres), "IF NOT EXISTS")
+	assert.Equal(t, "", m.statement(DialectMySQL))
+	assert.Contains(t, sqlMigrations[0].statement(DialectMySQL), "INDEX {table}_expires")
+}
+
+func TestSQLStoreQuery(t *testing.T) {
+	s := &SQLStore{dialect: DialectPostgres, table: "tokens"}
+	assert.Equal(t, "SELECT id FROM tokens WHERE uid = $1 AND id = $2",
+		s.query("SELECT id FROM {table} WHERE uid = ? AND id = ?"))
+	s.dialect = DialectMySQL
+	assert.Equal(t, "SELECT id FROM tokens WHERE uid = ? AND id = ?",
+		s.query("SELECT id FROM {table} WHERE uid = ? AND id = ?"))
+}
+
+func TestSQLStore(t *testing.T) {
+	s := newTestSQLStore(t)
+
+	b, exp, err := s.Exists(nil, "uid")
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.True(t, exp.IsZero())
+
+	// Expired tokens don't exist
+	id, err := s.Store(nil, "1337", "uid", Scope{}, -time.Hour)
+	assert.NoError(t, err)
+	b, _, err = s.Exists(nil, "uid")
+	assert.NoError(t, err)
+	assert.False(t, b)
+	_, _, err = s.Verify(nil, "1337", "uid", id)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	scope := Scope{Strategy: "test", Purpose: "signin"}
+	id, err = s.Store(nil, "1337", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	b, exp, err = s.Exists(nil, "uid")
+	assert.NoError(t, err)
+	assert.True(t, b)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), exp, time.Second)
+
+	valid, sc, err := s.Verify(nil, "1338", "uid", id)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, scope, sc)
+	valid, sc, err = s.Verify(nil, "1337", "uid", id)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, scope, sc)
+
+	// Failures are counted
+	for i := 1; i <= 3; i++ {
+		n, err := s.RecordFailure(nil, "uid", id)
+		assert.NoError(t, err)
+		assert.Equal(t, i, n)
+	}
+	_, err = s.RecordFailure(nil, "uid", "unknown")
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Delete
+	assert.NoError(t, s.Delete(nil, "uid", id))
+	_, _, err = s.Verify(nil, "1337", "uid", id)
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestSQLStoreList(t *testing.T) {
+	s := newTestSQLStore(t)
+	s.MaxTokens = 2
+
+	id1, err := s.Store(nil, "1", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	id2, err := s.Store(nil, "2", "uid", Scope{}, 2*time.Hour)
+	assert.NoError(t, err)
+	ids, err := s.List(nil, "uid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id2, id1}, ids)
+
+	// The token closest to expiry is discarded
+	id3, err := s.Store(nil, "3", "uid", Scope{}, 3*time.Hour)
+	assert.NoError(t, err)
+	ids, err = s.List(nil, "uid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{id3, id2}, ids)
+
+	// Other users are unaffected by deleting all of a user's tokens
+	_, err = s.Store(nil, "4", "other", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Delete(nil, "uid", ""))
+	ids, err = s.List(nil, "uid")
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	ids, err = s.List(nil, "other")
+	assert.NoError(t, err)
+	assert.Len(t, ids, 1)
+}
+
+func TestSQLStoreClean(t *testing.T) {
+	s := newTestSQLStore(t)
+	_, err := s.Store(nil, "1", "uid", Scope{}, time.Hour)
+	assert.NoError(t, err)
+	_, err = s.Store(nil, "2", "other", Scope{}, 10*time.Millisecond)
+	assert.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	n, err := s.Clean(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	_, err = s.Store(nil, "2", "other", Scope{}, 10*time.Millisecond)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.CleanEvery(ctx, 5*time.Millisecond, nil)
+	assert.Eventually(t, func() bool {
+		var count int
+		s.db.QueryRow(s.query(`SELECT COUNT(*) FROM {table}`)).Scan(&count)
+		return count == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestSQLStoreConsume(t *testing.T) {
+	s := newTestSQLStore(t)
+	scope := Scope{Strategy: "test"}
+	id, err := s.Store(nil, "1337", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+
+	// Invalid tokens and scopes are not consumed
+	valid, _, _, err := s.Consume(nil, "1338", "uid", id, scope, 0)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	valid, sc, _, err := s.Consume(nil, "1337", "uid", id, Scope{Strategy: "other"}, 0)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, scope, sc)
+
+	// Attempts are counted before verifying, and limited
+	valid, _, n, err := s.Consume(nil, "1338", "uid", id, scope, 2)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, 1, n)
+	valid, _, n, err = s.Consume(nil, "1338", "uid", id, Scope{Strategy: "other"}, 2)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, 0, n)
+	valid, _, n, err = s.Consume(nil, "1338", "uid", id, scope, 2)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	assert.Equal(t, 2, n)
+	_, _, n, err = s.Consume(nil, "1337", "uid", id, scope, 2)
+	assert.Equal(t, ErrAttemptsExhausted, err)
+	assert.Equal(t, 2, n)
+	_, _, _, err = s.Consume(nil, "1337", "uid", id, scope, 3)
+	assert.NoError(t, err)
+	id, err = s.Store(nil, "1337", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrTokenNotFound, s.Delete(nil, "uid", "missing"))
+
+	// Token can only be consumed once, even concurrently
+	consumed := make(chan bool, 10)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(consumed); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			valid, _, _, err := s.Consume(nil, "1337", "uid", id, scope, 0)
+			assert.True(t, err == nil || err == ErrTokenNotFound, "%v", err)
+			consumed <- valid
+		}()
+	}
+	wg.Wait()
+	close(consumed)
+	n = 0
+	for valid := range consumed {
+		if valid {
+			n++
+		}
+	}
+	assert.Equal(t, 1, n)
+}
+
+func TestSQLStoreVerifyToken(t *testing.T) {
+	s := newTestSQLStore(t)
+	p := New(s)
+	rec := &eventRecorder{}
+	p.AddObserver(rec)
+	p.SetTransport("test", &testTransport{}, &testGenerator{token: "1337"}, time.Hour)
+
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	valid, err := p.VerifyToken(nil, "test", "uid", id, "1337")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, EventTokenDeleted, rec.events[len(rec.events)-2].Type)
+	assert.Equal(t, ReasonConsumed, rec.events[len(rec.events)-2].Reason)
+
+	valid, err = p.VerifyToken(nil, "test", "uid", id, "1337")
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, valid)
+}
@@ -0,0 +1,171 @@
+package passwordless
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"context"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	statelessName = "passwordless-challenge"
+)
+
+var (
+	ErrNoEncryptionKey = errors.New("stateless challenges require an encryption key")
+)
+
+// AttemptRegistry is implemented by ConsumedRegistries that can also count
+// failed attempts made against a token.
+type AttemptRegistry interface {
+	// RecordAttempt records a failed attempt against the token of the given
+	// ID, returning the number of failed attempts made. The count need only
+	// be remembered until the token expires.
+	RecordAttempt(ctx context.Context, id string, exp time.Time) (int, error)
+}
+
+// StatelessStore holds no tokens itself. Instead, the token is signed and
+// encrypted into a challenge which is returned as the token's ID, to be held
+// by the client and provided again when the token is verified. Unlike
+// `CookieStore`, it does not need a ResponseWriter or cookies, so suits
+// mobile apps and single-page applications that can carry the challenge in a
+// request body or header.
+//
+// As the store holds no state, `Exists` and `List` report no tokens, so
+// resend cooldowns are not applied and tokens can only be verified with
+// their ID. Used challenges are rejected, and failed attempts counted, by
+// the `Consumed` registry. The default registry is held in memory, so it
+// only suits a single instance; where several servers verify tokens, set
+// `Consumed` to a registry they share, such as `RedisConsumedRegistry`.
+type StatelessStore struct {
+	// Consumed records the IDs of deleted tokens, which are then rejected
+	// until they expire. If it implements `AttemptRegistry`, failed attempts
+	// are also counted. It defaults to a `MemConsumedRegistry`. If nil,
+	// replays are not detected, and attempts are not limited.
+	Consumed ConsumedRegistry
+
+	cs *CookieStore
+}
+
+// NewStatelessStore creates a new StatelessStore using the given key ring.
+// New challenges are signed and encrypted with the first key, and challenges
+// created with any of the keys are accepted. Used challenges are recorded in
+// a `MemConsumedRegistry`, which should be replaced by a shared registry if
+// more than one instance verifies tokens.
+//
+// As the challenge is returned to whoever requested the token, and holds
+// the token itself, every key must have an encryption key. Otherwise the
+// token could be read from the challenge, so `ErrNoEncryptionKey` is
+// returned.
+func NewStatelessStore(keys ...CookieKey) (*StatelessStore, error) {
+	for _, k := range keys {
+		if len(k.EncryptionKey) == 0 {
+			return nil, fmt.Errorf("%w: %q", ErrNoEncryptionKey, k.ID)
+		}
+	}
+	cs, err := NewCookieStoreWithKeys(keys...)
+	if err != nil {
+		return nil, err
+	}
+	return &StatelessStore{Consumed: NewMemConsumedRegistry(), cs: cs}, nil
+}
+
+// Store seals the token, user ID and scope into a challenge, which is
+// returned as the token's ID.
+func (s *StatelessStore) Store(ctx context.Context, token, uid string, scope Scope, ttl time.Duration) (id string, err error) {
+	_, span := StartSpan(ctx, "StatelessStore.Store")
+	defer func() { endSpan(span, err) }()
+
+	jti, err := NewTokenID()
+	if err != nil {
+		return "", err
+	}
+	tokString, err := s.cs.newToken(token, uid, jti, scope, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return securecookie.EncodeMulti(statelessName, tokString, s.cs.codecs...)
+}
+
+// Exists always returns false, as the store holds no tokens.
+func (s *StatelessStore) Exists(ctx context.Context, uid string) (bool, time.Time, error) {
+	return false, time.Time{}, nil
+}
+
+// List always returns no IDs, as the store holds no tokens.
+func (s *StatelessStore) List(ctx context.Context, uid string) ([]string, error) {
+	return []string{}, nil
+}
+
+// Verify unseals the challenge given as the ID and verifies the token
+// against it. `ErrTokenNotFound` is returned if the challenge is invalid,
+// has expired or has been consumed.
+func (s *StatelessStore) Verify(ctx context.Context, token, uid, id string) (_ bool, _ Scope, err error) {
+	_, span := StartSpan(ctx, "StatelessStore.Verify")
+	defer func() { endSpan(span, err) }()
+
+	tokString, jti, _, err := s.open(ctx, id)
+	if err != nil {
+		return false, Scope{}, err
+	}
+	return s.cs.verifyToken(tokString, token, uid, jti)
+}
+
+// RecordFailure records a failed attempt against the challenge, if the
+// `Consumed` registry implements `AttemptRegistry`. Otherwise, attempts are
+// not counted and zero is returned.
+func (s *StatelessStore) RecordFailure(ctx context.Context, uid, id string) (int, error) {
+	_, jti, exp, err := s.open(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if r, ok := s.Consumed.(AttemptRegistry); ok {
+		return r.RecordAttempt(ctx, jti, exp)
+	}
+	return 0, nil
+}
+
+// Delete marks the challenge as consumed, if a registry is configured.
+// `ErrTokenNotFound` is returned if it had already been consumed.
+func (s *StatelessStore) Delete(ctx context.Context, uid, id string) error {
+	if s.Consumed == nil || id == "" {
+		return nil
+	}
+	_, jti, exp, err := s.open(ctx, id)
+	if err != nil {
+		return err
+	}
+	if ok, err := s.Consumed.MarkConsumed(ctx, jti, exp); err != nil {
+		return err
+	} else if !ok {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// open unseals the challenge, returning the signed token, its ID and its
+// expiry. `ErrTokenNotFound` is returned if the challenge is invalid, has
+// expired or has been consumed.
+func (s *StatelessStore) open(ctx context.Context, id string) (string, string, time.Time, error) {
+	var tokString string
+	if err := securecookie.DecodeMulti(statelessName, id, &tokString, s.cs.codecs...); err != nil {
+		return "", "", time.Time{}, ErrTokenNotFound
+	}
+	tok, claims, err := s.cs.parseToken(tokString)
+	if err != nil || !tok.Valid {
+		return "", "", time.Time{}, ErrTokenNotFound
+	}
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	if s.Consumed != nil {
+		if consumed, err := s.Consumed.IsConsumed(ctx, jti); err != nil {
+			return "", "", time.Time{}, err
+		} else if consumed {
+			return "", "", time.Time{}, ErrTokenNotFound
+		}
+	}
+	return tokString, jti, time.Unix(int64(exp), 0), nil
+}
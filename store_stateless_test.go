@@ -0,0 +1,120 @@
+package passwordless
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStatelessStore(t *testing.T) *StatelessStore {
+	s, err := NewStatelessStore(testKeyA)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestStatelessStore(t *testing.T) {
+	s := newTestStatelessStore(t)
+	_, err := NewStatelessStore()
+	assert.Equal(t, ErrNoCookieKeys, err)
+
+	// Challenges must be encrypted, as they are returned to the requester
+	unencrypted := testKeyB
+	unencrypted.EncryptionKey = nil
+	_, err = NewStatelessStore(testKeyA, unencrypted)
+	assert.True(t, errors.Is(err, ErrNoEncryptionKey))
+
+	// No context is required
+	scope := Scope{Strategy: "test", Purpose: "signin"}
+	id, err := s.Store(nil, "1337", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	valid, sc, err := s.Verify(nil, "1337", "uid", id)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, scope, sc)
+
+	// Wrong token or user
+	valid, _, err = s.Verify(nil, "1338", "uid", id)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	valid, _, err = s.Verify(nil, "1337", "other", id)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	// Tampered, foreign and expired challenges are not found
+	valid, _, err = s.Verify(nil, "1337", "uid", id[:len(id)-2])
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, valid)
+	other, err := NewStatelessStore(testKeyB)
+	assert.NoError(t, err)
+	_, _, err = other.Verify(nil, "1337", "uid", id)
+	assert.Equal(t, ErrTokenNotFound, err)
+	expired, err := s.Store(nil, "1337", "uid", scope, -time.Hour)
+	assert.NoError(t, err)
+	_, _, err = s.Verify(nil, "1337", "uid", expired)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Nothing is held by the store
+	b, exp, err := s.Exists(nil, "uid")
+	assert.NoError(t, err)
+	assert.False(t, b)
+	assert.True(t, exp.IsZero())
+	ids, err := s.List(nil, "uid")
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	// Challenges can't be replayed by default
+	assert.NoError(t, s.Delete(nil, "uid", id))
+	_, _, err = s.Verify(nil, "1337", "uid", id)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	// Without a registry, challenges can be replayed and attempts aren't
+	// counted
+	s.Consumed = nil
+	id, err = s.Store(nil, "1337", "uid", scope, time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Delete(nil, "uid", id))
+	valid, _, err = s.Verify(nil, "1337", "uid", id)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	n, err := s.RecordFailure(nil, "uid", id)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestStatelessStoreConsumed(t *testing.T) {
+	s := newTestStatelessStore(t)
+	p := New(s)
+	strategy := p.SetTransport("test", &testTransport{}, &testGenerator{token: "1337"}, time.Hour)
+	p.SetStrategy("test", LimitedStrategy{Strategy: strategy, Attempts: 2})
+
+	// Challenge is returned as the token ID, and can only be used once
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	valid, err := p.VerifyToken(nil, "test", "uid", id, "1337")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	valid, err = p.VerifyToken(nil, "test", "uid", id, "1337")
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, valid)
+
+	// Failed attempts are limited
+	id, err = p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	valid, err = p.VerifyToken(nil, "test", "uid", id, "1338")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	valid, err = p.VerifyToken(nil, "test", "uid", id, "1338")
+	assert.Equal(t, ErrAttemptsExhausted, err)
+	assert.False(t, valid)
+	valid, err = p.VerifyToken(nil, "test", "uid", id, "1337")
+	assert.Equal(t, ErrTokenNotFound, err)
+	assert.False(t, valid)
+
+	// Tokens can only be verified by ID
+	_, err = p.VerifyToken(nil, "test", "uid", "", "1337")
+	assert.Equal(t, ErrTokenNotFound, err)
+}
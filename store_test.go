@@ -0,0 +1,143 @@
+package passwordless
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExistsInScope(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestRedis(t)
+	ms := NewMemStore()
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+	rs := NewRedisStore(client)
+	rs.Hasher = testHashers["hmac"]
+	kv := NewKVStore(NewMemKV())
+	kv.Hasher = testHashers["hmac"]
+	for name, s := range map[string]interface {
+		TokenStore
+		ScopedExister
+	}{
+		"mem":   ms,
+		"redis": rs,
+		"sql":   newTestSQLStore(t),
+		"kv":    kv,
+	} {
+		email := Scope{Strategy: "email"}
+		sms := Scope{Strategy: "sms"}
+		_, err := s.Store(ctx, "token", "uid", email, 30*time.Minute)
+		assert.NoError(t, err, name)
+		_, err = s.Store(ctx, "token", "uid", sms, 5*time.Minute)
+		assert.NoError(t, err, name)
+
+		// Only tokens within the scope are considered
+		b, exp, err := s.ExistsInScope(ctx, "uid", sms)
+		assert.NoError(t, err, name)
+		assert.True(t, b, name)
+		assert.WithinDuration(t, time.Now().Add(5*time.Minute), exp, time.Second, name)
+		b, exp, err = s.ExistsInScope(ctx, "uid", email)
+		assert.NoError(t, err, name)
+		assert.True(t, b, name)
+		assert.WithinDuration(t, time.Now().Add(30*time.Minute), exp, time.Second, name)
+		b, exp, err = s.ExistsInScope(ctx, "uid", Scope{Strategy: "email", Purpose: "other"})
+		assert.NoError(t, err, name)
+		assert.False(t, b, name)
+		assert.True(t, exp.IsZero(), name)
+	}
+}
+
+// plainStore hides any optional methods of the wrapped store.
+type plainStore struct {
+	TokenStore
+}
+
+func TestConsumeToken(t *testing.T) {
+	ms := NewMemStore()
+	defer ms.Release()
+	ms.Hasher = testHashers["hmac"]
+	scope := Scope{Strategy: "test"}
+
+	// Stores that don't implement TokenConsumer count every attempt
+	for name, s := range map[string]TokenStore{"consumer": ms, "plain": plainStore{ms}} {
+		id, err := s.Store(nil, "1337", "uid", scope, time.Hour)
+		assert.NoError(t, err, name)
+
+		// Tokens are only deleted if valid and within scope
+		valid, _, n, err := ConsumeToken(nil, s, "1338", "uid", id, scope, 5)
+		assert.NoError(t, err, name)
+		assert.False(t, valid, name)
+		assert.Equal(t, 1, n, name)
+		_, sc, _, err := ConsumeToken(nil, s, "1337", "uid", id, Scope{}, 5)
+		assert.NoError(t, err, name)
+		assert.Equal(t, scope, sc, name)
+		valid, sc, n, err = ConsumeToken(nil, s, "1337", "uid", id, scope, 5)
+		assert.NoError(t, err, name)
+		assert.True(t, valid, name)
+		assert.Equal(t, scope, sc, name)
+		if name == "plain" {
+			assert.Equal(t, 3, n, name)
+		} else {
+			// Attempts in another scope aren't counted
+			assert.Equal(t, 2, n, name)
+		}
+		_, _, _, err = ConsumeToken(nil, s, "1337", "uid", id, scope, 5)
+		assert.Equal(t, ErrTokenNotFound, err, name)
+
+		// Tokens aren't verified once the limit is reached
+		id, err = s.Store(nil, "1337", "uid", scope, time.Hour)
+		assert.NoError(t, err, name)
+		for i := 1; i <= 2; i++ {
+			valid, _, n, err = ConsumeToken(nil, s, "1338", "uid", id, scope, 2)
+			assert.NoError(t, err, name)
+			assert.False(t, valid, name)
+			assert.Equal(t, i, n, name)
+		}
+		valid, _, _, err = ConsumeToken(nil, s, "1337", "uid", id, scope, 2)
+		assert.Equal(t, ErrAttemptsExhausted, err, name)
+		assert.False(t, valid, name)
+	}
+}
+
+func TestConsumeTokenConcurrent(t *testing.T) {
+	ms := NewMemStore()
+	defer ms.Release()
+	ms.Hasher = slowHasher{testHashers["hmac"]}
+
+	// Run under the race detector; each token may only be consumed once,
+	// and only guessed as often as permitted
+	for name, s := range map[string]TokenStore{"consumer": ms, "plain": plainStore{ms}} {
+		id, err := s.Store(nil, "1337", "uid", Scope{}, time.Hour)
+		assert.NoError(t, err, name)
+		var wg sync.WaitGroup
+		var mut sync.Mutex
+		consumed, guessed := 0, 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				token := "1337"
+				if i%2 == 1 {
+					token = "1338"
+				}
+				valid, _, _, err := ConsumeToken(nil, s, token, "uid", id, Scope{}, 3)
+				mut.Lock()
+				defer mut.Unlock()
+				if valid {
+					consumed++
+				} else if err == nil {
+					guessed++
+				} else {
+					assert.True(t, err == ErrTokenNotFound || err == ErrAttemptsExhausted, name)
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.True(t, consumed <= 1, name)
+		assert.True(t, consumed+guessed <= 3, name)
+	}
+}
@@ -0,0 +1,150 @@
+package passwordless
+
+import (
+	"sync"
+	"time"
+
+	"context"
+)
+
+// Tracer starts spans, allowing Passwordless, token stores and transports
+// to be traced. Implement this interface to integrate with a tracing
+// backend.
+type Tracer interface {
+	// Start starts a span with the given name, returning a context
+	// containing the span, so that spans started with it are its children.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a timed operation within a trace.
+type Span interface {
+	// SetAttribute annotates the span with a key and value.
+	SetAttribute(key string, value interface{})
+	// SetError marks the span as having failed with the given error.
+	SetError(err error)
+	// End ends the span.
+	End()
+}
+
+// WithTracer returns a Context containing the given tracer, which is used to
+// start spans for operations performed with the context.
+func WithTracer(ctx context.Context, t Tracer) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, trcKey, t)
+}
+
+// StartSpan starts a span with the tracer held in the Context. If the
+// Context does not contain a tracer, a no-op span is returned along with
+// the original Context.
+func StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	if ctx != nil {
+		if t, ok := ctx.Value(trcKey).(Tracer); ok && t != nil {
+			return t.Start(ctx, name)
+		}
+	}
+	return ctx, noopSpan{}
+}
+
+// endSpan marks the span as failed if err is not nil, then ends it.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// noopSpan is a Span that does nothing.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) SetError(err error)                         {}
+func (noopSpan) End()                                       {}
+
+// RecordingTracer is a Tracer that records spans in memory, for use in
+// tests.
+type RecordingTracer struct {
+	mut   sync.Mutex
+	spans []*recordingSpan
+}
+
+// RecordedSpan is a span recorded by RecordingTracer.
+type RecordedSpan struct {
+	Name string
+	// Parent is the name of the parent span, if any.
+	Parent     string
+	Attributes map[string]interface{}
+	Err        error
+	Start      time.Time
+	End        time.Time
+}
+
+// recordingSpan is a Span recording to a RecordingTracer.
+type recordingSpan struct {
+	t *RecordingTracer
+	s RecordedSpan
+}
+
+// Start starts and records a span.
+func (t *RecordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	span := &recordingSpan{
+		t: t,
+		s: RecordedSpan{
+			Name:       name,
+			Attributes: map[string]interface{}{},
+			Start:      time.Now(),
+		},
+	}
+	if parent, ok := ctx.Value(spnKey).(*recordingSpan); ok {
+		span.s.Parent = parent.s.Name
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spnKey, span), span
+}
+
+// Spans returns the spans recorded so far, in the order they were started.
+func (t *RecordingTracer) Spans() []RecordedSpan {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	spans := make([]RecordedSpan, len(t.spans))
+	for i, s := range t.spans {
+		spans[i] = s.s
+		spans[i].Attributes = make(map[string]interface{}, len(s.s.Attributes))
+		for k, v := range s.s.Attributes {
+			spans[i].Attributes[k] = v
+		}
+	}
+	return spans
+}
+
+// Reset discards the recorded spans.
+func (t *RecordingTracer) Reset() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.spans = nil
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) {
+	s.t.mut.Lock()
+	defer s.t.mut.Unlock()
+	s.s.Attributes[key] = value
+}
+
+func (s *recordingSpan) SetError(err error) {
+	s.t.mut.Lock()
+	defer s.t.mut.Unlock()
+	s.s.Err = err
+}
+
+func (s *recordingSpan) End() {
+	s.t.mut.Lock()
+	defer s.t.mut.Unlock()
+	s.s.End = time.Now()
+}
@@ -0,0 +1,118 @@
+package passwordless
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func spanNames(spans []RecordedSpan) []string {
+	names := make([]string, len(spans))
+	for i, s := range spans {
+		names[i] = s.Name
+	}
+	return names
+}
+
+func TestStartSpanNoop(t *testing.T) {
+	ctx, span := StartSpan(nil, "test")
+	assert.Nil(t, ctx)
+	assert.Equal(t, noopSpan{}, span)
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("error"))
+	span.End()
+
+	bg := context.Background()
+	ctx, _ = StartSpan(bg, "test")
+	assert.Equal(t, bg, ctx)
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &RecordingTracer{}
+	p := New(NewMemStore())
+	p.Tracer = tracer
+	tt := &testTransport{}
+	p.SetTransport("test", tt, &testGenerator{token: "1337"}, 5*time.Minute)
+
+	// Request
+	id, err := p.RequestToken(nil, "test", "uid", "recipient")
+	assert.NoError(t, err)
+	spans := tracer.Spans()
+	assert.Equal(t, []string{
+		"Passwordless.RequestToken",
+		"Strategy.Generate",
+		"MemStore.Store",
+		"Strategy.Send",
+	}, spanNames(spans))
+	assert.Equal(t, "", spans[0].Parent)
+	assert.Equal(t, "test", spans[0].Attributes["strategy"])
+	assert.Equal(t, id, spans[0].Attributes["token_id"])
+	for _, s := range spans[1:] {
+		assert.Equal(t, "Passwordless.RequestToken", s.Parent)
+	}
+	for _, s := range spans {
+		assert.False(t, s.End.IsZero(), s.Name)
+		assert.NoError(t, s.Err, s.Name)
+	}
+
+	// Verify
+	tracer.Reset()
+	valid, err := p.VerifyToken(nil, "test", "uid", id, "1337")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	spans = tracer.Spans()
+	assert.Equal(t, []string{
+		"Passwordless.VerifyToken",
+		"MemStore.Consume",
+	}, spanNames(spans))
+	assert.Equal(t, true, spans[0].Attributes["valid"])
+
+	// Every store method is traced
+	tracer.Reset()
+	ctx := WithTracer(nil, tracer)
+	p.Store.Exists(ctx, "uid")
+	p.Store.(ScopedExister).ExistsInScope(ctx, "uid", Scope{})
+	p.Store.List(ctx, "uid")
+	p.Store.RecordFailure(ctx, "uid", id)
+	assert.Equal(t, []string{
+		"MemStore.Exists",
+		"MemStore.ExistsInScope",
+		"MemStore.List",
+		"MemStore.RecordFailure",
+	}, spanNames(tracer.Spans()))
+
+	// Errors are recorded
+	tracer.Reset()
+	_, err = p.VerifyToken(nil, "test", "uid", id, "1337")
+	assert.Equal(t, ErrTokenNotFound, err)
+	spans = tracer.Spans()
+	assert.Equal(t, ErrTokenNotFound, spans[0].Err)
+	assert.Equal(t, ErrTokenNotFound, spans[1].Err)
+
+	tracer.Reset()
+	tt.err = errors.New("refused send")
+	_, err = p.RequestToken(nil, "test", "uid", "recipient")
+	assert.Error(t, err)
+	spans = tracer.Spans()
+	assert.Equal(t, "Strategy.Send", spans[3].Name)
+	assert.Equal(t, tt.err, spans[3].Err)
+	assert.Equal(t, err, spans[0].Err)
+}
+
+func TestTracingSMTP(t *testing.T) {
+	tracer := &RecordingTracer{}
+	tr := NewSMTPTransport("127.0.0.1:1", "from@example.com", nil, nil)
+	err := tr.Send(WithTracer(nil, tracer), "token", "uid", "to@example.com")
+	assert.Error(t, err)
+
+	spans := tracer.Spans()
+	assert.Equal(t, []string{"SMTPTransport.Send", "SMTPTransport.Connect"}, spanNames(spans))
+	assert.Equal(t, "127.0.0.1:1", spans[0].Attributes["smtp.addr"])
+	assert.Equal(t, "SMTPTransport.Send", spans[1].Parent)
+	assert.Equal(t, err, spans[0].Err)
+	assert.Equal(t, err, spans[1].Err)
+}
@@ -0,0 +1,131 @@
+package passwordless
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"context"
+)
+
+const (
+	// DefaultFailoverThreshold is the default number of consecutive
+	// failures after which a transport is skipped.
+	DefaultFailoverThreshold = 3
+	// DefaultFailoverCoolOff is the default period for which a failing
+	// transport is skipped.
+	DefaultFailoverCoolOff = 30 * time.Second
+)
+
+var (
+	ErrNoTransportAvailable = errors.New("all transports are unavailable")
+)
+
+// FailoverError is returned when a token could not be sent by any of the
+// transports of a FailoverTransport.
+type FailoverError struct {
+	// Errs holds the error returned by each transport tried, in order.
+	Errs []error
+}
+
+func (e *FailoverError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return "all transports failed: " + strings.Join(msgs, "; ")
+}
+
+// TransportHealth describes the health of a transport within a
+// FailoverTransport.
+type TransportHealth struct {
+	// Failures is the number of consecutive failed sends.
+	Failures int
+	// Until is when a transport that has failed too often will next be
+	// tried. It is zero if the transport is healthy.
+	Until time.Time
+}
+
+// Available returns true if the transport is currently being tried.
+func (h TransportHealth) Available() bool {
+	return time.Now().After(h.Until)
+}
+
+// FailoverTransport tries each of its transports in order until one
+// succeeds. A transport that fails Threshold times in a row is skipped for
+// the CoolOff period, after which it is tried again. Errors marked with
+// `Permanent` are returned immediately, without trying other transports or
+// counting against the transport's health.
+type FailoverTransport struct {
+	Transports []Transport
+	Threshold  int
+	CoolOff    time.Duration
+	mut        sync.Mutex
+	health     []TransportHealth
+}
+
+// NewFailoverTransport returns a FailoverTransport trying the given
+// transports in order.
+func NewFailoverTransport(transports ...Transport) *FailoverTransport {
+	return &FailoverTransport{
+		Transports: transports,
+		Threshold:  DefaultFailoverThreshold,
+		CoolOff:    DefaultFailoverCoolOff,
+		health:     make([]TransportHealth, len(transports)),
+	}
+}
+
+// Send sends the token with the first available transport to succeed. If
+// all transports are being skipped, `ErrNoTransportAvailable` is returned;
+// otherwise, if all fail, a `*FailoverError` is returned.
+func (f *FailoverTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	errs := []error{}
+	for i, t := range f.Transports {
+		if !f.Health(i).Available() {
+			continue
+		}
+		err := t.Send(ctx, token, uid, recipient)
+		if err == nil {
+			f.record(i, true)
+			return nil
+		} else if IsPermanent(err) {
+			return err
+		}
+		f.record(i, false)
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return ErrNoTransportAvailable
+	}
+	return &FailoverError{Errs: errs}
+}
+
+// Health returns the health of the i'th transport.
+func (f *FailoverTransport) Health(i int) TransportHealth {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if i >= len(f.health) {
+		return TransportHealth{}
+	}
+	return f.health[i]
+}
+
+// record records the outcome of a send with the i'th transport.
+func (f *FailoverTransport) record(i int, ok bool) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if len(f.health) < len(f.Transports) {
+		// Transports were added after construction
+		f.health = append(f.health, make([]TransportHealth, len(f.Transports)-len(f.health))...)
+	}
+	h := &f.health[i]
+	if ok {
+		*h = TransportHealth{}
+		return
+	}
+	h.Failures++
+	if h.Failures >= f.Threshold && f.Threshold > 0 {
+		h.Until = time.Now().Add(f.CoolOff)
+	}
+}
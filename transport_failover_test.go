@@ -0,0 +1,65 @@
+package passwordless
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailoverTransport(t *testing.T) {
+	primary := &flakyTransport{failures: 100, err: errors.New("primary down")}
+	backup := &flakyTransport{}
+	f := NewFailoverTransport(primary, backup)
+	f.Threshold = 2
+	f.CoolOff = 50 * time.Millisecond
+
+	// Primary fails, so backup is used
+	assert.NoError(t, f.Send(nil, "t1", "uid", "recipient"))
+	assert.Equal(t, 1, backup.count())
+	assert.Equal(t, 1, f.Health(0).Failures)
+	assert.True(t, f.Health(0).Available())
+
+	// Primary reaches threshold and is skipped
+	assert.NoError(t, f.Send(nil, "t2", "uid", "recipient"))
+	assert.False(t, f.Health(0).Available())
+	primary.failures = 0
+	assert.NoError(t, f.Send(nil, "t3", "uid", "recipient"))
+	assert.Equal(t, 0, primary.count())
+	assert.Equal(t, 3, backup.count())
+
+	// Primary is retried after cool off, and recovers
+	time.Sleep(f.CoolOff)
+	assert.NoError(t, f.Send(nil, "t4", "uid", "recipient"))
+	assert.Equal(t, 1, primary.count())
+	assert.Equal(t, TransportHealth{}, f.Health(0))
+	assert.Equal(t, TransportHealth{}, f.Health(1))
+}
+
+func TestFailoverTransportErrors(t *testing.T) {
+	a := &flakyTransport{failures: 100, err: errors.New("a down")}
+	b := &flakyTransport{failures: 100, err: errors.New("b down")}
+	f := NewFailoverTransport(a, b)
+	f.Threshold = 1
+	f.CoolOff = time.Minute
+
+	// All transports fail
+	err := f.Send(nil, "t1", "uid", "recipient")
+	assert.EqualError(t, err, "all transports failed: a down; b down")
+	if ferr, ok := err.(*FailoverError); assert.True(t, ok) {
+		assert.Len(t, ferr.Errs, 2)
+	}
+
+	// All transports are skipped
+	assert.Equal(t, ErrNoTransportAvailable, f.Send(nil, "t2", "uid", "recipient"))
+
+	// Permanent errors are returned immediately, and don't affect health
+	c := &flakyTransport{failures: 1, err: Permanent(errors.New("bad address"))}
+	d := &flakyTransport{}
+	f = NewFailoverTransport(c, d)
+	err = f.Send(nil, "t3", "uid", "recipient")
+	assert.True(t, IsPermanent(err))
+	assert.Equal(t, 0, d.count())
+	assert.Equal(t, 0, f.Health(0).Failures)
+}
@@ -0,0 +1,346 @@
+package passwordless
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"context"
+)
+
+const (
+	// DefaultQueueAttempts is the default number of attempts made to
+	// deliver each token.
+	DefaultQueueAttempts = 5
+	// DefaultQueueBaseDelay is the default delay before the first retry.
+	DefaultQueueBaseDelay = time.Second
+	// DefaultQueueMaxDelay is the default maximum delay between retries.
+	DefaultQueueMaxDelay = time.Minute
+	// DefaultStatusRetention is the default period for which the status of
+	// completed deliveries is kept.
+	DefaultStatusRetention = time.Hour
+)
+
+var (
+	ErrQueueFull   = errors.New("delivery queue is full")
+	ErrQueueClosed = errors.New("delivery queue has been shut down")
+)
+
+// permanentError marks an error as not worth retrying.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps an error returned by a Transport to indicate that
+// retrying the delivery will not succeed, for example because the recipient
+// address is invalid.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsPermanent returns true if the error was marked with `Permanent`.
+func IsPermanent(err error) bool {
+	var perr *permanentError
+	return errors.As(err, &perr)
+}
+
+// DeliveryStatus describes the progress of a queued delivery.
+type DeliveryStatus int
+
+const (
+	StatusQueued DeliveryStatus = iota + 1
+	StatusSending
+	StatusRetrying
+	StatusDelivered
+	StatusFailed
+)
+
+var deliveryStatusNames = map[DeliveryStatus]string{
+	StatusQueued:    "queued",
+	StatusSending:   "sending",
+	StatusRetrying:  "retrying",
+	StatusDelivered: "delivered",
+	StatusFailed:    "failed",
+}
+
+func (s DeliveryStatus) String() string {
+	if name, ok := deliveryStatusNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// DeliveryState is the state of a queued delivery.
+type DeliveryState struct {
+	Status DeliveryStatus
+	// Attempts is the number of delivery attempts made so far.
+	Attempts int
+	// Err is the error returned by the most recent attempt.
+	Err error
+	// Updated is when the state last changed.
+	Updated time.Time
+}
+
+// queueJob is a token waiting to be delivered.
+type queueJob struct {
+	ctx                       context.Context
+	id, token, uid, recipient string
+}
+
+// QueueTransport wraps a Transport, queueing tokens to be sent by a pool of
+// workers so that `Send` returns immediately. Failed deliveries are retried
+// with exponential backoff and jitter, unless the error is marked with
+// `Permanent`.
+//
+// As `Send` returns before the token is delivered, delivery failures are
+// not reported to `RequestToken`. Instead, the status of each delivery can
+// be retrieved by token ID with `Status`.
+//
+// The context passed to the wrapped transport retains the values of the
+// original context, but not its deadline or cancellation. Transports should
+// not use the `ResponseWriter` or `Request` set with `SetContext`, as the
+// request may have completed by the time the token is sent.
+type QueueTransport struct {
+	Transport Transport
+	// MaxAttempts is the maximum number of delivery attempts.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubling with each
+	// subsequent retry up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Retryable reports whether a delivery that failed with the given
+	// error should be retried. If nil, all errors not marked with
+	// `Permanent` are retried.
+	Retryable func(error) bool
+	// StatusRetention is the period for which the status of completed
+	// deliveries is kept.
+	StatusRetention time.Duration
+
+	jobs      chan queueJob
+	abort     chan struct{}
+	wg        sync.WaitGroup
+	mut       sync.Mutex
+	closed    bool
+	status    map[string]DeliveryState
+	lastPrune time.Time
+}
+
+// NewQueueTransport returns a QueueTransport delivering tokens through the
+// given transport with the specified number of workers. Up to `size` tokens
+// can be queued before `Send` returns `ErrQueueFull`.
+func NewQueueTransport(t Transport, workers, size int) *QueueTransport {
+	q := &QueueTransport{
+		Transport:       t,
+		MaxAttempts:     DefaultQueueAttempts,
+		BaseDelay:       DefaultQueueBaseDelay,
+		MaxDelay:        DefaultQueueMaxDelay,
+		StatusRetention: DefaultStatusRetention,
+		jobs:            make(chan queueJob, size),
+		abort:           make(chan struct{}),
+		status:          make(map[string]DeliveryState),
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// Send queues the token for delivery. The delivery status is tracked by the
+// token ID provided in the context (see `TokenID`).
+func (q *QueueTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	job := queueJob{
+		ctx:       detachedContext{ctx},
+		id:        TokenID(ctx),
+		token:     token,
+		uid:       uid,
+		recipient: recipient,
+	}
+	select {
+	case q.jobs <- job:
+	default:
+		return ErrQueueFull
+	}
+	q.setStatus(job.id, DeliveryState{Status: StatusQueued})
+	q.prune()
+	return nil
+}
+
+// Status returns the delivery state of the token with the given ID, and
+// false if it is not known.
+func (q *QueueTransport) Status(id string) (DeliveryState, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	s, ok := q.status[id]
+	return s, ok
+}
+
+// Shutdown stops accepting new tokens and waits for queued tokens to be
+// delivered. If the context ends first, outstanding retries are abandoned
+// and the context's error is returned.
+func (q *QueueTransport) Shutdown(ctx context.Context) error {
+	q.mut.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mut.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.mut.Lock()
+		select {
+		case <-q.abort:
+		default:
+			close(q.abort)
+		}
+		q.mut.Unlock()
+		return ctx.Err()
+	}
+}
+
+// work delivers queued tokens until the queue is closed.
+func (q *QueueTransport) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		q.deliver(job)
+	}
+}
+
+// deliver sends the token, retrying as necessary.
+func (q *QueueTransport) deliver(job queueJob) {
+	state := DeliveryState{}
+	for {
+		select {
+		case <-q.abort:
+			state.Status = StatusFailed
+			if state.Err == nil {
+				state.Err = ErrQueueClosed
+			}
+			q.update(job.id, state)
+			return
+		default:
+		}
+
+		state.Status = StatusSending
+		q.update(job.id, state)
+		state.Err = q.Transport.Send(job.ctx, job.token, job.uid, job.recipient)
+		state.Attempts++
+		if state.Err == nil {
+			state.Status = StatusDelivered
+			q.update(job.id, state)
+			return
+		} else if !q.retryable(state.Err) || state.Attempts >= q.MaxAttempts {
+			state.Status = StatusFailed
+			q.update(job.id, state)
+			return
+		}
+
+		state.Status = StatusRetrying
+		q.update(job.id, state)
+		select {
+		case <-time.After(q.backoff(state.Attempts)):
+		case <-q.abort:
+		}
+	}
+}
+
+// retryable returns true if a delivery failing with the error should be
+// retried.
+func (q *QueueTransport) retryable(err error) bool {
+	if q.Retryable != nil {
+		return q.Retryable(err)
+	}
+	return !IsPermanent(err)
+}
+
+// backoff returns a random delay before the next attempt, up to an
+// exponentially increasing limit.
+func (q *QueueTransport) backoff(attempts int) time.Duration {
+	limit := q.BaseDelay
+	for i := 1; i < attempts && limit < q.MaxDelay; i++ {
+		limit *= 2
+	}
+	if q.MaxDelay > 0 && limit > q.MaxDelay {
+		limit = q.MaxDelay
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit))) + 1
+}
+
+// update sets the delivery state of the token with the given ID.
+func (q *QueueTransport) update(id string, s DeliveryState) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.setStatus(id, s)
+}
+
+// setStatus sets the delivery state of the token. The caller must hold the
+// lock.
+func (q *QueueTransport) setStatus(id string, s DeliveryState) {
+	if id == "" {
+		return
+	}
+	s.Updated = time.Now()
+	q.status[id] = s
+}
+
+// prune discards the status of deliveries completed before the retention
+// period. The caller must hold the lock.
+func (q *QueueTransport) prune() {
+	if time.Since(q.lastPrune) < q.StatusRetention/10 {
+		return
+	}
+	q.lastPrune = time.Now()
+	for id, s := range q.status {
+		done := s.Status == StatusDelivered || s.Status == StatusFailed
+		if done && time.Since(s.Updated) > q.StatusRetention {
+			delete(q.status, id)
+		}
+	}
+}
+
+// detachedContext is a Context that retains the values of its parent, but
+// not its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	if c.parent == nil {
+		return nil
+	}
+	return c.parent.Value(key)
+}
@@ -0,0 +1,170 @@
+package passwordless
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyTransport fails the given number of times before succeeding.
+type flakyTransport struct {
+	mut      sync.Mutex
+	failures int
+	err      error
+	sent     []string
+	block    chan struct{}
+}
+
+func (t *flakyTransport) Send(ctx context.Context, token, uid, recipient string) error {
+	if t.block != nil {
+		<-t.block
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.failures > 0 {
+		t.failures--
+		return t.err
+	}
+	t.sent = append(t.sent, token)
+	return nil
+}
+
+func (t *flakyTransport) count() int {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return len(t.sent)
+}
+
+func newTestQueue(t Transport, workers, size int) *QueueTransport {
+	q := NewQueueTransport(t, workers, size)
+	q.BaseDelay = time.Millisecond
+	q.MaxDelay = 5 * time.Millisecond
+	return q
+}
+
+func TestQueueTransportRetry(t *testing.T) {
+	ft := &flakyTransport{failures: 2, err: errors.New("temporary")}
+	q := newTestQueue(ft, 2, 10)
+
+	assert.NoError(t, q.Send(withTokenID(nil, "id1"), "token", "uid", "recipient"))
+	assert.NoError(t, q.Shutdown(context.Background()))
+
+	assert.Equal(t, 1, ft.count())
+	s, ok := q.Status("id1")
+	assert.True(t, ok)
+	assert.Equal(t, StatusDelivered, s.Status)
+	assert.Equal(t, 3, s.Attempts)
+	assert.NoError(t, s.Err)
+
+	_, ok = q.Status("unknown")
+	assert.False(t, ok)
+}
+
+func TestQueueTransportFailure(t *testing.T) {
+	// Permanent errors aren't retried
+	ft := &flakyTransport{failures: 10, err: Permanent(errors.New("bad address"))}
+	q := newTestQueue(ft, 1, 10)
+	assert.NoError(t, q.Send(withTokenID(nil, "id1"), "token", "uid", "recipient"))
+	assert.NoError(t, q.Shutdown(context.Background()))
+	s, _ := q.Status("id1")
+	assert.Equal(t, StatusFailed, s.Status)
+	assert.Equal(t, 1, s.Attempts)
+	assert.True(t, IsPermanent(s.Err))
+	assert.EqualError(t, s.Err, "bad address")
+
+	// Retries are limited
+	ft = &flakyTransport{failures: 10, err: errors.New("temporary")}
+	q = newTestQueue(ft, 1, 10)
+	q.MaxAttempts = 3
+	assert.NoError(t, q.Send(withTokenID(nil, "id2"), "token", "uid", "recipient"))
+	assert.NoError(t, q.Shutdown(context.Background()))
+	s, _ = q.Status("id2")
+	assert.Equal(t, StatusFailed, s.Status)
+	assert.Equal(t, 3, s.Attempts)
+	assert.Equal(t, 0, ft.count())
+}
+
+func TestQueueTransportFull(t *testing.T) {
+	ft := &flakyTransport{block: make(chan struct{})}
+	q := newTestQueue(ft, 1, 1)
+
+	// First is taken by the worker, second fills the queue
+	assert.NoError(t, q.Send(withTokenID(nil, "id1"), "token", "uid", "recipient"))
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, q.Send(withTokenID(nil, "id2"), "token", "uid", "recipient"))
+	assert.Equal(t, ErrQueueFull, q.Send(withTokenID(nil, "id3"), "token", "uid", "recipient"))
+	s, _ := q.Status("id2")
+	assert.Equal(t, StatusQueued, s.Status)
+
+	// Queued tokens are drained on shutdown
+	close(ft.block)
+	assert.NoError(t, q.Shutdown(context.Background()))
+	assert.Equal(t, 2, ft.count())
+	assert.Equal(t, ErrQueueClosed, q.Send(nil, "token", "uid", "recipient"))
+}
+
+func TestQueueTransportShutdownTimeout(t *testing.T) {
+	ft := &flakyTransport{failures: 100, err: errors.New("temporary")}
+	q := NewQueueTransport(ft, 1, 10)
+	q.BaseDelay = time.Hour
+	q.MaxDelay = time.Hour
+	assert.NoError(t, q.Send(withTokenID(nil, "id1"), "token", "uid", "recipient"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, q.Shutdown(ctx))
+
+	// Retry is abandoned
+	assert.Eventually(t, func() bool {
+		s, _ := q.Status("id1")
+		return s.Status == StatusFailed
+	}, time.Second, time.Millisecond)
+}
+
+func TestQueueTransportContext(t *testing.T) {
+	var got context.Context
+	done := make(chan struct{})
+	q := NewQueueTransport(transportFunc(func(ctx context.Context, token, uid, recipient string) error {
+		got = ctx
+		close(done)
+		return nil
+	}), 1, 1)
+
+	ctx, cancel := context.WithCancel(WithPurpose(nil, "signin"))
+	assert.NoError(t, q.Send(withTokenID(ctx, "id1"), "token", "uid", "recipient"))
+	cancel()
+	<-done
+
+	// Values are retained, but not cancellation
+	assert.Equal(t, "signin", Purpose(got))
+	assert.Equal(t, "id1", TokenID(got))
+	assert.NoError(t, got.Err())
+	assert.NoError(t, q.Shutdown(context.Background()))
+}
+
+func TestQueueTransportBackoff(t *testing.T) {
+	q := &QueueTransport{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for attempts, limit := range map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 40 * time.Millisecond,
+		4: 50 * time.Millisecond,
+		9: 50 * time.Millisecond,
+	} {
+		for i := 0; i < 20; i++ {
+			d := q.backoff(attempts)
+			assert.True(t, d > 0 && d <= limit, "%d: %s", attempts, d)
+		}
+	}
+}
+
+type transportFunc func(ctx context.Context, token, uid, recipient string) error
+
+func (f transportFunc) Send(ctx context.Context, token, uid, recipient string) error {
+	return f(ctx, token, uid, recipient)
+}
@@ -40,48 +40,16 @@ func NewSMTPTransport(addr, from string, auth smtp.Auth, c ComposerFunc) *SMTPTr
 
 // Send sends an email to the email address specified in `recipient`,
 // containing the user token provided.
-func (t *SMTPTransport) Send(ctx context.Context, token, uid, recipient string) error {
-	host, _, _ := net.SplitHostPort(t.addr)
+func (t *SMTPTransport) Send(ctx context.Context, token, uid, recipient string) (err error) {
+	ctx, span := StartSpan(ctx, "SMTPTransport.Send")
+	span.SetAttribute("smtp.addr", t.addr)
+	defer func() { endSpan(span, err) }()
 
-	// If UseSSL is true, need to ensure the connection is made over a
-	// TLS channel.
-	var c *smtp.Client
-	if t.UseSSL {
-		// Connect with SSL handshake
-		tlscfg := &tls.Config{
-			ServerName: host,
-		}
-		if conn, err := tls.Dial("tcp", t.addr, tlscfg); err != nil {
-			return err
-		} else if c, err = smtp.NewClient(conn, host); err != nil {
-			defer c.Close()
-			defer conn.Close()
-			return err
-		}
-	} else {
-		// Not using SSL handshake
-		if cl, err := smtp.Dial(t.addr); err != nil {
-			return err
-		} else {
-			c = cl
-			defer c.Close()
-		}
-	}
-
-	// Use STARTTLS if available
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: host}
-		if err := c.StartTLS(config); err != nil {
-			return err
-		}
-	}
-
-	// Use auth credentials if supported and provided
-	if ok, _ := c.Extension("AUTH"); ok && t.auth != nil {
-		if err := c.Auth(t.auth); err != nil {
-			return err
-		}
+	c, err := t.connect(ctx)
+	if err != nil {
+		return err
 	}
+	defer c.Close()
 
 	// Compose email
 	if err := c.Mail(t.from); err != nil {
@@ -111,6 +79,54 @@ func (t *SMTPTransport) Send(ctx context.Context, token, uid, recipient string)
 	return c.Quit()
 }
 
+// connect connects to the email server, using TLS and authenticating if
+// available.
+func (t *SMTPTransport) connect(ctx context.Context) (c *smtp.Client, err error) {
+	_, span := StartSpan(ctx, "SMTPTransport.Connect")
+	defer func() { endSpan(span, err) }()
+
+	host, _, _ := net.SplitHostPort(t.addr)
+
+	// If UseSSL is true, need to ensure the connection is made over a
+	// TLS channel.
+	if t.UseSSL {
+		// Connect with SSL handshake
+		tlscfg := &tls.Config{
+			ServerName: host,
+		}
+		conn, err := tls.Dial("tcp", t.addr, tlscfg)
+		if err != nil {
+			return nil, err
+		}
+		if c, err = smtp.NewClient(conn, host); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else if c, err = smtp.Dial(t.addr); err != nil {
+		// Not using SSL handshake
+		return nil, err
+	}
+
+	// Use STARTTLS if available
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := &tls.Config{ServerName: host}
+		if err := c.StartTLS(config); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	// Use auth credentials if supported and provided
+	if ok, _ := c.Extension("AUTH"); ok && t.auth != nil {
+		if err := c.Auth(t.auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
 // Email is a helper for creating multipart (text and html) emails
 type Email struct {
 	Body    []struct{ t, c string }
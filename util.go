@@ -0,0 +1,25 @@
+package passwordless
+
+import (
+	"context"
+	"time"
+)
+
+// millis returns the time in milliseconds since the Unix epoch.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// fromMillis returns the time of the given milliseconds since the Unix
+// epoch.
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// orBackground returns the context, or a background context if nil.
+func orBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}